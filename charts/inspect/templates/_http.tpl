@@ -0,0 +1,249 @@
+{{/*
+A test of the http TestSuite, which runs "inspect http" with a command. Expects a dict of the root context
+("root"), the test's "description", the "command" run, the "instance" name its metrics are pushed as, and the
+"args" following the command as YAML list items.
+*/}}
+{{- define "inspect.httpTest" -}}
+{{- $ := .root -}}
+- description: {{ .description }}
+  template:
+    metadata:
+      {{- if or $.Values.podAnnotations $.Values.inspections.http.podAnnotations }}
+      annotations:
+        {{- with $.Values.podAnnotations }}
+        {{- toYaml . | nindent 8 }}
+        {{- end }}
+        {{- with $.Values.inspections.http.podAnnotations }}
+        {{- toYaml . | nindent 8 }}
+        {{- end }}
+      {{- end }}
+      labels:
+        {{- include "inspect.labels" $ | nindent 8 }}
+        {{- with $.Values.podLabels }}
+        {{- toYaml . | nindent 8 }}
+        {{- end }}
+    spec:
+      {{- with $.Values.imagePullSecrets }}
+      imagePullSecrets:
+        {{- toYaml . | nindent 8 }}
+      {{- end }}
+      {{- if or $.Values.inspections.http.serviceAccount.create $.Values.inspections.http.serviceAccount.fullnameOverride }}
+      serviceAccountName: {{ default (include "inspect.httpName" $) $.Values.inspections.http.serviceAccount.fullnameOverride }}
+      {{- else }}
+      automountServiceAccountToken: false
+      {{- end }}
+      securityContext:
+        {{- toYaml $.Values.podSecurityContext | nindent 8 }}
+      containers:
+        - name: konfirm-http
+          image: "{{ $.Values.image.repository }}:{{ $.Values.image.tag | default $.Chart.AppVersion }}"
+          args:
+            - --healthz
+            - "0.0.0.0:8080"
+            - --log-format
+            - {{ default $.Values.logging.format $.Values.inspections.http.logging.format }}
+            - --log-level
+            - {{ default $.Values.logging.level $.Values.inspections.http.logging.level }}
+            {{- if $.Values.monitoring.gateway }}
+            - --metrics-gateway
+            - {{ $.Values.monitoring.gateway | quote }}
+            - --metrics-instance
+            - {{ printf "%s%s" $.Values.inspections.http.monitoring.instancePrefix .instance }}
+            - --metrics-job
+            - {{ default (include "inspect.httpName" $ | replace "-" "_" | quote) $.Values.inspections.http.monitoring.job }}
+            {{- end }}
+            - http
+            - {{ .command }}
+            {{- .args | trim | nindent 12 }}
+          imagePullPolicy: {{ $.Values.image.pullPolicy }}
+          securityContext:
+            {{- toYaml $.Values.securityContext | nindent 12 }}
+          ports:
+            - name: http-probes
+              containerPort: 8080
+          livenessProbe:
+            httpGet:
+              path: /
+              port: http-probes
+          resources:
+            {{- toYaml $.Values.inspections.http.resources | nindent 12 }}
+          {{- if or (not ($.Values.volumeMounts | empty)) (not ($.Values.inspections.http.volumeMounts | empty)) }}
+          volumeMounts:
+            {{- with $.Values.volumeMounts }}
+            {{- toYaml . | nindent 12 }}
+            {{- end }}
+            {{- with $.Values.inspections.http.volumeMounts }}
+            {{- toYaml . | nindent 12 }}
+            {{- end }}
+          {{- end }}
+      {{- if or (not ($.Values.volumes | empty)) (not ($.Values.inspections.http.volumes | empty)) }}
+      volumes:
+        {{- with $.Values.volumes }}
+        {{- toYaml . | nindent 8 }}
+        {{- end }}
+        {{- with $.Values.inspections.http.volumes }}
+        {{- toYaml . | nindent 8 }}
+        {{- end }}
+      {{- end }}
+      {{- with (default $.Values.nodeSelector $.Values.inspections.http.nodeSelector) }}
+      nodeSelector:
+        {{- toYaml . | nindent 8 }}
+      {{- end }}
+      {{- with (default $.Values.affinity $.Values.inspections.http.affinity) }}
+      affinity:
+        {{- toYaml . | nindent 8 }}
+      {{- end }}
+      {{- with (default $.Values.tolerations $.Values.inspections.http.tolerations) }}
+      tolerations:
+        {{- toYaml . | nindent 8 }}
+      {{- end }}
+{{- end }}
+
+{{/*
+The http server URL, unless overridden.
+*/}}
+{{- define "inspect.httpServerUrl" }}
+{{- default (printf "http://%s.%s" (include "inspect.httpServerName" .) .Release.Namespace) .Values.inspections.http.serverUrlOverride }}
+{{- end }}
+
+{{/*
+Args authenticating http inspection requests.
+*/}}
+{{- define "inspect.httpAuthArgs" }}
+{{- with .Values.inspections.http.auth.tokenFile }}
+- --token-file
+- {{ . | quote }}
+{{- end }}
+{{- with .Values.inspections.http.auth.hmacKeyFile }}
+- --hmac-key-file
+- {{ . | quote }}
+{{- end }}
+{{- end }}
+
+{{/*
+Args forcing the protocol of http inspection requests.
+*/}}
+{{- define "inspect.httpProtocolArgs" }}
+{{- with .Values.inspections.http.protocol }}
+- --protocol
+- {{ . | quote }}
+{{- end }}
+{{- end }}
+
+{{/*
+Args asserting the client address observed by the http server.
+*/}}
+{{- define "inspect.httpSourceArgs" }}
+{{- with .Values.inspections.http.source }}
+{{- if .preserved }}
+- --expect-source-preserved
+{{- end }}
+{{- range .cidrs }}
+- --expect-source-cidr
+- {{ . | quote }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{/*
+Args of each http inspection command, following the command.
+*/}}
+{{- define "inspect.httpPingArgs" }}
+{{- include "inspect.httpAuthArgs" . }}
+{{- include "inspect.httpProtocolArgs" . }}
+{{- include "inspect.httpSourceArgs" . }}
+{{- if .Values.inspections.http.ping.fanOut }}
+- --fan-out
+- {{ default (printf "http://%s-headless.%s:8080" (include "inspect.httpServerName" .) .Release.Namespace) .Values.inspections.http.serverUrlOverride | quote }}
+{{- else }}
+- {{ include "inspect.httpServerUrl" . | quote }}
+{{- end }}
+{{- end }}
+
+{{- define "inspect.httpReplayArgs" }}
+{{- include "inspect.httpAuthArgs" . }}
+{{- include "inspect.httpProtocolArgs" . }}
+- --concurrency
+- {{ .Values.inspections.http.load.concurrency | quote }}
+- --iterations
+- {{ .Values.inspections.http.load.iterations | quote }}
+{{- with .Values.inspections.http.load.duration }}
+- --duration
+- {{ . | quote }}
+{{- end }}
+- {{ include "inspect.httpServerUrl" . | quote }}
+{{- toYaml .Values.inspections.http.replays | nindent 0 }}
+{{- end }}
+
+{{- define "inspect.httpDistributionArgs" }}
+{{- include "inspect.httpAuthArgs" . }}
+{{- include "inspect.httpSourceArgs" . }}
+- --requests
+- {{ .Values.inspections.http.distribution.requests | quote }}
+- --min-backends
+- {{ .Values.inspections.http.distribution.minBackends | quote }}
+- {{ include "inspect.httpServerUrl" . | quote }}
+{{- end }}
+
+{{- define "inspect.httpWebSocketArgs" }}
+{{- include "inspect.httpAuthArgs" . }}
+- --text
+- {{ .Values.inspections.http.websocket.text | quote }}
+- --binary
+- {{ .Values.inspections.http.websocket.binary | quote }}
+- --message-size
+- {{ .Values.inspections.http.websocket.messageSize | quote }}
+- {{ include "inspect.httpServerUrl" . | quote }}
+{{- end }}
+
+{{- define "inspect.httpDownloadArgs" }}
+{{- include "inspect.httpAuthArgs" . }}
+- --size
+- {{ .Values.inspections.http.download.size | quote }}
+- {{ include "inspect.httpServerUrl" . | quote }}
+{{- end }}
+
+{{- define "inspect.httpUploadArgs" }}
+{{- include "inspect.httpAuthArgs" . }}
+- --size
+- {{ .Values.inspections.http.upload.size | quote }}
+- {{ include "inspect.httpServerUrl" . | quote }}
+{{- end }}
+
+{{- define "inspect.httpHoldArgs" }}
+{{- include "inspect.httpAuthArgs" . }}
+- --duration
+- {{ .Values.inspections.http.hold.duration | quote }}
+- --interval
+- {{ .Values.inspections.http.hold.interval | quote }}
+- {{ include "inspect.httpServerUrl" . | quote }}
+{{- end }}
+
+{{- define "inspect.httpHeadersArgs" }}
+{{- include "inspect.httpAuthArgs" . }}
+{{- with .Values.inspections.http.headers }}
+{{- range $name, $value := .send }}
+- --header
+- {{ printf "%s: %s" $name $value | quote }}
+{{- end }}
+{{- range $name, $size := .large }}
+- --large-header
+- {{ printf "%s=%s" $name $size | quote }}
+{{- end }}
+{{- range $name, $change := .expect }}
+- --expect-change
+- {{ printf "%s=%s" $name $change | quote }}
+{{- end }}
+{{- end }}
+- {{ include "inspect.httpServerUrl" . | quote }}
+{{- end }}
+
+{{/*
+Args of a probe, which is the context, following the probe command.
+*/}}
+{{- define "inspect.httpProbeArgs" }}
+{{- range .args }}
+- {{ . | quote }}
+{{- end }}
+- {{ .url | quote }}
+{{- end }}
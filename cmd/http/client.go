@@ -18,22 +18,231 @@
 package http
 
 import (
+	"math"
 	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/resource"
 
 	"github.com/raft-tech/konfirm-inspections/inspections"
 	"github.com/raft-tech/konfirm-inspections/internal/cli"
 	"github.com/raft-tech/konfirm-inspections/internal/healthz"
 	"github.com/raft-tech/konfirm-inspections/internal/logging"
+	"github.com/raft-tech/konfirm-inspections/pkg/http"
 )
 
 var (
 	metricsGateway string
 	replayBytes    int
+	caCert         string
+	clientCert     string
+	clientKey      string
+	tokenFile      string
+	hmacKeyFile    string
+	runID          string
+	connectTimeout time.Duration
+	respTimeout    time.Duration
+	expectDeny     bool
+	protocol       string
+	concurrency    int
+	iterations     int
+	loadDuration   time.Duration
+	requests       int
+	minBackends    int
+	fanOut         bool
+	srv            bool
+
+	expectSourcePreserved bool
+	expectSourceCIDRs     []string
+
+	probeMethod     string
+	probeHeaders    []string
+	probeBody       string
+	probeBodyFile   string
+	followRedirects bool
+	expectStatus    []string
+	expectHeaders   []string
+	expectBody      []string
+	expectBodyRegex []string
+	expectJSON      []string
+	maxLatency      time.Duration
+
+	textMessages   int
+	binaryMessages int
+	messageSize    string
+
+	holdDuration time.Duration
+	holdInterval time.Duration
+
+	transferSize string
+
+	largeHeaders  []string
+	expectChanges []string
 )
 
+func clientFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&caCert, "ca-cert", "", "verify the server using the PEM encoded CA bundle at the specified path")
+	cmd.Flags().StringVar(&clientCert, "client-cert", "", "present the PEM encoded client certificate at the specified path")
+	cmd.Flags().StringVar(&clientKey, "client-key", "", "the PEM encoded private key for client-cert")
+	cmd.Flags().StringVar(&tokenFile, "token-file", "", "authenticate using the bearer token in the file at the specified path")
+	cmd.Flags().StringVar(&hmacKeyFile, "hmac-key-file", "", "sign requests using the HMAC key in the file at the specified path")
+	cmd.Flags().StringVar(&runID, "run-id", "", "identifies the inspection run in the server's logs (default is random)")
+	cmd.Flags().StringVar(&protocol, "protocol", "", "force the protocol (http/1.1, h2, or h2c with prior knowledge) and fail if it is downgraded")
+	cmd.Flags().DurationVar(&connectTimeout, "connect-timeout", 30*time.Second, "how long establishing a connection may take")
+	cmd.Flags().DurationVar(&respTimeout, "response-timeout", 0, "how long to wait for response headers once a request is sent (0 waits indefinitely)")
+}
+
+func denyFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&expectDeny, "expect-deny", false, "succeed only if the connection is refused, reset, or times out while connecting")
+}
+
+func loadFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVarP(&concurrency, "concurrency", "c", 1, "the number of concurrent workers replaying each spec")
+	cmd.Flags().IntVarP(&iterations, "iterations", "n", 0, "the number of times each spec is replayed (default 1, or unlimited if duration is set)")
+	cmd.Flags().DurationVarP(&loadDuration, "duration", "d", 0, "replay each spec until the duration elapses")
+}
+
+func fanOutFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&fanOut, "fan-out", false, "check every address the server's host resolves to (e.g., a headless Service)")
+	cmd.Flags().BoolVar(&srv, "srv", false, "with fan-out, resolve the server's host as an SRV name")
+}
+
+func sourceFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&expectSourcePreserved, "expect-source-preserved", false, "fail unless the server observes the client's own address")
+	cmd.Flags().StringArrayVar(&expectSourceCIDRs, "expect-source-cidr", nil, "an IP or CIDR within which the server must observe the client's address (repeatable)")
+}
+
+func distributionFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVarP(&requests, "requests", "n", 10, "the number of requests sent")
+	cmd.Flags().IntVar(&minBackends, "min-backends", 2, "the minimum number of distinct backends that must respond")
+	cmd.Flags().IntVarP(&concurrency, "concurrency", "c", 1, "the number of concurrent workers sending requests")
+}
+
+func probeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&probeMethod, "method", "X", "GET", "the request method")
+	cmd.Flags().StringArrayVarP(&probeHeaders, "header", "H", nil, "a request header formatted as NAME: VALUE (repeatable)")
+	cmd.Flags().StringVar(&probeBody, "body", "", "the request body")
+	cmd.Flags().StringVar(&probeBodyFile, "body-file", "", "send the contents of the file at the specified path as the request body")
+	cmd.Flags().BoolVarP(&followRedirects, "follow-redirects", "L", false, "follow redirects and assert on the final response")
+	cmd.Flags().StringArrayVar(&expectStatus, "expect-status", nil, "an acceptable status code, class, or range (e.g., 204, 2xx, or 200-399; repeatable; default 2xx)")
+	cmd.Flags().StringArrayVar(&expectHeaders, "expect-header", nil, "a response header formatted as NAME (present), NAME=VALUE (equal), or NAME~REGEX (matches) (repeatable)")
+	cmd.Flags().StringArrayVar(&expectBody, "expect-body", nil, "a string the response body must contain (repeatable)")
+	cmd.Flags().StringArrayVar(&expectBodyRegex, "expect-body-regex", nil, "a regular expression the response body must match (repeatable)")
+	cmd.Flags().StringArrayVar(&expectJSON, "expect-json", nil, "a dot-separated JSON path in the response body formatted as PATH (present) or PATH=VALUE (equal) (repeatable)")
+	cmd.Flags().DurationVar(&maxLatency, "max-latency", 0, "the maximum time to receive the complete response (0 is unlimited)")
+}
+
+func webSocketFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&textMessages, "text", 4, "the number of text messages exchanged")
+	cmd.Flags().IntVar(&binaryMessages, "binary", 4, "the number of binary messages exchanged")
+	cmd.Flags().StringVar(&messageSize, "message-size", "1Ki", "the size of each message")
+}
+
+func holdFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVarP(&holdDuration, "duration", "d", time.Minute, "how long the stream must survive")
+	cmd.Flags().DurationVar(&holdInterval, "interval", 15*time.Second, "how often the server sends a heartbeat (0 is silent until the stream ends)")
+}
+
+func transferFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&transferSize, "size", "64Mi", "the number of bytes transferred")
+}
+
+func headerFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVarP(&probeHeaders, "header", "H", nil, "a request header formatted as NAME: VALUE (repeatable)")
+	cmd.Flags().StringArrayVar(&largeHeaders, "large-header", nil, "a request header formatted as NAME=SIZE with a generated value SIZE bytes long (repeatable)")
+	cmd.Flags().StringArrayVar(&expectChanges, "expect-change", nil, "how a header is expected to arrive, formatted as NAME=CHANGE (repeatable)")
+}
+
+// headerArgs validates the headers flags and returns them as inspection args.
+func headerArgs() ([]string, error) {
+
+	var args []string
+	for _, h := range probeHeaders {
+		if name, _, ok := strings.Cut(h, ":"); !ok || strings.TrimSpace(name) == "" {
+			return nil, cli.ErrorF(2, "header must be formatted as NAME: VALUE")
+		}
+		args = append(args, "--konfirm.header", h)
+	}
+	for _, h := range largeHeaders {
+		name, size, _ := strings.Cut(h, "=")
+		qty, err := resource.ParseQuantity(size)
+		if strings.TrimSpace(name) == "" || err != nil || qty.Value() <= 0 || qty.Value() > math.MaxInt32 {
+			return nil, cli.ErrorF(2, "large-header must be formatted as NAME=SIZE, where SIZE is a positive quantity (e.g., X-Large=16Ki)")
+		}
+		args = append(args, "--konfirm.large-header", name+"="+strconv.FormatInt(qty.Value(), 10))
+	}
+	for _, c := range expectChanges {
+		name, change, _ := strings.Cut(c, "=")
+		if strings.TrimSpace(name) == "" {
+			return nil, cli.ErrorF(2, "expect-change must be formatted as NAME=CHANGE")
+		} else if _, err := http.ParseHeaderChange(change); err != nil {
+			return nil, cli.Wrap(2, err)
+		}
+		args = append(args, "--konfirm.expect-change", c)
+	}
+	return args, nil
+}
+
+// probeArgs validates the probe flags and returns them as inspection args.
+func probeArgs() ([]string, error) {
+
+	if probeBody != "" && probeBodyFile != "" {
+		return nil, cli.ErrorF(2, "body and body-file are mutually exclusive")
+	}
+	args := []string{"--konfirm.method", probeMethod}
+	for _, h := range probeHeaders {
+		if name, _, ok := strings.Cut(h, ":"); !ok || strings.TrimSpace(name) == "" {
+			return nil, cli.ErrorF(2, "header must be formatted as NAME: VALUE")
+		}
+		args = append(args, "--konfirm.header", h)
+	}
+	if probeBody != "" {
+		args = append(args, "--konfirm.body", probeBody)
+	}
+	if probeBodyFile != "" {
+		args = append(args, "--konfirm.body-file", probeBodyFile)
+	}
+	if followRedirects {
+		args = append(args, "--konfirm.follow-redirects")
+	}
+	for _, s := range expectStatus {
+		if _, err := http.ParseStatusRange(s); err != nil {
+			return nil, cli.Wrap(2, err)
+		}
+		args = append(args, "--konfirm.expect-status", s)
+	}
+	for _, h := range expectHeaders {
+		if _, err := http.ParseHeaderAssertion(h); err != nil {
+			return nil, cli.Wrap(2, err)
+		}
+		args = append(args, "--konfirm.expect-header", h)
+	}
+	for _, b := range expectBody {
+		args = append(args, "--konfirm.expect-body", b)
+	}
+	for _, r := range expectBodyRegex {
+		if _, err := regexp.Compile(r); err != nil {
+			return nil, cli.Wrap(2, err)
+		}
+		args = append(args, "--konfirm.expect-body-regex", r)
+	}
+	for _, j := range expectJSON {
+		if _, err := http.ParseJSONAssertion(j); err != nil {
+			return nil, cli.Wrap(2, err)
+		}
+		args = append(args, "--konfirm.expect-json", j)
+	}
+	if maxLatency > 0 {
+		args = append(args, "--konfirm.max-latency", maxLatency.String())
+	}
+	return args, nil
+}
+
 func client(cmd *cobra.Command, cargs []string) error {
 
 	logger := logging.NewLogger(cmd.OutOrStdout())
@@ -52,6 +261,106 @@ func client(cmd *cobra.Command, cargs []string) error {
 	// Build the inspection args
 	args := inspections.BuildInspectorArgs(cmd.Flags())
 	args = append(args, "--ginkgo.label-filter="+cmd.Name())
+	if caCert != "" {
+		args = append(args, "--konfirm.ca-cert", caCert)
+	}
+	if clientCert != "" || clientKey != "" {
+		args = append(args, "--konfirm.client-cert", clientCert, "--konfirm.client-key", clientKey)
+	}
+	if tokenFile != "" {
+		args = append(args, "--konfirm.token-file", tokenFile)
+	}
+	if hmacKeyFile != "" {
+		args = append(args, "--konfirm.hmac-key-file", hmacKeyFile)
+	}
+	if runID != "" {
+		args = append(args, "--konfirm.run-id", runID)
+	}
+	if p, err := http.ParseProtocol(protocol); err != nil {
+		return cli.Wrap(2, err)
+	} else if len(cargs) > 0 {
+		if err = p.ValidateURL(cargs[0]); err != nil {
+			return cli.Wrap(2, err)
+		}
+	}
+	if protocol != "" {
+		args = append(args, "--konfirm.protocol", protocol)
+	}
+	args = append(args, "--konfirm.connect-timeout", connectTimeout.String())
+	if respTimeout > 0 {
+		args = append(args, "--konfirm.response-timeout", respTimeout.String())
+	}
+	if expectDeny {
+		args = append(args, "--konfirm.expect-deny")
+	}
+	if concurrency > 1 {
+		args = append(args, "--konfirm.concurrency", strconv.Itoa(concurrency))
+	}
+	if iterations > 0 {
+		args = append(args, "--konfirm.iterations", strconv.Itoa(iterations))
+	}
+	if loadDuration > 0 {
+		args = append(args, "--konfirm.duration", loadDuration.String())
+	}
+	if expectSourcePreserved {
+		args = append(args, "--konfirm.expect-source-preserved")
+	}
+	for _, c := range expectSourceCIDRs {
+		if _, err := http.ParseSourcePrefix(c); err != nil {
+			return cli.Wrap(2, err)
+		}
+		args = append(args, "--konfirm.expect-source-cidr", c)
+	}
+	if fanOut {
+		args = append(args, "--konfirm.fan-out")
+	}
+	if srv {
+		args = append(args, "--konfirm.srv")
+	}
+	if cmd.Name() == "distribution" {
+		args = append(args, "--konfirm.requests", strconv.Itoa(requests), "--konfirm.min-backends", strconv.Itoa(minBackends))
+	}
+	if cmd.Name() == "websocket" {
+		size, err := resource.ParseQuantity(messageSize)
+		if err != nil || size.Value() <= 0 {
+			return cli.ErrorF(2, "message-size must be a positive quantity (e.g., 64Ki)")
+		} else if textMessages < 0 || binaryMessages < 0 || textMessages+binaryMessages == 0 {
+			return cli.ErrorF(2, "at least one text or binary message must be exchanged")
+		}
+		args = append(args,
+			"--konfirm.text-messages", strconv.Itoa(textMessages),
+			"--konfirm.binary-messages", strconv.Itoa(binaryMessages),
+			"--konfirm.message-size", strconv.FormatInt(size.Value(), 10))
+	}
+	if cmd.Name() == "hold" {
+		if holdDuration <= 0 || holdDuration > http.MaxHoldDuration {
+			return cli.ErrorF(2, "duration must be positive and no more than %s", http.MaxHoldDuration)
+		} else if holdInterval < 0 {
+			return cli.ErrorF(2, "interval must not be negative")
+		}
+		args = append(args, "--konfirm.hold-duration", holdDuration.String(), "--konfirm.hold-interval", holdInterval.String())
+	}
+	if cmd.Name() == "download" || cmd.Name() == "upload" {
+		size, err := resource.ParseQuantity(transferSize)
+		if err != nil || size.Value() <= 0 || size.Value() > http.MaxTransferSize {
+			return cli.ErrorF(2, "size must be a positive quantity (e.g., 64Mi) no more than %d bytes", http.MaxTransferSize)
+		}
+		args = append(args, "--konfirm.transfer-size", strconv.FormatInt(size.Value(), 10))
+	}
+	if cmd.Name() == "probe" {
+		if pargs, err := probeArgs(); err == nil {
+			args = append(args, pargs...)
+		} else {
+			return err
+		}
+	}
+	if cmd.Name() == "headers" {
+		if hargs, err := headerArgs(); err == nil {
+			args = append(args, hargs...)
+		} else {
+			return err
+		}
+	}
 
 	// Execute the inspection
 	var inspection *exec.Cmd
@@ -18,13 +18,18 @@
 package http
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
 )
 
 func New() *cobra.Command {
 
 	cmd := &cobra.Command{
-		Short:         "Verify HTTP connectivity",
+		Short: "Verify HTTP connectivity",
+		Long: "Verify HTTP connectivity to the server started by serve, or another server.\n\nClients dial a unix " +
+			"socket if the server URL's scheme is http+unix or https+unix, with the socket path percent-encoded " +
+			"as the host (e.g., http+unix://%2Frun%2Fkonfirm%2Fhttp.sock).",
 		SilenceErrors: true,
 		SilenceUsage:  true,
 		Use:           "http [COMMAND]",
@@ -33,16 +38,83 @@ func New() *cobra.Command {
 	server := &cobra.Command{
 		RunE:  serve,
 		Short: "starts the HTTP server",
-		Use:   "serve [--addr ADDRESS]",
+		Long: "Serve starts the HTTP server.\n\nThe --fault-* flags inject faults into responses for testing clients " +
+			"against a misbehaving server. Each is the probability (between 0 and 1) that the fault is injected " +
+			"into a given response, and faults are chosen independently.\n\nThe --max-replay-bytes and " +
+			"--max-concurrent-replays flags limit the replays handled at once. Buffered replays count their size " +
+			"(or --max-replay if chunked or compressed) against --max-replay-bytes. Replays that exceed either limit wait up to " +
+			"--replay-queue-timeout, then are rejected with 503 Service Unavailable and a Retry-After header.\n\n" +
+			"The --*-timeout flags protect the server from slow clients. Replay, upload, and download deadlines " +
+			"are extended by the time taken to transfer their size at --min-transfer-rate, held streams by their " +
+			"duration, and WebSockets have none. Connections closed by each timeout are logged and counted.\n\n" +
+			"The --auth-* flags require requests to present the bearer token in --auth-token-file, or to be signed " +
+			"using the HMAC key in --auth-hmac-key-file (e.g., files mounted from a Secret). Signed requests must be " +
+			"timestamped within --auth-max-skew of the server's clock and may not be reused. Unauthorized requests " +
+			"are rejected with 401 Unauthorized, logged, and counted.\n\n" +
+			"The --listen flag serves the handler on additional listeners, each formatted as " +
+			"[NAME=]NETWORK://ADDRESS, where NETWORK is tcp, tcp4, tcp6, or unix, optionally suffixed with +tls " +
+			"(e.g., tcp6://[::]:8080, unix:///run/konfirm/http.sock, or public=tcp+tls://:8443). The --addr " +
+			"listener serves TLS if it is configured; set it to \"\" to serve only the --listen listeners. " +
+			"Listeners are labelled by NAME, or by NETWORK://ADDRESS if unnamed, in logs and metrics.\n\n" +
+			"The --proxy-protocol flag accepts HAProxy PROXY protocol (v1 or v2) headers on TCP listeners, sent by " +
+			"load balancers to convey the client's address. If optional, connections without a header are also " +
+			"accepted; if required, they are rejected. The client address observed by the server is returned to " +
+			"clients by the check and identity endpoints.",
+		Use: "serve [--addr ADDRESS] [--listen [NAME=]NETWORK://ADDRESS]...",
 	}
 	server.PersistentFlags().StringVarP(&serverAddr, "addr", "l", ":8080", "the address the server will listen on")
+	server.PersistentFlags().StringArrayVar(&listeners, "listen", nil, "an additional listener formatted as [NAME=]NETWORK://ADDRESS (repeatable)")
+	server.PersistentFlags().StringVar(&proxyProtocol, "proxy-protocol", "", "accept PROXY protocol headers on TCP listeners (optional or required)")
 	server.PersistentFlags().StringVarP(&maxReplayRequest, "max-replay", "m", "128Mi", "the maximum replay request size")
+	server.PersistentFlags().StringVar(&maxReplayBytes, "max-replay-bytes", "0", "the total size of the replays handled at once (0 is unlimited)")
+	server.PersistentFlags().IntVar(&replayLimits.MaxConcurrent, "max-concurrent-replays", 0, "the number of replays handled at once (0 is unlimited)")
+	server.PersistentFlags().DurationVar(&replayLimits.QueueTimeout, "replay-queue-timeout", 0, "how long a replay waits for the replay limits before it is rejected (0 rejects immediately)")
+	server.PersistentFlags().DurationVar(&replayLimits.RetryAfter, "replay-retry-after", time.Second, "the Retry-After sent with rejected replays")
+	server.PersistentFlags().DurationVar(&timeouts.ReadHeader, "read-header-timeout", 10*time.Second, "how long reading request headers may take (0 is unlimited)")
+	server.PersistentFlags().DurationVar(&timeouts.Read, "read-timeout", 30*time.Second, "how long reading a request may take, extended for bodies by min-transfer-rate (0 is unlimited)")
+	server.PersistentFlags().DurationVar(&timeouts.Write, "write-timeout", 30*time.Second, "how long writing a response may take, extended for bodies by min-transfer-rate (0 is unlimited)")
+	server.PersistentFlags().DurationVar(&timeouts.Idle, "idle-timeout", 2*time.Minute, "how long a connection may wait for the next request (0 uses read-timeout)")
+	server.PersistentFlags().StringVar(&maxHeaderBytes, "max-header-bytes", "1Mi", "the maximum size of request headers")
+	server.PersistentFlags().StringVar(&minTransferRate, "min-transfer-rate", "1Mi", "the slowest rate in bytes/sec at which bodies are expected to be transferred (0 does not extend timeouts)")
+	server.PersistentFlags().StringVar(&authTokenFile, "auth-token-file", "", "require the bearer token in the file at the specified path")
+	server.PersistentFlags().StringVar(&authHMACKeyFile, "auth-hmac-key-file", "", "require requests signed using the HMAC key in the file at the specified path")
+	server.PersistentFlags().DurationVar(&authMaxSkew, "auth-max-skew", 5*time.Minute, "how far a signed request's timestamp may be from the server's clock")
+	server.PersistentFlags().BoolVar(&streamReplays, "stream-replay", false, "echo replay requests as they are received instead of buffering them")
+	server.PersistentFlags().BoolVar(&enableHTTP2, "http2", true, "accept HTTP/2 connections, negotiated over TLS or as cleartext h2c")
+	server.PersistentFlags().StringVar(&tlsCert, "tls-cert", "", "serve TLS using the PEM encoded certificate at the specified path")
+	server.PersistentFlags().StringVar(&tlsKey, "tls-key", "", "serve TLS using the PEM encoded private key at the specified path")
+	server.PersistentFlags().DurationVar(&tlsReload, "tls-reload-interval", 10*time.Second, "how often tls-cert and tls-key are checked for changes")
+	server.PersistentFlags().BoolVar(&tlsSelfSigned, "tls-self-signed", false, "serve TLS using a self-signed certificate generated at startup")
+	server.PersistentFlags().StringVar(&tlsSelfSignedCA, "tls-self-signed-ca", "", "write the generated self-signed CA to the specified path")
+	server.PersistentFlags().StringSliceVar(&tlsSelfSignedHost, "tls-self-signed-host", nil, "additional DNS names or IPs for the self-signed certificate")
+	server.PersistentFlags().StringVar(&tlsClientCA, "tls-client-ca", "", "require client certificates signed by the PEM encoded CA bundle at the specified path")
+	server.PersistentFlags().Float64Var(&faults.Corrupt, "fault-corrupt", 0, "the probability that a response body is corrupted")
+	server.PersistentFlags().IntVar(&faults.CorruptBytes, "fault-corrupt-bytes", 1, "the number of bytes flipped in a corrupted response body")
+	server.PersistentFlags().Float64Var(&faults.Truncate, "fault-truncate", 0, "the probability that a response body is truncated")
+	server.PersistentFlags().Float64Var(&faults.ContentType, "fault-content-type", 0, "the probability that a response has the wrong Content-Type")
+	server.PersistentFlags().Float64Var(&faults.Delay, "fault-delay", 0, "the probability that response headers are delayed")
+	server.PersistentFlags().DurationVar(&faults.DelayDuration, "fault-delay-duration", time.Second, "how long delayed response headers are delayed")
+	server.PersistentFlags().Float64Var(&faults.Reset, "fault-reset", 0, "the probability that a connection is reset instead of responding")
+	server.PersistentFlags().Float64Var(&faults.Error, "fault-error", 0, "the probability that a 5xx status is returned instead of responding")
 
 	ping := &cobra.Command{
 		RunE:  client,
 		Short: "sends a simple GET request to the server at the specified URL",
-		Use:   "ping URL",
+		Long: "Ping sends a simple GET request to the server at the specified URL.\n\nWith --fan-out, the URL's host " +
+			"(e.g., a headless Service) is resolved and every A/AAAA record, or SRV record with --srv, is checked " +
+			"individually using the original Host header.\n\nWith --expect-deny, ping succeeds only if the server " +
+			"is unreachable (e.g., blocked by a NetworkPolicy): the connection must be refused, reset, or time out " +
+			"while connecting (see --connect-timeout). If the server is reachable, ping exits with code 3.\n\n" +
+			"With --expect-source-preserved, ping fails unless the client address observed by the server (e.g., " +
+			"conveyed by a load balancer using the PROXY protocol) is the client's own address. With " +
+			"--expect-source-cidr, it must be within one of the specified CIDRs instead (e.g., if the client's " +
+			"egress is translated).",
+		Use: "ping URL",
 	}
+	clientFlags(ping)
+	denyFlags(ping)
+	fanOutFlags(ping)
+	sourceFlags(ping)
 
 	replay := &cobra.Command{
 		RunE:  client,
@@ -50,10 +122,114 @@ func New() *cobra.Command {
 		Long: "Replay sends the specified number of bytes to the server at the specified URL and expects to receive " +
 			"the exact same bytes back. SHA256 digests are calculated for the sent and received bytes, and the two " +
 			"are compared. The command is successful only if the HTTP request/response had no error and the digests " +
-			"match.",
+			"match.\n\nEach SPEC is formatted as NAME:SIZE (e.g., medium:64Ki), or as NAME:COUNTxSIZE (e.g., chunky:16x4Ki) " +
+			"to send COUNT chunks of SIZE bytes using chunked transfer-encoding. Either may be followed by " +
+			",encoding=ENCODING to compress the request body, and ,accept=ENCODING to request a compressed response, " +
+			"where ENCODING is gzip, deflate, or br (e.g., compressed:64Ki,encoding=gzip,accept=gzip). The digest of the " +
+			"decoded response is compared, and the replay fails if a proxy stripped or re-applied either encoding. " +
+			"Compressed replays report the bytes sent and received both decoded and on the wire.\n\nBy default " +
+			"each SPEC is replayed once. Use --iterations, --duration and --concurrency to replay each SPEC repeatedly (e.g., 500 times " +
+			"across 16 workers for at most 5 minutes), in which case the success rate, throughput and latency " +
+			"percentiles are reported.\n\nWith --expect-deny, each SPEC is replayed once and replay succeeds only if " +
+			"the server is unreachable, as described for ping.",
 		Use: "replay URL SPEC [SPEC]...",
 	}
+	clientFlags(replay)
+	denyFlags(replay)
+	loadFlags(replay)
+
+	distribution := &cobra.Command{
+		RunE:  client,
+		Short: "reports how requests to the server at the specified URL are distributed across backends",
+		Long: "Distribution sends the specified number of requests to the identity endpoint of the server at the " +
+			"specified URL, each on a new connection, and reports which backends (e.g., the pods behind a " +
+			"Kubernetes Service) responded. The command fails if fewer than the minimum number of distinct " +
+			"backends respond. The client's source address may be asserted as described for ping.",
+		Use: "distribution URL",
+	}
+	clientFlags(distribution)
+	distributionFlags(distribution)
+	sourceFlags(distribution)
+
+	probe := &cobra.Command{
+		RunE:  client,
+		Short: "sends a configurable request to any URL and asserts on the response",
+		Long: "Probe sends a request to the specified URL, which need not be served by inspect http serve, and " +
+			"asserts on the response: its status code, headers, body, JSON values, and latency. Every assertion " +
+			"must be satisfied for the command to be successful. By default only a 2xx status is required, and " +
+			"redirects are not followed.\n\nJSON paths are dot-separated object keys and array indices (e.g., " +
+			"items.0.id). Expected JSON strings are compared as-is, and other values using their JSON encoding " +
+			"(e.g., --expect-json ready=true).",
+		Use: "probe URL",
+	}
+	clientFlags(probe)
+	probeFlags(probe)
+
+	webSocket := &cobra.Command{
+		RunE:  client,
+		Short: "exchanges WebSocket messages with the server at the specified URL",
+		Long: "WebSocket upgrades a connection to the WebSocket endpoint of the server at the specified URL and " +
+			"exchanges the specified number of text and binary messages, each of which the server echoes. SHA256 " +
+			"digests are calculated for the sent and received messages, and the two are compared. The upgrade " +
+			"latency and the round-trip time of each message are reported.",
+		Use: "websocket URL",
+	}
+	clientFlags(webSocket)
+	webSocketFlags(webSocket)
+
+	hold := &cobra.Command{
+		RunE:  client,
+		Short: "holds a long-lived event stream open with the server at the specified URL",
+		Long: "Hold asks the server at the specified URL to hold a Server-Sent Events stream open for the specified " +
+			"duration, sending a heartbeat at the specified interval or, if the interval is 0, going silent until " +
+			"the stream ends. The command fails if the stream does not survive for the full duration, as when an " +
+			"intermediary enforces an idle or maximum connection timeout. How long the stream lasted is reported, " +
+			"as is whether it was cleanly closed, reset, or stalled.",
+		Use: "hold URL",
+	}
+	clientFlags(hold)
+	holdFlags(hold)
+
+	download := &cobra.Command{
+		RunE:  client,
+		Short: "measures download throughput from the server at the specified URL",
+		Long: "Download streams the specified number of bytes from the server at the specified URL and reports " +
+			"the throughput in MB/s. The bytes are verified using the SHA256 digest the server sends as a " +
+			"trailer, or if a proxy removes it, the digest of the bytes the server is expected to send. Unlike " +
+			"replay, only the response carries a body, so egress from the server is measured on its own.",
+		Use: "download URL",
+	}
+	clientFlags(download)
+	transferFlags(download)
+
+	upload := &cobra.Command{
+		RunE:  client,
+		Short: "measures upload throughput to the server at the specified URL",
+		Long: "Upload streams the specified number of bytes to the server at the specified URL and reports the " +
+			"throughput in MB/s. The server hashes the bytes as it receives them and responds with their SHA256 " +
+			"digest, which is compared to the digest of the bytes sent. Unlike replay, only the request carries " +
+			"a body, so ingress to the server is measured on its own.",
+		Use: "upload URL",
+	}
+	clientFlags(upload)
+	transferFlags(upload)
+
+	headers := &cobra.Command{
+		RunE:  client,
+		Short: "reports how request headers sent to the server at the specified URL arrive",
+		Long: "Headers sends a request with the specified headers to the headers endpoint of the server at the " +
+			"specified URL, which echoes the request it received as JSON, and reports how each header arrived: " +
+			"unchanged, modified, removed, or added (e.g., X-Forwarded-For added by an ingress controller). The " +
+			"Host is always reported.\n\nEach header sent, and the Host, must arrive unchanged unless another change " +
+			"is expected using --expect-change NAME=CHANGE, where CHANGE is unchanged, modified, removed, added, or " +
+			"absent. Headers that are added are reported, but not asserted unless expected. Use --large-header " +
+			"NAME=SIZE to send a header SIZE bytes long (e.g., X-Large=16Ki), in which case a proxy rejecting it " +
+			"(e.g., with 431 Request Header Fields Too Large) fails the command.",
+		Use: "headers URL",
+	}
+	clientFlags(headers)
+	headerFlags(headers)
 
-	cmd.AddCommand(server, ping, replay)
+	cmd.AddCommand(server, ping, replay, distribution, probe, webSocket, hold, download, upload, headers)
 	return cmd
 }
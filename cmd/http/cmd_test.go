@@ -19,8 +19,13 @@ package http_test
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"net"
 	gohttp "net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -31,6 +36,7 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"github.com/raft-tech/konfirm-inspections/cmd/http"
+	"github.com/raft-tech/konfirm-inspections/inspections"
 	"github.com/raft-tech/konfirm-inspections/internal/healthz"
 )
 
@@ -53,9 +59,10 @@ func TestHttpCommand(t *testing.T) {
 
 var _ = Describe("command", func() {
 
-	Context("with server", func() {
+	var logger *zap.Logger
+	var serverArgs []string
 
-		var logger *zap.Logger
+	Context("with server", func() {
 
 		It("checks", func(ctx context.Context) {
 			cmd := http.New()
@@ -66,55 +73,321 @@ var _ = Describe("command", func() {
 			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
 		})
 
-		BeforeEach(func() {
-			logger = zap.New(zapcore.NewCore(
-				zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()),
-				zapcore.AddSync(GinkgoWriter),
-				zapcore.LevelOf(zapcore.DebugLevel),
-			))
-			DeferCleanup(func() {
-				_ = logger.Sync()
-			})
-		})
-
-		BeforeEach(func(ctx context.Context) {
-
-			// Creat the http command and add flags defined in Root
-			server := http.New()
-			server.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
-			server.SetOut(GinkgoWriter)
-			server.SetErr(GinkgoWriter)
-
-			// Run the server subcommand
-			sctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
-			DeferCleanup(func() {
-				cancel()
-			})
-			go func(ctx context.Context) {
-				defer GinkgoRecover()
-				server.SetArgs([]string{"serve", "--addr", serverAddr})
-				logger.Debug("starting HTTP server")
-				for i := 0; ; i++ {
-					if err := server.ExecuteContext(ctx); err == nil {
-						logger.Info("started HTTP server")
-					} else if i < 3 {
-						logger.Warn("error starting HTTP server", zap.Error(err), zap.Int("attempt", i+1))
-						time.Sleep(time.Duration(i) * time.Second)
-					} else {
-						Expect(err).NotTo(HaveOccurred(), "exceeded max retry count")
-					}
-				}
-			}(sctx)
+		It("checks with h2c", func(ctx context.Context) {
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"ping", "--protocol", "h2c", "http://" + serverAddr})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+		})
+
+		It("replays under load", func(ctx context.Context) {
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"replay", "--concurrency", "4", "--iterations", "32", "http://" + serverAddr, "small:1Ki", "chunky:4x1Ki"})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+		})
+
+		It("replays compressed bodies", func(ctx context.Context) {
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"replay", "http://" + serverAddr, "compressed:64Ki,encoding=gzip,accept=deflate", "chunky:4x1Ki,accept=br"})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+		})
+
+		It("expects deny", func(ctx context.Context) {
+
+			// A closed port refuses the connection
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			closed := listener.Addr().String()
+			Expect(listener.Close()).To(Succeed())
+
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"ping", "--expect-deny", "--connect-timeout", "1s", "http://" + closed})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+
+			// The server is reachable
+			cmd = http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"replay", "--expect-deny", "http://" + serverAddr, "small:1Ki"})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			err = cmd.ExecuteContext(ctx)
+			var exitErr interface{ ExitCode() int }
+			Expect(errors.As(err, &exitErr)).To(BeTrue())
+			Expect(exitErr.ExitCode()).To(Equal(inspections.ReachableExitCode))
+		})
+
+		It("reports the backend distribution", func(ctx context.Context) {
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"distribution", "--requests", "4", "--min-backends", "1", "http://" + serverAddr})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+
+			// A single server cannot satisfy two backends
+			cmd = http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"distribution", "--requests", "4", "--min-backends", "2", "http://" + serverAddr})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).NotTo(Succeed())
+		})
+
+		It("exchanges websocket messages", func(ctx context.Context) {
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"websocket", "--text", "2", "--binary", "2", "--message-size", "16Ki", "http://" + serverAddr})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+		})
+
+		It("holds a stream open", func(ctx context.Context) {
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"hold", "--duration", "1s", "--interval", "200ms", "http://" + serverAddr})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+		})
+
+		It("downloads and uploads", func(ctx context.Context) {
+			for _, c := range []string{"download", "upload"} {
+				cmd := http.New()
+				cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+				cmd.SetArgs([]string{c, "--size", "4Mi", "http://" + serverAddr})
+				cmd.SetOut(GinkgoWriter)
+				cmd.SetErr(GinkgoWriter)
+				Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+			}
+		})
+
+		It("reports how headers arrive", func(ctx context.Context) {
+			headers := func(args ...string) error {
+				cmd := http.New()
+				cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+				cmd.SetArgs(append(append([]string{"headers"}, args...), "http://"+serverAddr))
+				cmd.SetOut(GinkgoWriter)
+				cmd.SetErr(GinkgoWriter)
+				return cmd.ExecuteContext(ctx)
+			}
+			Expect(headers("-H", "X-Custom: 1", "--large-header", "X-Large=16Ki", "--expect-change", "X-Real-Ip=absent")).To(Succeed())
+			Expect(headers("--expect-change", "X-Forwarded-For=added")).NotTo(Succeed())
+			Expect(headers("--expect-change", "X-Custom=stripped")).To(MatchError(ContainSubstring("header changes must be one of")))
+		})
+
+		It("exposes server metrics", func(ctx context.Context) {
+			cmd := http.New()
+			cmd.SetArgs([]string{"ping", "http://" + serverAddr})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
 
-			// Wait for the server to be available
 			addr := serverProbeAddr
 			if strings.HasPrefix(addr, ":") {
 				addr = "localhost" + addr
 			}
-			Eventually(func() (*gohttp.Response, error) {
-				return gohttp.Get("http://" + addr + "/ready")
-			}).WithTimeout(10 * time.Second).Should(HaveHTTPStatus(gohttp.StatusOK))
+			res, err := gohttp.Get("http://" + addr + "/metrics")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(HaveHTTPBody(ContainSubstring(`konfirm_http_server_requests_total{code="200",handler="check"}`)))
+		})
+
+		It("probes", func(ctx context.Context) {
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"probe", "--expect-status", "200", "--expect-header", "Content-Type=application/json",
+				"--expect-json", "startupId", "--max-latency", "5s", "http://" + serverAddr + "/identity"})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+
+			cmd = http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"probe", "-X", "POST", "--expect-body", "Mic check", "http://" + serverAddr + "/check"})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).NotTo(Succeed())
+		})
+	})
+
+	Context("with TLS server", func() {
+
+		var caFile string
+
+		It("checks", func(ctx context.Context) {
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"ping", "--ca-cert", caFile, "https://" + serverAddr})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+		})
+
+		It("checks with h2", func(ctx context.Context) {
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"ping", "--ca-cert", caFile, "--protocol", "h2", "https://" + serverAddr})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+		})
+
+		BeforeEach(func() {
+			caFile = filepath.Join(GinkgoT().TempDir(), "ca.crt")
+			serverArgs = []string{"--tls-self-signed", "--tls-self-signed-ca", caFile}
+		})
+	})
+
+	Context("with authenticating server", func() {
+
+		var tokenFile, keyFile string
+
+		It("checks and replays with credentials", func(ctx context.Context) {
+			for _, args := range [][]string{
+				{"ping", "--token-file", tokenFile, "http://" + serverAddr},
+				{"ping", "--hmac-key-file", keyFile, "http://" + serverAddr},
+				{"replay", "--token-file", tokenFile, "http://" + serverAddr, "small:1Ki"},
+				{"replay", "--hmac-key-file", keyFile, "http://" + serverAddr, "small:1Ki"},
+			} {
+				cmd := http.New()
+				cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+				cmd.SetArgs(args)
+				cmd.SetOut(GinkgoWriter)
+				cmd.SetErr(GinkgoWriter)
+				Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+			}
+
+			// Requests without credentials are unauthorized
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs([]string{"ping", "http://" + serverAddr})
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			Expect(cmd.ExecuteContext(ctx)).NotTo(Succeed())
+		})
+
+		BeforeEach(func() {
+			dir := GinkgoT().TempDir()
+			tokenFile, keyFile = filepath.Join(dir, "token"), filepath.Join(dir, "key")
+			Expect(os.WriteFile(tokenFile, []byte("s3cret"), 0600)).To(Succeed())
+			Expect(os.WriteFile(keyFile, []byte("k3y"), 0600)).To(Succeed())
+			serverArgs = []string{"--auth-token-file", tokenFile, "--auth-hmac-key-file", keyFile}
+		})
+	})
+
+	Context("with unix socket listener", func() {
+
+		var socket string
+
+		It("checks over the socket and the addr listener", func(ctx context.Context) {
+			for _, server := range []string{"http+unix://" + url.PathEscape(socket), "http://" + serverAddr} {
+				cmd := http.New()
+				cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+				cmd.SetArgs([]string{"ping", server})
+				cmd.SetOut(GinkgoWriter)
+				cmd.SetErr(GinkgoWriter)
+				Expect(cmd.ExecuteContext(ctx)).To(Succeed())
+			}
+		})
+
+		BeforeEach(func() {
+			socket = filepath.Join(GinkgoT().TempDir(), "http.sock")
+			serverArgs = []string{"--listen", "sock=unix://" + socket}
+		})
+	})
+
+	Context("with optional PROXY protocol", func() {
+
+		ping := func(ctx context.Context, args ...string) error {
+			cmd := http.New()
+			cmd.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+			cmd.SetArgs(append(append([]string{"ping"}, args...), "http://"+serverAddr))
+			cmd.SetOut(GinkgoWriter)
+			cmd.SetErr(GinkgoWriter)
+			return cmd.ExecuteContext(ctx)
+		}
+
+		It("asserts the client's source was preserved", func(ctx context.Context) {
+			Expect(ping(ctx, "--expect-source-preserved", "--expect-source-cidr", "127.0.0.0/8")).To(Succeed())
+			Expect(ping(ctx, "--expect-source-cidr", "203.0.113.0/24")).NotTo(Succeed())
+			Expect(ping(ctx, "--expect-source-cidr", "localhost")).To(MatchError(ContainSubstring("IP address or CIDR")))
+		})
+
+		BeforeEach(func() {
+			serverArgs = []string{"--proxy-protocol", "optional"}
 		})
 	})
 
+	BeforeEach(func() {
+		serverArgs = nil
+		logger = zap.New(zapcore.NewCore(
+			zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()),
+			zapcore.AddSync(GinkgoWriter),
+			zapcore.LevelOf(zapcore.DebugLevel),
+		))
+		DeferCleanup(func() {
+			_ = logger.Sync()
+		})
+	})
+
+	JustBeforeEach(func(ctx context.Context) {
+
+		// Creat the http command and add flags defined in Root
+		server := http.New()
+		server.PersistentFlags().String(healthz.ListenFlag, serverProbeAddr, "")
+		server.SetOut(GinkgoWriter)
+		server.SetErr(GinkgoWriter)
+
+		// Run the server subcommand
+		sctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		stopped := make(chan struct{})
+		DeferCleanup(func() {
+			cancel()
+			<-stopped
+		})
+		go func(ctx context.Context) {
+			defer GinkgoRecover()
+			defer close(stopped)
+			server.SetArgs(append([]string{"serve", "--addr", serverAddr}, serverArgs...))
+			logger.Debug("starting HTTP server")
+			for i := 0; ; i++ {
+				if err := server.ExecuteContext(ctx); err == nil {
+					logger.Info("stopped HTTP server")
+					return
+				} else if i < 3 {
+					logger.Warn("error starting HTTP server", zap.Error(err), zap.Int("attempt", i+1))
+					time.Sleep(time.Duration(i) * time.Second)
+				} else {
+					Expect(err).NotTo(HaveOccurred(), "exceeded max retry count")
+				}
+			}
+		}(sctx)
+
+		// Wait for the server to be available
+		addr := serverProbeAddr
+		if strings.HasPrefix(addr, ":") {
+			addr = "localhost" + addr
+		}
+		Eventually(func() (*gohttp.Response, error) {
+			return gohttp.Get("http://" + addr + "/ready")
+		}).WithTimeout(10 * time.Second).Should(HaveHTTPStatus(gohttp.StatusOK))
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", serverAddr)
+			if err == nil {
+				_ = conn.Close()
+			}
+			return err
+		}).WithTimeout(10 * time.Second).Should(Succeed())
+	})
 })
@@ -19,10 +19,16 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"math"
+	"net"
 	gohttp "net/http"
+	"os"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -36,6 +42,32 @@ import (
 var (
 	serverAddr       string
 	maxReplayRequest string
+	streamReplays    bool
+	enableHTTP2      bool
+
+	tlsCert           string
+	tlsKey            string
+	tlsReload         time.Duration
+	tlsSelfSigned     bool
+	tlsSelfSignedCA   string
+	tlsSelfSignedHost []string
+	tlsClientCA       string
+
+	faults http.FaultConfig
+
+	maxReplayBytes string
+	replayLimits   http.ReplayLimits
+
+	maxHeaderBytes  string
+	minTransferRate string
+	timeouts        http.Timeouts
+
+	authTokenFile   string
+	authHMACKeyFile string
+	authMaxSkew     time.Duration
+
+	listeners     []string
+	proxyProtocol string
 )
 
 func serve(cmd *cobra.Command, _ []string) (err error) {
@@ -62,7 +94,7 @@ func serve(cmd *cobra.Command, _ []string) (err error) {
 	if qty, err := resource.ParseQuantity(maxReplayRequest); err != nil {
 		return cli.Wrap(2, errors.Join(errors.New("error parsing max-replay"), err))
 	} else if i, ok := qty.AsInt64(); ok {
-		if i > 536870912 { // If greater than 512Mi
+		if i > 536870912 && !streamReplays { // If greater than 512Mi
 			logger.Warn("max-replay is set to a high number; large replay requests may result in out-of-memory errors")
 		}
 		http.MaxReplayRequestSize = i
@@ -70,54 +102,262 @@ func serve(cmd *cobra.Command, _ []string) (err error) {
 		return cli.ErrorF(2, "max-replay value is too large")
 	}
 
-	server := gohttp.Server{
-		Addr:    serverAddr,
-		Handler: http.NewHandler(),
+	if streamReplays {
+		logger.Info("replays will be streamed; max-replay does not apply")
 	}
 
-	// Start
-	done := make(chan error)
-	go func(out chan<- error) {
-		logger.Info("starting server", zap.String("address", serverAddr))
-		ready(true)
-		out <- server.ListenAndServe()
-		close(out)
-	}(done)
+	if qty, err := resource.ParseQuantity(maxReplayBytes); err != nil {
+		return cli.Wrap(2, errors.Join(errors.New("error parsing max-replay-bytes"), err))
+	} else if i, ok := qty.AsInt64(); ok {
+		replayLimits.MaxBytes = i
+	} else {
+		return cli.ErrorF(2, "max-replay-bytes value is too large")
+	}
+	if err = replayLimits.Validate(); err != nil {
+		return cli.Wrap(2, err)
+	} else if replayLimits.Enabled() {
+		logger.Info("replays are limited",
+			zap.Int64("maxBytes", replayLimits.MaxBytes),
+			zap.Int("maxConcurrent", replayLimits.MaxConcurrent),
+			zap.Duration("queueTimeout", replayLimits.QueueTimeout))
+	}
 
-	select {
+	if qty, err := resource.ParseQuantity(maxHeaderBytes); err != nil {
+		return cli.Wrap(2, errors.Join(errors.New("error parsing max-header-bytes"), err))
+	} else if i, ok := qty.AsInt64(); ok && i <= math.MaxInt32 {
+		timeouts.MaxHeaderBytes = int(i)
+	} else {
+		return cli.ErrorF(2, "max-header-bytes value is too large")
+	}
+	if qty, err := resource.ParseQuantity(minTransferRate); err != nil {
+		return cli.Wrap(2, errors.Join(errors.New("error parsing min-transfer-rate"), err))
+	} else if i, ok := qty.AsInt64(); ok {
+		timeouts.MinTransferRate = i
+	} else {
+		return cli.ErrorF(2, "min-transfer-rate value is too large")
+	}
+	if err = timeouts.Validate(); err != nil {
+		return cli.Wrap(2, err)
+	}
 
-	// Normal shutdowns
-	case <-cmd.Context().Done():
+	if err = faults.Validate(); err != nil {
+		return cli.Wrap(2, err)
+	} else if faults.Enabled() {
+		logger.Warn("fault injection is enabled",
+			zap.Float64("corrupt", faults.Corrupt),
+			zap.Int("corruptBytes", faults.CorruptBytes),
+			zap.Float64("truncate", faults.Truncate),
+			zap.Float64("contentType", faults.ContentType),
+			zap.Float64("delay", faults.Delay),
+			zap.Duration("delayDuration", faults.DelayDuration),
+			zap.Float64("reset", faults.Reset),
+			zap.Float64("error", faults.Error))
+	}
 
-		// Perform shutdown
-		logger.Info("initiating shutdown")
-		ready(false)
-		ctx, cancel := context.WithTimeoutCause(context.Background(), 10*time.Second, errors.New("server shutdown timed out"))
-		defer cancel()
-		if err = server.Shutdown(ctx); err == nil {
-			logger.Info("shutdown complete")
+	http.MaxClockSkew = authMaxSkew
+	var auth http.Credentials
+	if auth, err = http.LoadCredentials(authTokenFile, authHMACKeyFile); err != nil {
+		return cli.Wrap(2, errors.Join(errors.New("error loading auth credentials"), err))
+	} else if auth.Enabled() {
+		logger.Info("requests must be authenticated",
+			zap.Bool("token", auth.Token != ""),
+			zap.Bool("hmac", len(auth.HMACKey) > 0),
+			zap.Duration("maxSkew", http.MaxClockSkew))
+	}
+
+	// Server metrics are exposed by the healthz server
+	if err = http.RegisterServerMetrics(prometheus.DefaultRegisterer); err != nil {
+		logger.Error("error registering server metrics", zap.Error(err))
+	}
+
+	handlerOpts := []http.HandlerOption{http.WithFaults(faults), http.WithReplayLimits(replayLimits), http.WithTimeouts(timeouts), http.WithAuth(auth)}
+	if streamReplays {
+		handlerOpts = append(handlerOpts, http.WithStreamedReplays())
+	}
+	handler := http.NewHandler(handlerOpts...)
+
+	// Configure TLS if set
+	var tlsConfig *tls.Config
+	if tlsConfig, err = serverTLSConfig(logger); err != nil {
+		return
+	}
+	if tlsClientCA != "" {
+		if tlsConfig == nil {
+			return cli.ErrorF(2, "tls-client-ca requires tls-cert/tls-key or tls-self-signed")
+		}
+		if pool, e := http.LoadCertPool(tlsClientCA); e == nil {
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			logger.Info("client certificates are required", zap.String("clientCA", tlsClientCA))
 		} else {
-			logger.Error("an error occurred while shutting down the server", zap.Error(err))
+			return cli.Wrap(2, errors.Join(errors.New("error loading tls-client-ca"), e))
 		}
+	}
+	if !enableHTTP2 {
+		logger.Info("HTTP/2 is disabled")
+	}
+
+	// The addr listener serves TLS if configured, and listen adds more
+	var specs []http.ListenerSpec
+	if serverAddr != "" {
+		spec := http.ListenerSpec{Network: "tcp", Address: serverAddr, TLS: tlsConfig != nil}
+		spec.Name = spec.String()
+		specs = append(specs, spec)
+	}
+	for _, l := range listeners {
+		if spec, e := http.ParseListenerSpec(l); e != nil {
+			return cli.Wrap(2, errors.Join(fmt.Errorf("error parsing listen %q", l), e))
+		} else if spec.TLS && tlsConfig == nil {
+			return cli.ErrorF(2, "listener %s requires tls-cert/tls-key or tls-self-signed", spec.Name)
+		} else {
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) == 0 {
+		return cli.ErrorF(2, "addr or listen must be set")
+	}
+	var proxyPolicy http.ProxyPolicy
+	if proxyPolicy, err = http.ParseProxyPolicy(proxyProtocol); err != nil {
+		return cli.Wrap(2, err)
+	} else if proxyPolicy != http.ProxyIgnore {
+		logger.Info("PROXY protocol headers are accepted on TCP listeners", zap.String("policy", string(proxyPolicy)))
+	}
 
-		// Drain the done channel
-		for e := range done {
-			if !errors.Is(e, gohttp.ErrServerClosed) {
-				logger.Error("a server error occurred", zap.Error(e))
-				if err == nil {
-					err = e
-				}
+	// Each listener is served by its own server; connections closed by timeouts are logged and counted
+	servers := make([]*gohttp.Server, len(specs))
+	lns := make([]net.Listener, len(specs))
+	defer func() {
+		for _, ln := range lns {
+			if ln != nil && err != nil {
+				_ = ln.Close()
 			}
 		}
+	}()
+	for i, spec := range specs {
+		server := &gohttp.Server{Handler: handler}
+		timeouts.Apply(server)
+		http.LabelListener(server, spec.Name)
+
+		// HTTP/2 is negotiated over TLS, and accepted as h2c otherwise
+		switch {
+		case !enableHTTP2:
+			server.TLSNextProto = make(map[string]func(*gohttp.Server, *tls.Conn, gohttp.Handler))
+		case !spec.TLS:
+			server.Handler = http.NewH2CHandler(handler)
+		}
+		if spec.TLS {
+			server.TLSConfig = tlsConfig
+		}
+
+		var ln net.Listener
+		if ln, err = spec.Listen(); err != nil {
+			logger.Error("error listening", zap.String("listener", spec.Name), zap.Error(err))
+			return
+		}
+		if spec.Network != "unix" {
+			ln = http.AcceptProxyHeaders(ln, proxyPolicy)
+		}
+		servers[i], lns[i] = server, http.WatchTimeouts(ln)
+	}
 
-	// Server cli
+	// Start
+	done := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(spec http.ListenerSpec, ln net.Listener) {
+			logger.Info("starting server",
+				zap.String("listener", spec.Name),
+				zap.String("network", spec.Network),
+				zap.String("address", spec.Address),
+				zap.Bool("tls", spec.TLS),
+				zap.Bool("http2", enableHTTP2),
+				zap.Duration("readHeaderTimeout", timeouts.ReadHeader),
+				zap.Duration("readTimeout", timeouts.Read),
+				zap.Duration("writeTimeout", timeouts.Write),
+				zap.Duration("idleTimeout", timeouts.Idle),
+				zap.Int("maxHeaderBytes", timeouts.MaxHeaderBytes))
+			if spec.TLS {
+				done <- server.ServeTLS(ln, "", "")
+			} else {
+				done <- server.Serve(ln)
+			}
+		}(specs[i], lns[i])
+	}
+	ready(true)
+
+	// Serve until the command is done or any server fails, then shut them all down
+	running := len(servers)
+	select {
+	case <-cmd.Context().Done():
+		logger.Info("initiating shutdown")
 	case e := <-done:
-		if !errors.Is(e, gohttp.ErrServerClosed) {
+		running--
+		logger.Error("a server error occurred", zap.Error(e))
+		err = e
+	}
+	ready(false)
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 10*time.Second, errors.New("server shutdown timed out"))
+	defer cancel()
+	var shutdownErrs []error
+	for _, server := range servers {
+		shutdownErrs = append(shutdownErrs, server.Shutdown(ctx))
+	}
+	if e := errors.Join(shutdownErrs...); e == nil {
+		logger.Info("shutdown complete")
+	} else {
+		logger.Error("an error occurred while shutting down the server", zap.Error(e))
+	}
+
+	// Drain the done channel
+	for ; running > 0; running-- {
+		if e := <-done; !errors.Is(e, gohttp.ErrServerClosed) {
 			logger.Error("a server error occurred", zap.Error(e))
-			err = e
+			if err == nil {
+				err = e
+			}
 		}
 	}
 
 	_ = logger.Sync()
 	return
 }
+
+// serverTLSConfig returns the server's TLS configuration, or nil if TLS is not enabled.
+func serverTLSConfig(logger *zap.Logger) (*tls.Config, error) {
+
+	switch {
+
+	case tlsSelfSigned && (tlsCert != "" || tlsKey != ""):
+		return nil, cli.ErrorF(2, "tls-self-signed and tls-cert/tls-key are mutually exclusive")
+
+	case tlsSelfSigned:
+		hosts := append([]string{"localhost", "127.0.0.1", "::1"}, tlsSelfSignedHost...)
+		if h, err := os.Hostname(); err == nil {
+			hosts = append(hosts, h)
+		}
+		ca, cert, err := http.NewSelfSignedCertificate(hosts...)
+		if err != nil {
+			return nil, cli.Wrap(1, errors.Join(errors.New("error generating self-signed certificate"), err))
+		}
+		if tlsSelfSignedCA != "" {
+			if err = os.WriteFile(tlsSelfSignedCA, ca, 0644); err != nil {
+				return nil, cli.Wrap(1, errors.Join(errors.New("error writing self-signed CA"), err))
+			}
+			logger.Info("wrote self-signed CA", zap.String("path", tlsSelfSignedCA))
+		}
+		logger.Debug("generated self-signed certificate", zap.Strings("hosts", hosts), zap.ByteString("ca", ca))
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+
+	case tlsCert != "" && tlsKey != "":
+		reloader, err := http.NewKeyPairReloader(tlsCert, tlsKey, tlsReload)
+		if err != nil {
+			return nil, cli.Wrap(2, errors.Join(errors.New("error loading tls-cert/tls-key"), err))
+		}
+		return &tls.Config{GetCertificate: reloader.GetCertificate}, nil
+
+	case tlsCert != "" || tlsKey != "":
+		return nil, cli.ErrorF(2, "tls-cert and tls-key must be set together")
+
+	default:
+		return nil, nil
+	}
+}
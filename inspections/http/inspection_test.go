@@ -22,8 +22,14 @@ package http
 import (
 	"context"
 	"flag"
-	"io"
+	"net"
 	gohttp "net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -36,30 +42,251 @@ import (
 	"github.com/raft-tech/konfirm-inspections/inspections"
 	"github.com/raft-tech/konfirm-inspections/internal/logging"
 	"github.com/raft-tech/konfirm-inspections/pkg/http"
-	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
 )
 
 var (
 	logger *zap.Logger
 
 	server        string
+	caCert        string
+	clientCert    string
+	clientKey     string
+	tokenFile     string
+	runID         string
+	hmacKeyFile   string
+	connTimeout   time.Duration
+	respTimeout   time.Duration
+	expectDeny    bool
+	protocol      string
+	reachable     atomic.Bool
+	clientOpts    []http.ClientOption
+	httpClient    *gohttp.Client
 	replayEntries []TableEntry
+	loadOpts      http.LoadOptions
+	requests      int
+	minBackends   int
+	fanOut        bool
+	srv           bool
+	sourceCIDRs   []string
+	expectSource  bool
+	endpoints     []TableEntry
+	probeSpec     http.ProbeSpec
+	probeHeaders  []string
+	probeBody     string
+	probeBodyFile string
+	expectStatus  []string
+	expectHeaders []string
+	expectBody    []string
+	expectRegex   []string
+	expectJSON    []string
+	wsSpec        http.WebSocketSpec
+	holdSpec      http.HoldSpec
+	transferSize  int64
+	headerSpec    http.HeaderSpec
+	largeHeaders  []string
+	expectChanges []string
 
 	// Ping Metrics
-	pingSuccess  prometheus.Gauge
+	pingSuccess  *prometheus.GaugeVec
 	pingDuration prometheus.Gauge
+	pingPhases   *prometheus.GaugeVec
+	pingFailure  *prometheus.GaugeVec
+	pingDenied   prometheus.Gauge
+
+	// Fan-out Ping Metrics
+	endpointSuccess  *prometheus.GaugeVec
+	endpointDuration *prometheus.GaugeVec
+	endpointDenied   *prometheus.GaugeVec
 
 	// Replay Metrics
-	replaySuccess  *prometheus.GaugeVec
-	replayDuration *prometheus.GaugeVec
+	replaySuccess      *prometheus.GaugeVec
+	replayDuration     *prometheus.GaugeVec
+	replayPhases       *prometheus.GaugeVec
+	replayFailure      *prometheus.GaugeVec
+	replaySent         *prometheus.GaugeVec
+	replayReceived     *prometheus.GaugeVec
+	replayWireSent     *prometheus.GaugeVec
+	replayWireReceived *prometheus.GaugeVec
+	replayDenied       *prometheus.GaugeVec
+
+	// Replay Load Metrics
+	replayLatency    *prometheus.HistogramVec
+	replayQuantiles  *prometheus.GaugeVec
+	replaySuccesses  *prometheus.GaugeVec
+	replayThroughput *prometheus.GaugeVec
+
+	// Distribution Metrics
+	distributionSuccess  prometheus.Gauge
+	distributionBackends prometheus.Gauge
+	distributionRequests *prometheus.GaugeVec
+
+	// Probe Metrics
+	probeSuccess  *prometheus.GaugeVec
+	probeDuration prometheus.Gauge
+	probePhases   *prometheus.GaugeVec
+	probeFailure  *prometheus.GaugeVec
+	probeStatus   prometheus.Gauge
+
+	// WebSocket Metrics
+	wsSuccess   *prometheus.GaugeVec
+	wsDuration  prometheus.Gauge
+	wsUpgrade   prometheus.Gauge
+	wsRTT       prometheus.Histogram
+	wsQuantiles *prometheus.GaugeVec
+	wsFailure   *prometheus.GaugeVec
 
-	labelFilter  ginkgo.LabelFilter
-	pingLabels   Labels = []string{"ping"}
-	replayLabels Labels = []string{"replay"}
+	// Hold Metrics
+	holdSuccess *prometheus.GaugeVec
+	holdLasted  prometheus.Gauge
+	holdFailure *prometheus.GaugeVec
+
+	// Download and Upload Metrics
+	downloadSuccess    *prometheus.GaugeVec
+	downloadTransfer   prometheus.Gauge
+	downloadThroughput prometheus.Gauge
+	downloadFailure    *prometheus.GaugeVec
+	uploadSuccess      *prometheus.GaugeVec
+	uploadTransfer     prometheus.Gauge
+	uploadThroughput   prometheus.Gauge
+	uploadFailure      *prometheus.GaugeVec
+
+	// Headers Metrics
+	headersSuccess *prometheus.GaugeVec
+	headersChange  *prometheus.GaugeVec
+	headersFailure *prometheus.GaugeVec
+
+	labelFilter    ginkgo.LabelFilter
+	pingLabels     Labels = []string{"ping"}
+	replayLabels   Labels = []string{"replay"}
+	distLabels     Labels = []string{"distribution"}
+	probeLabels    Labels = []string{"probe"}
+	wsLabels       Labels = []string{"websocket"}
+	holdLabels     Labels = []string{"hold"}
+	downloadLabels Labels = []string{"download"}
+	uploadLabels   Labels = []string{"upload"}
+	headersLabels  Labels = []string{"headers"}
 )
 
 func init() {
-	inspections.RegisterTestFlags(flag.CommandLine)
+	flags := flag.CommandLine
+	inspections.RegisterTestFlags(flags)
+	flags.StringVar(&caCert, "konfirm.ca-cert", "", "verify the server using the PEM encoded CA bundle at the specified path")
+	flags.StringVar(&clientCert, "konfirm.client-cert", "", "present the PEM encoded client certificate at the specified path")
+	flags.StringVar(&clientKey, "konfirm.client-key", "", "the PEM encoded private key for konfirm.client-cert")
+	flags.StringVar(&tokenFile, "konfirm.token-file", "", "authenticate using the bearer token in the file at the specified path")
+	flags.StringVar(&hmacKeyFile, "konfirm.hmac-key-file", "", "sign requests using the HMAC key in the file at the specified path")
+	flags.StringVar(&runID, "konfirm.run-id", "", "identifies the inspection run in the server's logs (default is random)")
+	flags.DurationVar(&connTimeout, "konfirm.connect-timeout", 30*time.Second, "how long establishing a connection may take")
+	flags.DurationVar(&respTimeout, "konfirm.response-timeout", 0, "how long to wait for response headers once a request is sent")
+	flags.StringVar(&protocol, "konfirm.protocol", "", "force the protocol (http/1.1, h2, or h2c) and fail if it is downgraded")
+	flags.BoolVar(&expectDeny, "konfirm.expect-deny", false, "succeed only if the server is unreachable")
+	flags.IntVar(&loadOpts.Concurrency, "konfirm.concurrency", 1, "the number of concurrent workers replaying each spec")
+	flags.IntVar(&loadOpts.Iterations, "konfirm.iterations", 0, "the number of times each spec is replayed")
+	flags.DurationVar(&loadOpts.Duration, "konfirm.duration", 0, "replay each spec until the duration elapses")
+	flags.BoolVar(&expectSource, "konfirm.expect-source-preserved", false, "fail unless the server observes the client's own address")
+	flags.Func("konfirm.expect-source-cidr", "an IP or CIDR within which the server must observe the client's address (repeatable)", appendTo(&sourceCIDRs))
+	flags.BoolVar(&fanOut, "konfirm.fan-out", false, "check every address the server's host resolves to")
+	flags.BoolVar(&srv, "konfirm.srv", false, "with konfirm.fan-out, resolve the server's host as an SRV name")
+	flags.IntVar(&requests, "konfirm.requests", 10, "the number of requests sent to determine the backend distribution")
+	flags.IntVar(&minBackends, "konfirm.min-backends", 2, "the minimum number of distinct backends that must respond")
+	flags.StringVar(&probeSpec.Method, "konfirm.method", "GET", "the probe request method")
+	flags.Func("konfirm.header", "a probe or headers request header formatted as NAME: VALUE (repeatable)", appendTo(&probeHeaders))
+	flags.StringVar(&probeBody, "konfirm.body", "", "the probe request body")
+	flags.StringVar(&probeBodyFile, "konfirm.body-file", "", "send the contents of the file at the specified path as the probe request body")
+	flags.BoolVar(&probeSpec.FollowRedirects, "konfirm.follow-redirects", false, "follow redirects and assert on the final response")
+	flags.Func("konfirm.expect-status", "an acceptable status code, class, or range (repeatable)", appendTo(&expectStatus))
+	flags.Func("konfirm.expect-header", "a response header assertion (repeatable)", appendTo(&expectHeaders))
+	flags.Func("konfirm.expect-body", "a string the response body must contain (repeatable)", appendTo(&expectBody))
+	flags.Func("konfirm.expect-body-regex", "a regular expression the response body must match (repeatable)", appendTo(&expectRegex))
+	flags.Func("konfirm.expect-json", "a JSON path assertion (repeatable)", appendTo(&expectJSON))
+	flags.DurationVar(&probeSpec.MaxLatency, "konfirm.max-latency", 0, "the maximum time to receive the complete probe response")
+	flags.IntVar(&wsSpec.TextMessages, "konfirm.text-messages", 4, "the number of WebSocket text messages exchanged")
+	flags.IntVar(&wsSpec.BinaryMessages, "konfirm.binary-messages", 4, "the number of WebSocket binary messages exchanged")
+	flags.IntVar(&wsSpec.MessageSize, "konfirm.message-size", 1024, "the size of each WebSocket message in bytes")
+	flags.DurationVar(&holdSpec.Duration, "konfirm.hold-duration", time.Minute, "how long the held stream must survive")
+	flags.DurationVar(&holdSpec.Interval, "konfirm.hold-interval", 15*time.Second, "how often the server sends a heartbeat on the held stream")
+	flags.Func("konfirm.large-header", "a request header formatted as NAME=BYTES with a generated value (repeatable)", appendTo(&largeHeaders))
+	flags.Func("konfirm.expect-change", "how a header is expected to arrive, formatted as NAME=CHANGE (repeatable)", appendTo(&expectChanges))
+	flags.Int64Var(&transferSize, "konfirm.transfer-size", 64*1024*1024, "the number of bytes downloaded or uploaded")
+}
+
+// appendTo returns a flag.Func that appends each value of a repeated flag to values.
+func appendTo(values *[]string) func(string) error {
+	return func(s string) error {
+		*values = append(*values, s)
+		return nil
+	}
+}
+
+// buildProbeSpec completes probeSpec from the repeated and file flags.
+func buildProbeSpec(g *WithT) {
+	probeSpec.Header = make(gohttp.Header)
+	for _, h := range probeHeaders {
+		name, value, ok := strings.Cut(h, ":")
+		g.Expect(ok).To(BeTrue(), "validate probe header %q", h)
+		probeSpec.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if probeBodyFile != "" {
+		body, err := os.ReadFile(probeBodyFile)
+		g.Expect(err).NotTo(HaveOccurred(), "read probe body file")
+		probeSpec.Body = body
+	} else if probeBody != "" {
+		probeSpec.Body = []byte(probeBody)
+	}
+	for _, s := range expectStatus {
+		r, err := http.ParseStatusRange(s)
+		g.Expect(err).NotTo(HaveOccurred(), "validate expected status")
+		probeSpec.Status = append(probeSpec.Status, r)
+	}
+	for _, s := range expectHeaders {
+		a, err := http.ParseHeaderAssertion(s)
+		g.Expect(err).NotTo(HaveOccurred(), "validate expected header")
+		probeSpec.Headers = append(probeSpec.Headers, a)
+	}
+	probeSpec.BodyContains = expectBody
+	for _, s := range expectRegex {
+		p, err := regexp.Compile(s)
+		g.Expect(err).NotTo(HaveOccurred(), "validate expected body regex")
+		probeSpec.BodyPatterns = append(probeSpec.BodyPatterns, p)
+	}
+	for _, s := range expectJSON {
+		a, err := http.ParseJSONAssertion(s)
+		g.Expect(err).NotTo(HaveOccurred(), "validate expected JSON")
+		probeSpec.JSON = append(probeSpec.JSON, a)
+	}
+}
+
+// buildHeaderSpec builds headerSpec from the repeated header flags.
+func buildHeaderSpec(g *WithT) {
+	headerSpec.Header = make(gohttp.Header)
+	for _, h := range probeHeaders {
+		name, value, ok := strings.Cut(h, ":")
+		g.Expect(ok).To(BeTrue(), "validate header %q", h)
+		headerSpec.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	for _, h := range largeHeaders {
+		name, size, _ := strings.Cut(h, "=")
+		n, err := strconv.Atoi(size)
+		g.Expect(err).NotTo(HaveOccurred(), "validate large header %q", h)
+		headerSpec.Header.Add(strings.TrimSpace(name), http.LargeHeaderValue(n))
+	}
+	headerSpec.Expect = make(map[string]http.HeaderChange)
+	for _, c := range expectChanges {
+		name, s, _ := strings.Cut(c, "=")
+		change, err := http.ParseHeaderChange(s)
+		g.Expect(err).NotTo(HaveOccurred(), "validate expected header change %q", c)
+		headerSpec.Expect[strings.TrimSpace(name)] = change
+	}
+}
+
+// TestMain exits with inspections.ReachableExitCode if the server was reachable when it was expected to be
+// denied.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if code != 0 && reachable.Load() {
+		code = inspections.ReachableExitCode
+	}
+	os.Exit(code)
 }
 
 func TestHTTP(t *testing.T) {
@@ -81,60 +308,398 @@ func TestHTTP(t *testing.T) {
 	server = flag.CommandLine.Arg(0)
 	g.Expect(server).NotTo(BeEmpty(), "a valid server URL is the first argument")
 
+	proto, err := http.ParseProtocol(protocol)
+	g.Expect(err).NotTo(HaveOccurred(), "validate protocol")
+	g.Expect(proto.ValidateURL(server)).To(Succeed(), "validate protocol")
+	httpClient, err = http.NewHTTPClient(http.ClientConfig{
+		CACertFile:      caCert,
+		ClientCertFile:  clientCert,
+		ClientKeyFile:   clientKey,
+		ConnectTimeout:  connTimeout,
+		Protocol:        proto,
+		ResponseTimeout: respTimeout,
+	})
+	g.Expect(err).NotTo(HaveOccurred(), "configure the http client")
+	if proto != http.DefaultProtocol {
+		clientOpts = append(clientOpts, http.WithProtocol(proto))
+	}
+
+	// Presenting a client certificate asserts the server verified it
+	if clientCert != "" {
+		clientOpts = append(clientOpts, http.WithMutualTLS())
+	}
+
+	// Requests are correlated with the server's logs by their request ID, spec, and run ID
+	if runID == "" {
+		runID = http.NewID()
+	}
+	logger.Info("starting inspection run", zap.String("runId", runID))
+	clientOpts = append(clientOpts, http.WithRunID(runID))
+
+	creds, err := http.LoadCredentials(tokenFile, hmacKeyFile)
+	g.Expect(err).NotTo(HaveOccurred(), "load credentials")
+	if creds.Enabled() {
+		clientOpts = append(clientOpts, http.WithCredentials(creds))
+	}
+
+	// The client's address observed by the server, if asserted, must be preserved
+	if expectSource {
+		clientOpts = append(clientOpts, http.WithPreservedSource())
+	}
+	for _, s := range sourceCIDRs {
+		p, err := http.ParseSourcePrefix(s)
+		g.Expect(err).NotTo(HaveOccurred(), "validate expected source CIDR")
+		clientOpts = append(clientOpts, http.WithSourcePrefixes(p))
+	}
+
+	// If pings fan out, the server's host *must* resolve to at least one endpoint
+	if fanOut && labelFilter(pingLabels) {
+		ctx := logging.NewContext(context.Background(), logger)
+		addrs, err := http.ResolveEndpoints(ctx, net.DefaultResolver, server, srv)
+		g.Expect(err).NotTo(HaveOccurred(), "resolve server endpoints")
+		for _, addr := range addrs {
+			endpoints = append(endpoints, Entry(addr, addr))
+		}
+	}
+
 	// If replays are tested, at least one spec arg *must* be defined
 	if labelFilter(replayLabels) {
 		args := flag.CommandLine.Args()
 		g.Expect(len(args)).To(BeNumerically(">=", 2), "at least one spec is defined as the second argument")
 		for _, s := range args[1:] {
-			spec, err := source.NewSpec(s, "")
+			spec, err := http.NewReplaySpec(s)
 			g.Expect(err).NotTo(HaveOccurred(), "validate replay spec")
-			replayEntries = append(replayEntries, Entry(spec.Describe(), spec.Describe(), spec.Generate(), spec.Size()))
+			replayEntries = append(replayEntries, Entry(spec.Describe(), spec))
 		}
 	}
 
+	if labelFilter(probeLabels) {
+		buildProbeSpec(g)
+	}
+
+	if labelFilter(headersLabels) {
+		buildHeaderSpec(g)
+	}
+
 	setupMetrics()
 	RunSpecs(t, "HTTP", suiteCfg, reporterCfg)
 }
 
 var _ = Describe("Check", func() {
 
+	if fanOut {
+		DescribeTable("can ping each endpoint", func(ctx context.Context, endpoint string) {
+			ctx = logging.NewContext(ctx, logger)
+			labels := prometheus.Labels{"endpoint": endpoint}
+			client := http.NewClient(server, httpClient, append(clientOpts, http.WithEndpoint(endpoint))...)
+			result, err := client.Check(ctx)
+			endpointDuration.With(labels).Set(float64(result.Timings.Total.Milliseconds()))
+			if expectDeny {
+				expectDenied(endpointDenied.With(labels), result)
+				return
+			}
+			labels["protocol"] = result.Protocol
+			if result.OK {
+				endpointSuccess.With(labels).Set(1.0)
+			} else {
+				endpointSuccess.With(labels).Set(0.0)
+			}
+			Expect(err).NotTo(HaveOccurred(), "ping failed: %s (request %s)", result.Failure, result.RequestID)
+			Expect(result.OK).To(BeTrue(), "ping failed: %s (request %s)", result.Failure, result.RequestID)
+		}, endpoints)
+		return
+	}
+
 	It("can ping the server", func(ctx context.Context) {
 		ctx = logging.NewContext(ctx, logger)
-		client := http.NewClient(server, gohttp.DefaultClient)
-		start := time.Now()
-		ok, err := client.Check(ctx)
-		pingDuration.Set(float64(time.Now().Sub(start).Milliseconds()))
-		if ok {
-			pingSuccess.Set(1.0)
+		client := http.NewClient(server, httpClient, clientOpts...)
+		result, err := client.Check(ctx)
+		pingDuration.Set(float64(result.Timings.Total.Milliseconds()))
+		for phase, d := range result.Timings.Phases() {
+			pingPhases.With(prometheus.Labels{"phase": phase}).Set(float64(d.Milliseconds()))
+		}
+		setFailures(pingFailure, prometheus.Labels{}, map[http.FailureCategory]int{result.Failure: 1})
+		if expectDeny {
+			expectDenied(pingDenied, result)
+			return
+		}
+		labels := prometheus.Labels{"protocol": result.Protocol}
+		if result.OK {
+			pingSuccess.With(labels).Set(1.0)
 		} else {
-			pingSuccess.Set(0.0)
+			pingSuccess.With(labels).Set(0.0)
 		}
-		Expect(err).NotTo(HaveOccurred())
-		Expect(ok).To(BeTrue())
+		Expect(err).NotTo(HaveOccurred(), "ping failed: %s (request %s)", result.Failure, result.RequestID)
+		Expect(result.OK).To(BeTrue(), "ping failed: %s (request %s)", result.Failure, result.RequestID)
 	})
 
 }, pingLabels)
 
 var _ = Describe("ReplayN", func() {
 
-	DescribeTable("replays N bytes", func(ctx context.Context, spec string, src io.Reader, size int64) {
-		ctx = logging.NewContext(ctx, logger)
-		labels := prometheus.Labels{"spec": spec}
-		client := http.NewClient(server, gohttp.DefaultClient)
-		start := time.Now()
-		ok, err := client.ReplayN(ctx, src, size)
-		replayDuration.With(labels).Set(float64(time.Now().Sub(start).Milliseconds()))
-		if ok {
-			replaySuccess.With(labels).Set(1.0)
+	DescribeTable("replays N bytes", func(ctx context.Context, spec http.ReplaySpec) {
+		ctx = http.WithSpec(logging.NewContext(ctx, logger), spec.Describe())
+		labels := prometheus.Labels{"spec": spec.Describe()}
+		client := http.NewClient(server, httpClient, clientOpts...)
+		replay := func(ctx context.Context) (http.Result, error) {
+			return client.Replay(ctx, spec)
+		}
+
+		if expectDeny {
+			result, _ := replay(ctx)
+			setFailures(replayFailure, labels, map[http.FailureCategory]int{result.Failure: 1})
+			expectDenied(replayDenied.With(labels), result)
+			return
+		}
+
+		if !loadOpts.IsSingleShot() {
+			var proto atomic.Value
+			report := http.RunLoad(ctx, loadOpts, replay, func(result http.Result) {
+				replayLatency.With(labels).Observe(float64(result.Timings.Total.Milliseconds()))
+				if result.Protocol != "" {
+					proto.Store(result.Protocol)
+				}
+			})
+			for _, q := range []float64{0.5, 0.9, 0.99} {
+				replayQuantiles.With(prometheus.Labels{"spec": spec.Describe(), "quantile": strconv.FormatFloat(q, 'f', -1, 64)}).
+					Set(float64(report.Percentile(q).Milliseconds()))
+			}
+			replayDuration.With(labels).Set(float64(report.Elapsed.Milliseconds()))
+			replayReceived.With(labels).Set(float64(report.BytesReceived))
+			replaySuccesses.With(labels).Set(report.SuccessRate())
+			replayThroughput.With(labels).Set(report.Throughput())
+			setFailures(replayFailure, labels, report.Failures)
+			p, _ := proto.Load().(string)
+			successLabels := prometheus.Labels{"spec": spec.Describe(), "protocol": p}
+			if report.Successes == report.Requests {
+				replaySuccess.With(successLabels).Set(1.0)
+			} else {
+				replaySuccess.With(successLabels).Set(0.0)
+			}
+			Expect(report.Successes).To(Equal(report.Requests), "replay failures: %v (requests %v)", report.Failures, report.FailedRequestIDs)
+			return
+		}
+
+		result, err := replay(ctx)
+		replayDuration.With(labels).Set(float64(result.Timings.Total.Milliseconds()))
+		for phase, d := range result.Timings.Phases() {
+			replayPhases.With(prometheus.Labels{"spec": spec.Describe(), "phase": phase}).Set(float64(d.Milliseconds()))
+		}
+		replaySent.With(labels).Set(float64(result.BytesSent))
+		replayReceived.With(labels).Set(float64(result.BytesReceived))
+		replayWireSent.With(labels).Set(float64(result.WireBytesSent))
+		replayWireReceived.With(labels).Set(float64(result.WireBytesReceived))
+		setFailures(replayFailure, labels, map[http.FailureCategory]int{result.Failure: 1})
+		successLabels := prometheus.Labels{"spec": spec.Describe(), "protocol": result.Protocol}
+		if result.OK {
+			replaySuccess.With(successLabels).Set(1.0)
 		} else {
-			replaySuccess.With(labels).Set(0.0)
+			replaySuccess.With(successLabels).Set(0.0)
 		}
-		Expect(err).NotTo(HaveOccurred())
-		Expect(ok).To(BeTrue())
+		Expect(err).NotTo(HaveOccurred(), "replay failed: %s (request %s)", result.Failure, result.RequestID)
+		Expect(result.OK).To(BeTrue(), "replay failed: %s (request %s)", result.Failure, result.RequestID)
 	}, replayEntries)
 
 }, replayLabels)
 
+// expectDenied asserts the server was unreachable, recording the outcome in gauge. Any other failure, except
+// cancellation, means the server was reached.
+func expectDenied(gauge prometheus.Gauge, result http.Result) {
+	if result.Denied() {
+		gauge.Set(1.0)
+	} else {
+		gauge.Set(0.0)
+		if result.Failure != http.CanceledFailure {
+			reachable.Store(true)
+		}
+	}
+	Expect(result.Denied()).To(BeTrue(), "the server was reachable (failure: %q, status: %d)", result.Failure, result.StatusCode)
+}
+
+// setFailures sets the gauge for each failure category to its count, including categories with no failures
+// so each category is present in the pushed metrics.
+func setFailures(vec *prometheus.GaugeVec, labels prometheus.Labels, failures map[http.FailureCategory]int) {
+	for _, category := range http.FailureCategories {
+		l := prometheus.Labels{"category": string(category)}
+		for k, v := range labels {
+			l[k] = v
+		}
+		vec.With(l).Set(float64(failures[category]))
+	}
+}
+
+var _ = Describe("Identify", func() {
+
+	It("distributes requests across backends", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := http.NewClient(server, httpClient, clientOpts...)
+
+		var mu sync.Mutex
+		backends := make(map[string]int)
+		report := http.RunLoad(ctx, http.LoadOptions{Concurrency: loadOpts.Concurrency, Iterations: requests}, client.Identify, func(result http.Result) {
+			if result.Backend == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			backends[result.Backend.String()]++
+			distributionRequests.With(prometheus.Labels{"pod": result.Backend.Pod, "node": result.Backend.Node}).Inc()
+		})
+
+		logger.Info("request distribution", zap.Any("backends", backends))
+		distributionBackends.Set(float64(len(backends)))
+		if report.Successes == report.Requests && len(backends) >= minBackends {
+			distributionSuccess.Set(1.0)
+		} else {
+			distributionSuccess.Set(0.0)
+		}
+		Expect(report.Successes).To(Equal(report.Requests), "identity request failures: %v (requests %v)", report.Failures, report.FailedRequestIDs)
+		Expect(len(backends)).To(BeNumerically(">=", minBackends), "requests were distributed across %d backends: %v", len(backends), backends)
+	})
+
+}, distLabels)
+
+var _ = Describe("Probe", func() {
+
+	It("satisfies the probe assertions", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := http.NewClient(server, httpClient, clientOpts...)
+		result, err := client.Probe(ctx, probeSpec)
+		probeDuration.Set(float64(result.Timings.Total.Milliseconds()))
+		for phase, d := range result.Timings.Phases() {
+			probePhases.With(prometheus.Labels{"phase": phase}).Set(float64(d.Milliseconds()))
+		}
+		probeStatus.Set(float64(result.StatusCode))
+		setFailures(probeFailure, prometheus.Labels{}, map[http.FailureCategory]int{result.Failure: 1})
+		labels := prometheus.Labels{"protocol": result.Protocol}
+		if result.OK {
+			probeSuccess.With(labels).Set(1.0)
+		} else {
+			probeSuccess.With(labels).Set(0.0)
+		}
+		Expect(err).NotTo(HaveOccurred(), "probe failed: %s (request %s)", result.Failure, result.RequestID)
+		Expect(result.OK).To(BeTrue(), "probe failed: %s (request %s)", result.Failure, result.RequestID)
+	})
+
+}, probeLabels)
+
+var _ = Describe("WebSocket", func() {
+
+	It("echoes WebSocket messages", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := http.NewClient(server, httpClient, clientOpts...)
+		result, err := client.WebSocket(ctx, wsSpec)
+		wsDuration.Set(float64(result.Timings.Total.Milliseconds()))
+		wsUpgrade.Set(float64(result.Upgrade.Milliseconds()))
+		for _, rtt := range result.RoundTrips {
+			wsRTT.Observe(float64(rtt.Milliseconds()))
+		}
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			wsQuantiles.With(prometheus.Labels{"quantile": strconv.FormatFloat(q, 'f', -1, 64)}).
+				Set(float64(result.RoundTripPercentile(q).Milliseconds()))
+		}
+		setFailures(wsFailure, prometheus.Labels{}, map[http.FailureCategory]int{result.Failure: 1})
+		labels := prometheus.Labels{"protocol": result.Protocol}
+		if result.OK {
+			wsSuccess.With(labels).Set(1.0)
+		} else {
+			wsSuccess.With(labels).Set(0.0)
+		}
+		Expect(err).NotTo(HaveOccurred(), "websocket failed: %s (request %s)", result.Failure, result.RequestID)
+		Expect(result.OK).To(BeTrue(), "websocket failed: %s (request %s)", result.Failure, result.RequestID)
+	})
+
+}, wsLabels)
+
+var _ = Describe("Hold", func() {
+
+	It("holds a stream open", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := http.NewClient(server, httpClient, clientOpts...)
+		result, err := client.Hold(ctx, holdSpec)
+		holdLasted.Set(result.Lasted.Seconds())
+		setFailures(holdFailure, prometheus.Labels{}, map[http.FailureCategory]int{result.Failure: 1})
+		labels := prometheus.Labels{"protocol": result.Protocol}
+		if result.OK {
+			holdSuccess.With(labels).Set(1.0)
+		} else {
+			holdSuccess.With(labels).Set(0.0)
+		}
+		Expect(err).NotTo(HaveOccurred(), "hold failed after %s: %s (request %s)", result.Lasted, result.Failure, result.RequestID)
+		Expect(result.OK).To(BeTrue(), "hold failed after %s: %s (request %s)", result.Lasted, result.Failure, result.RequestID)
+	})
+
+}, holdLabels)
+
+// transferred records the outcome of a download or upload.
+func transferred(result http.Result, success *prometheus.GaugeVec, transfer, throughput prometheus.Gauge, failure *prometheus.GaugeVec) {
+	transfer.Set(float64(result.Transfer.Milliseconds()))
+	throughput.Set(result.Throughput() / 1e6)
+	setFailures(failure, prometheus.Labels{}, map[http.FailureCategory]int{result.Failure: 1})
+	labels := prometheus.Labels{"protocol": result.Protocol}
+	if result.OK {
+		success.With(labels).Set(1.0)
+	} else {
+		success.With(labels).Set(0.0)
+	}
+}
+
+var _ = Describe("Download", func() {
+
+	It("downloads from the server", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := http.NewClient(server, httpClient, clientOpts...)
+		result, err := client.Download(ctx, transferSize)
+		transferred(result, downloadSuccess, downloadTransfer, downloadThroughput, downloadFailure)
+		logger.Info("download throughput", zap.Float64("mbps", result.Throughput()/1e6))
+		Expect(err).NotTo(HaveOccurred(), "download failed: %s (request %s)", result.Failure, result.RequestID)
+		Expect(result.OK).To(BeTrue(), "download failed: %s (request %s)", result.Failure, result.RequestID)
+	})
+
+}, downloadLabels)
+
+var _ = Describe("Upload", func() {
+
+	It("uploads to the server", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := http.NewClient(server, httpClient, clientOpts...)
+		result, err := client.Upload(ctx, transferSize)
+		transferred(result, uploadSuccess, uploadTransfer, uploadThroughput, uploadFailure)
+		logger.Info("upload throughput", zap.Float64("mbps", result.Throughput()/1e6))
+		Expect(err).NotTo(HaveOccurred(), "upload failed: %s (request %s)", result.Failure, result.RequestID)
+		Expect(result.OK).To(BeTrue(), "upload failed: %s (request %s)", result.Failure, result.RequestID)
+	})
+
+}, uploadLabels)
+
+var _ = Describe("Headers", func() {
+
+	It("headers arrive as expected", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := http.NewClient(server, httpClient, clientOpts...)
+		result, err := client.Headers(ctx, headerSpec)
+		setFailures(headersFailure, prometheus.Labels{}, map[http.FailureCategory]int{result.Failure: 1})
+		for _, d := range result.Headers {
+			logger.Info("header", zap.Object("header", d))
+			labels := prometheus.Labels{"header": d.Name, "change": string(d.Change), "expected": string(d.Expected)}
+			if d.OK() {
+				headersChange.With(labels).Set(1.0)
+			} else {
+				headersChange.With(labels).Set(0.0)
+			}
+		}
+		labels := prometheus.Labels{"protocol": result.Protocol}
+		if result.OK {
+			headersSuccess.With(labels).Set(1.0)
+		} else {
+			headersSuccess.With(labels).Set(0.0)
+		}
+		Expect(err).NotTo(HaveOccurred(), "headers failed: %s (request %s)", result.Failure, result.RequestID)
+		Expect(result.OK).To(BeTrue(), "headers failed: %s (request %s)", result.Failure, result.RequestID)
+	})
+
+}, headersLabels)
+
 func setupMetrics() {
 
 	namespace := inspections.MetricsNamespace
@@ -143,12 +708,12 @@ func setupMetrics() {
 		"server": server,
 	}
 
-	pingSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	pingSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace:   namespace,
 		Subsystem:   subsystem,
 		Name:        "ping_successful",
 		ConstLabels: sharedLabels,
-	})
+	}, []string{"protocol"})
 
 	pingDuration = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   namespace,
@@ -157,12 +722,54 @@ func setupMetrics() {
 		ConstLabels: sharedLabels,
 	})
 
+	pingPhases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "ping_phase_duration_ms",
+		ConstLabels: sharedLabels,
+	}, []string{"phase"})
+
+	endpointSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "endpoint_ping_successful",
+		ConstLabels: sharedLabels,
+	}, []string{"endpoint", "protocol"})
+
+	endpointDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "endpoint_ping_duration_ms",
+		ConstLabels: sharedLabels,
+	}, []string{"endpoint"})
+
+	pingDenied = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "ping_denied",
+		ConstLabels: sharedLabels,
+	})
+
+	endpointDenied = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "endpoint_ping_denied",
+		ConstLabels: sharedLabels,
+	}, []string{"endpoint"})
+
+	pingFailure = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "ping_failure",
+		ConstLabels: sharedLabels,
+	}, []string{"category"})
+
 	replaySuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace:   namespace,
 		Subsystem:   subsystem,
 		Name:        "replay_successful",
 		ConstLabels: sharedLabels,
-	}, []string{"spec"})
+	}, []string{"spec", "protocol"})
 
 	replayDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace:   namespace,
@@ -170,22 +777,363 @@ func setupMetrics() {
 		Name:        "replay_duration_ms",
 		ConstLabels: sharedLabels,
 	}, []string{"spec"})
+
+	replayPhases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_phase_duration_ms",
+		ConstLabels: sharedLabels,
+	}, []string{"spec", "phase"})
+
+	replayFailure = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_failure",
+		ConstLabels: sharedLabels,
+	}, []string{"spec", "category"})
+
+	replayDenied = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_denied",
+		ConstLabels: sharedLabels,
+	}, []string{"spec"})
+
+	replaySent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_bytes_sent",
+		ConstLabels: sharedLabels,
+	}, []string{"spec"})
+
+	replayReceived = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_bytes_received",
+		ConstLabels: sharedLabels,
+	}, []string{"spec"})
+
+	replayWireSent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_wire_bytes_sent",
+		ConstLabels: sharedLabels,
+	}, []string{"spec"})
+
+	replayWireReceived = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_wire_bytes_received",
+		ConstLabels: sharedLabels,
+	}, []string{"spec"})
+
+	replayLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_latency_ms",
+		ConstLabels: sharedLabels,
+		Buckets:     prometheus.ExponentialBuckets(1, 2, 16),
+	}, []string{"spec"})
+
+	replayQuantiles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_latency_quantile_ms",
+		ConstLabels: sharedLabels,
+	}, []string{"spec", "quantile"})
+
+	replaySuccesses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_success_rate",
+		ConstLabels: sharedLabels,
+	}, []string{"spec"})
+
+	replayThroughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "replay_throughput_bytes_per_second",
+		ConstLabels: sharedLabels,
+	}, []string{"spec"})
+
+	distributionSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "distribution_successful",
+		ConstLabels: sharedLabels,
+	})
+
+	distributionBackends = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "distribution_backends",
+		ConstLabels: sharedLabels,
+	})
+
+	distributionRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "distribution_requests",
+		ConstLabels: sharedLabels,
+	}, []string{"pod", "node"})
+
+	probeSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "probe_successful",
+		ConstLabels: sharedLabels,
+	}, []string{"protocol"})
+
+	probeDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "probe_duration_ms",
+		ConstLabels: sharedLabels,
+	})
+
+	probePhases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "probe_phase_duration_ms",
+		ConstLabels: sharedLabels,
+	}, []string{"phase"})
+
+	probeFailure = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "probe_failure",
+		ConstLabels: sharedLabels,
+	}, []string{"category"})
+
+	probeStatus = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "probe_status_code",
+		ConstLabels: sharedLabels,
+	})
+
+	wsSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "websocket_successful",
+		ConstLabels: sharedLabels,
+	}, []string{"protocol"})
+
+	wsDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "websocket_duration_ms",
+		ConstLabels: sharedLabels,
+	})
+
+	wsUpgrade = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "websocket_upgrade_ms",
+		ConstLabels: sharedLabels,
+	})
+
+	wsRTT = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "websocket_rtt_ms",
+		ConstLabels: sharedLabels,
+		Buckets:     prometheus.ExponentialBuckets(1, 2, 16),
+	})
+
+	wsQuantiles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "websocket_rtt_quantile_ms",
+		ConstLabels: sharedLabels,
+	}, []string{"quantile"})
+
+	wsFailure = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "websocket_failure",
+		ConstLabels: sharedLabels,
+	}, []string{"category"})
+
+	holdSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "hold_successful",
+		ConstLabels: sharedLabels,
+	}, []string{"protocol"})
+
+	holdLasted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "hold_lasted_seconds",
+		ConstLabels: sharedLabels,
+	})
+
+	holdFailure = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "hold_failure",
+		ConstLabels: sharedLabels,
+	}, []string{"category"})
+
+	headersSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "headers_successful",
+		ConstLabels: sharedLabels,
+	}, []string{"protocol"})
+
+	headersChange = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "headers_as_expected",
+		ConstLabels: sharedLabels,
+	}, []string{"header", "change", "expected"})
+
+	headersFailure = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "headers_failure",
+		ConstLabels: sharedLabels,
+	}, []string{"category"})
+
+	for _, d := range []struct {
+		name       string
+		success    **prometheus.GaugeVec
+		transfer   *prometheus.Gauge
+		throughput *prometheus.Gauge
+		failure    **prometheus.GaugeVec
+	}{
+		{"download", &downloadSuccess, &downloadTransfer, &downloadThroughput, &downloadFailure},
+		{"upload", &uploadSuccess, &uploadTransfer, &uploadThroughput, &uploadFailure},
+	} {
+		*d.success = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        d.name + "_successful",
+			ConstLabels: sharedLabels,
+		}, []string{"protocol"})
+
+		*d.transfer = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        d.name + "_transfer_ms",
+			ConstLabels: sharedLabels,
+		})
+
+		*d.throughput = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        d.name + "_throughput_mbps",
+			ConstLabels: sharedLabels,
+		})
+
+		*d.failure = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        d.name + "_failure",
+			ConstLabels: sharedLabels,
+		}, []string{"category"})
+	}
 }
 
 var _ = AfterSuite(func(ctx context.Context) {
 
 	metrics := inspections.NewMetrics()
 
-	// Register Ping metrics only if the ping node ran
-	if labelFilter(pingLabels) {
-		metrics.Register(pingSuccess)
+	// Register Ping metrics only if the ping node ran; denied pings report whether they were denied in place of
+	// whether they were successful
+	if labelFilter(pingLabels) && fanOut {
+		metrics.Register(endpointDuration)
+		if expectDeny {
+			metrics.Register(endpointDenied)
+		} else {
+			metrics.Register(endpointSuccess)
+		}
+	} else if labelFilter(pingLabels) {
 		metrics.Register(pingDuration)
+		metrics.Register(pingFailure)
+		if expectDeny {
+			metrics.Register(pingDenied)
+		} else {
+			metrics.Register(pingSuccess)
+			metrics.Register(pingPhases)
+		}
 	}
 
 	// Register Replay metrics only if the replay node ran
-	if labelFilter(replayLabels) {
+	if labelFilter(replayLabels) && expectDeny {
+		metrics.Register(replayFailure)
+		metrics.Register(replayDenied)
+	} else if labelFilter(replayLabels) {
 		metrics.Register(replaySuccess)
 		metrics.Register(replayDuration)
+		metrics.Register(replayPhases)
+		metrics.Register(replayFailure)
+		metrics.Register(replaySent)
+		metrics.Register(replayReceived)
+		metrics.Register(replayWireSent)
+		metrics.Register(replayWireReceived)
+		if !loadOpts.IsSingleShot() {
+			metrics.Register(replayLatency)
+			metrics.Register(replayQuantiles)
+			metrics.Register(replaySuccesses)
+			metrics.Register(replayThroughput)
+		}
+	}
+
+	// Register Distribution metrics only if the distribution node ran
+	if labelFilter(distLabels) {
+		metrics.Register(distributionSuccess)
+		metrics.Register(distributionBackends)
+		metrics.Register(distributionRequests)
+	}
+
+	// Register Probe metrics only if the probe node ran
+	if labelFilter(probeLabels) {
+		metrics.Register(probeSuccess)
+		metrics.Register(probeDuration)
+		metrics.Register(probePhases)
+		metrics.Register(probeFailure)
+		metrics.Register(probeStatus)
+	}
+
+	// Register WebSocket metrics only if the websocket node ran
+	if labelFilter(wsLabels) {
+		metrics.Register(wsSuccess)
+		metrics.Register(wsDuration)
+		metrics.Register(wsUpgrade)
+		metrics.Register(wsRTT)
+		metrics.Register(wsQuantiles)
+		metrics.Register(wsFailure)
+	}
+
+	// Register Hold metrics only if the hold node ran
+	if labelFilter(holdLabels) {
+		metrics.Register(holdSuccess)
+		metrics.Register(holdLasted)
+		metrics.Register(holdFailure)
+	}
+
+	// Register Download and Upload metrics only if their nodes ran
+	if labelFilter(downloadLabels) {
+		metrics.Register(downloadSuccess)
+		metrics.Register(downloadTransfer)
+		metrics.Register(downloadThroughput)
+		metrics.Register(downloadFailure)
+	}
+	if labelFilter(uploadLabels) {
+		metrics.Register(uploadSuccess)
+		metrics.Register(uploadTransfer)
+		metrics.Register(uploadThroughput)
+		metrics.Register(uploadFailure)
+	}
+
+	// Register Headers metrics only if the headers node ran
+	if labelFilter(headersLabels) {
+		metrics.Register(headersSuccess)
+		metrics.Register(headersChange)
+		metrics.Register(headersFailure)
 	}
 
 	metrics.Push(ctx)
@@ -28,6 +28,9 @@ import (
 	"github.com/raft-tech/konfirm-inspections/internal/cli"
 )
 
+// ReachableExitCode is the exit code of inspections that expected the server to be unreachable but reached it.
+const ReachableExitCode = 3
+
 func Run(inspection *exec.Cmd, parent *cobra.Command) error {
 
 	var iout io.ReadCloser
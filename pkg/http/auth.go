@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var EmptyCredentialErr = errors.New("credential files must not be empty")
+var UnauthorizedErr = errors.New("the server rejected the request's credentials")
+
+const (
+	authorization = "Authorization"
+
+	bearerScheme = "Bearer"
+	hmacScheme   = "Konfirm-HMAC-SHA256"
+
+	// TimestampHeader and NonceHeader are signed, together with the request method and URI, by HMAC requests.
+	TimestampHeader = "X-Konfirm-Timestamp"
+	NonceHeader     = "X-Konfirm-Nonce"
+)
+
+// MaxClockSkew is how far an HMAC request's timestamp may be from the server's clock. Nonces are remembered for
+// twice as long, so a signed request cannot be replayed.
+var MaxClockSkew = 5 * time.Minute
+
+// Credentials authenticate requests to the server using a bearer token, HMAC signatures, or either.
+type Credentials struct {
+
+	// Token is sent as a bearer token.
+	Token string
+
+	// HMACKey signs the method, URI, timestamp, and a nonce of each request. Bodies are not signed, since
+	// they may be streamed.
+	HMACKey []byte
+}
+
+// LoadCredentials reads Credentials from the specified files (e.g., mounted from a Kubernetes Secret), either
+// of which may be empty. Surrounding whitespace is trimmed.
+func LoadCredentials(tokenFile, hmacKeyFile string) (creds Credentials, err error) {
+	read := func(file string) ([]byte, error) {
+		if file == "" {
+			return nil, nil
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		} else if b = bytes.TrimSpace(b); len(b) == 0 {
+			return nil, EmptyCredentialErr
+		}
+		return b, nil
+	}
+	var token []byte
+	if token, err = read(tokenFile); err != nil {
+		return
+	}
+	creds.Token = string(token)
+	creds.HMACKey, err = read(hmacKeyFile)
+	return
+}
+
+// Enabled is true if any credential is set.
+func (c Credentials) Enabled() bool {
+	return c.Token != "" || len(c.HMACKey) > 0
+}
+
+// sign returns the HMAC signature of a request.
+func (c Credentials) sign(method, uri, timestamp, nonce string) string {
+	mac := hmac.New(sha256.New, c.HMACKey)
+	_, _ = mac.Write([]byte(strings.Join([]string{method, uri, timestamp, nonce}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authorize sets the headers that authenticate a request, preferring HMAC signatures if both are set. Requests
+// that already have an Authorization header (e.g., sent by a HeaderSpec) are unchanged.
+func (c Credentials) authorize(header http.Header, method, uri string) {
+	if header.Get(authorization) != "" {
+		return
+	}
+	switch {
+	case len(c.HMACKey) > 0:
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(b)
+		header.Set(TimestampHeader, timestamp)
+		header.Set(NonceHeader, nonce)
+		header.Set(authorization, hmacScheme+" "+c.sign(method, uri, timestamp, nonce))
+	case c.Token != "":
+		header.Set(authorization, bearerScheme+" "+c.Token)
+	}
+}
+
+// WithAuth requires requests to be authenticated using any of the credentials set in creds.
+func WithAuth(creds Credentials) HandlerOption {
+	return authOption(creds)
+}
+
+type authOption Credentials
+
+func (o authOption) apply(h *handlerConfig) {
+	h.auth = Credentials(o)
+}
+
+// Reasons a request was unauthorized, which are also the values of the unauthorized_total reason label.
+const (
+	authMissing  = "missing"
+	authInvalid  = "invalid"
+	authExpired  = "expired"
+	authReplayed = "replayed"
+)
+
+// nonces remembers the nonces of HMAC requests until they expire. Nonces are queued in the order they were seen,
+// so expired nonces are forgotten from the front of the queue without visiting the others.
+type nonces struct {
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	queue []seenNonce
+}
+
+type seenNonce struct {
+	nonce string
+	at    time.Time
+}
+
+// add returns false if nonce has been seen, and otherwise remembers it, forgetting expired nonces.
+func (n *nonces) add(nonce string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for len(n.queue) > 0 && now.Sub(n.queue[0].at) > 2*MaxClockSkew {
+		delete(n.seen, n.queue[0].nonce)
+		n.queue[0] = seenNonce{}
+		n.queue = n.queue[1:]
+	}
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	n.seen[nonce] = struct{}{}
+	n.queue = append(n.queue, seenNonce{nonce: nonce, at: now})
+	return true
+}
+
+// authenticate wraps next, rejecting requests that are not authenticated using creds with 401 Unauthorized.
+func authenticate(next http.Handler, creds Credentials) http.Handler {
+
+	seen := &nonces{seen: make(map[string]struct{})}
+	var challenges []string
+	if creds.Token != "" {
+		challenges = append(challenges, bearerScheme)
+	}
+	if len(creds.HMACKey) > 0 {
+		challenges = append(challenges, hmacScheme)
+	}
+
+	verify := func(req *http.Request) string {
+		scheme, credential, _ := strings.Cut(req.Header.Get(authorization), " ")
+		switch {
+		case scheme == "":
+			return authMissing
+		case strings.EqualFold(scheme, bearerScheme) && creds.Token != "":
+			if subtle.ConstantTimeCompare([]byte(credential), []byte(creds.Token)) != 1 {
+				return authInvalid
+			}
+		case scheme == hmacScheme && len(creds.HMACKey) > 0:
+			timestamp, nonce := req.Header.Get(TimestampHeader), req.Header.Get(NonceHeader)
+			expected := creds.sign(req.Method, req.URL.RequestURI(), timestamp, nonce)
+			if nonce == "" || !hmac.Equal([]byte(credential), []byte(expected)) {
+				return authInvalid
+			}
+			now := time.Now()
+			if ts, err := strconv.ParseInt(timestamp, 10, 64); err != nil || now.Sub(time.Unix(ts, 0)).Abs() > MaxClockSkew {
+				return authExpired
+			} else if !seen.add(nonce, now) {
+				return authReplayed
+			}
+		default:
+			return authInvalid
+		}
+		return ""
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if reason := verify(req); reason != "" {
+			requestLogger(req).Warn("unauthorized request",
+				zap.String("reason", reason),
+				zap.String("clientAddr", req.RemoteAddr),
+				zap.String("uri", req.RequestURI))
+			serverUnauthorized.WithLabelValues(reason).Inc()
+			for _, c := range challenges {
+				res.Header().Add("WWW-Authenticate", c)
+			}
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// WithCredentials authenticates the client's requests, including WebSocket upgrades, using creds. Credentials are
+// only sent to the server's host, so they are not sent by Probe or to redirects to other hosts.
+func WithCredentials(creds Credentials) ClientOption {
+	return credentialsOption(creds)
+}
+
+type credentialsOption Credentials
+
+func (o credentialsOption) apply(c *client) {
+	c.creds = Credentials(o)
+}
+
+// clientTransport is an http.RoundTripper that sets the correlation headers of each request, including
+// redirects, and authenticates those to host if the client has credentials. NewClient wraps the client's
+// transport after applying its options, so options that inspect the transport are unaffected.
+type clientTransport struct {
+	next  http.RoundTripper
+	creds Credentials
+	host  string
+}
+
+func (t *clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	if corr, ok := correlationFrom(req.Context()); ok {
+		corr.set(req.Header)
+	}
+	if t.host != "" && strings.EqualFold(req.URL.Host, t.host) {
+		t.creds.authorize(req.Header, req.Method, req.URL.RequestURI())
+	}
+	return next.RoundTrip(req)
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var _ = Describe("Auth", func() {
+
+	var srv *httptest.Server
+	serve := func(creds Credentials) {
+		srv = newTestServer(WithAuth(creds))
+	}
+
+	// signed returns a check request signed using key at the specified time
+	signed := func(key string, at time.Time, nonce string) *http.Request {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/check", nil)
+		Expect(err).NotTo(HaveOccurred())
+		ts := strconv.FormatInt(at.Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(NonceHeader, nonce)
+		req.Header.Set("Authorization", hmacScheme+" "+Credentials{HMACKey: []byte(key)}.sign(http.MethodGet, "/check", ts, nonce))
+		return req
+	}
+
+	status := func(req *http.Request) int {
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+
+	It("loads credentials from files", func() {
+		dir := GinkgoT().TempDir()
+		token, key, empty := filepath.Join(dir, "token"), filepath.Join(dir, "key"), filepath.Join(dir, "empty")
+		Expect(os.WriteFile(token, []byte("s3cret\n"), 0600)).To(Succeed())
+		Expect(os.WriteFile(key, []byte("k3y"), 0600)).To(Succeed())
+		Expect(os.WriteFile(empty, []byte("\n"), 0600)).To(Succeed())
+
+		creds, err := LoadCredentials(token, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds).To(Equal(Credentials{Token: "s3cret", HMACKey: []byte("k3y")}))
+
+		creds, err = LoadCredentials("", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds.Enabled()).To(BeFalse())
+
+		_, err = LoadCredentials(empty, "")
+		Expect(err).To(MatchError(EmptyCredentialErr))
+		_, err = LoadCredentials("", filepath.Join(dir, "missing"))
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+
+	It("accepts bearer tokens", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		serve(Credentials{Token: "s3cret"})
+
+		client := NewClient(srv.URL, &http.Client{}, WithCredentials(Credentials{Token: "s3cret"}))
+		Expect(client.Check(ctx)).To(BeSuccessful())
+		Expect(client.ReplayN(ctx, source.New(1024), 1024)).To(BeSuccessful())
+
+		invalid := testutil.ToFloat64(serverUnauthorized.WithLabelValues(authInvalid))
+		result, err := NewClient(srv.URL, &http.Client{}, WithCredentials(Credentials{Token: "wrong"})).Check(ctx)
+		Expect(err).To(MatchError(UnauthorizedErr))
+		Expect(result.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(testutil.ToFloat64(serverUnauthorized.WithLabelValues(authInvalid))).To(Equal(invalid + 1))
+
+		missing := testutil.ToFloat64(serverUnauthorized.WithLabelValues(authMissing))
+		_, err = NewClient(srv.URL, &http.Client{}).ReplayN(ctx, source.New(1024), 1024)
+		Expect(err).To(MatchError(UnauthorizedErr))
+		Expect(testutil.ToFloat64(serverUnauthorized.WithLabelValues(authMissing))).To(Equal(missing + 1))
+
+		res, err := http.Get(srv.URL + "/check")
+		Expect(err).NotTo(HaveOccurred())
+		_ = res.Body.Close()
+		Expect(res.Header.Values("WWW-Authenticate")).To(ConsistOf("Bearer"))
+	})
+
+	It("accepts HMAC signed requests", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		serve(Credentials{HMACKey: []byte("k3y")})
+
+		client := NewClient(srv.URL, &http.Client{}, WithCredentials(Credentials{HMACKey: []byte("k3y")}))
+		Expect(client.Check(ctx)).To(BeSuccessful())
+		Expect(client.ReplayChunked(ctx, source.New(1024), 256, 4)).To(BeSuccessful())
+		Expect(client.WebSocket(ctx, WebSocketSpec{TextMessages: 1, MessageSize: 16})).To(BeSuccessful())
+
+		_, err := NewClient(srv.URL, &http.Client{}, WithCredentials(Credentials{HMACKey: []byte("wrong")})).Check(ctx)
+		Expect(err).To(MatchError(UnauthorizedErr))
+		_, err = NewClient(srv.URL, &http.Client{}, WithCredentials(Credentials{Token: "k3y"})).Check(ctx)
+		Expect(err).To(MatchError(UnauthorizedErr))
+	})
+
+	It("rejects expired and replayed signatures", func() {
+		serve(Credentials{HMACKey: []byte("k3y")})
+
+		expired := testutil.ToFloat64(serverUnauthorized.WithLabelValues(authExpired))
+		Expect(status(signed("k3y", time.Now().Add(-2*MaxClockSkew), "a"))).To(Equal(http.StatusUnauthorized))
+		Expect(status(signed("k3y", time.Now().Add(2*MaxClockSkew), "b"))).To(Equal(http.StatusUnauthorized))
+		Expect(testutil.ToFloat64(serverUnauthorized.WithLabelValues(authExpired))).To(Equal(expired + 2))
+
+		replayed := testutil.ToFloat64(serverUnauthorized.WithLabelValues(authReplayed))
+		Expect(status(signed("k3y", time.Now(), "c"))).To(Equal(http.StatusOK))
+		Expect(status(signed("k3y", time.Now(), "c"))).To(Equal(http.StatusUnauthorized))
+		Expect(testutil.ToFloat64(serverUnauthorized.WithLabelValues(authReplayed))).To(Equal(replayed + 1))
+	})
+
+	It("forgets expired nonces", func() {
+		seen := &nonces{seen: make(map[string]struct{})}
+		now := time.Now()
+		Expect(seen.add("a", now)).To(BeTrue())
+		Expect(seen.add("b", now.Add(MaxClockSkew))).To(BeTrue())
+		Expect(seen.add("a", now.Add(MaxClockSkew))).To(BeFalse())
+
+		now = now.Add(2*MaxClockSkew + time.Second)
+		Expect(seen.add("a", now)).To(BeTrue())
+		Expect(seen.add("b", now)).To(BeFalse())
+		Expect(seen.queue).To(HaveLen(2))
+	})
+
+	It("only sends credentials to the server", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		creds := WithCredentials(Credentials{Token: "s3cret"})
+
+		received := make(chan string, 3)
+		other := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			received <- req.Header.Get("Authorization")
+		}))
+		DeferCleanup(other.Close)
+		redirect := httptest.NewServer(http.RedirectHandler(other.URL, http.StatusFound))
+		DeferCleanup(redirect.Close)
+
+		_, _ = NewClient(redirect.URL, &http.Client{}, creds).Check(ctx)
+		Expect(received).To(Receive(BeEmpty()))
+		Expect(NewClient(other.URL, &http.Client{}, creds).Probe(ctx, ProbeSpec{})).To(BeSuccessful())
+		Expect(received).To(Receive(BeEmpty()))
+
+		// Authorization headers sent by a HeaderSpec are not overwritten
+		serve(Credentials{})
+		spec := HeaderSpec{Header: http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}}
+		Expect(NewClient(srv.URL, &http.Client{}, creds).Headers(ctx, spec)).To(BeSuccessful())
+	})
+
+	It("accepts either credential if both are set", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		serve(Credentials{Token: "s3cret", HMACKey: []byte("k3y")})
+		Expect(NewClient(srv.URL, &http.Client{}, WithCredentials(Credentials{Token: "s3cret"})).Check(ctx)).To(BeSuccessful())
+		Expect(NewClient(srv.URL, &http.Client{}, WithCredentials(Credentials{HMACKey: []byte("k3y")})).Check(ctx)).To(BeSuccessful())
+	})
+})
@@ -21,11 +21,14 @@ import (
 	"context"
 	"crypto"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync/atomic"
 
 	"go.uber.org/zap"
 
@@ -34,125 +37,464 @@ import (
 
 var HttpStatusCodeErr = errors.New("the server responded with an unsuccessful HTTP status code")
 var ExceedsMaxRequestSizeErr = errors.New("request exceeded the server's maximum permitted size")
+var MutualTLSErr = errors.New("the server did not verify a client certificate")
+var InvalidChunksErr = errors.New("chunk size and count must be greater than zero")
 
 type Client interface {
-	Check(ctx context.Context) (bool, error)
-	ReplayN(ctx context.Context, body io.Reader, len int64) (bool, error)
+	Check(ctx context.Context) (Result, error)
+	Identify(ctx context.Context) (Result, error)
+	ReplayN(ctx context.Context, body io.Reader, len int64) (Result, error)
+	ReplayChunked(ctx context.Context, body io.Reader, chunkSize int64, count int64) (Result, error)
+	Replay(ctx context.Context, spec ReplaySpec) (Result, error)
+	Probe(ctx context.Context, spec ProbeSpec) (Result, error)
+	WebSocket(ctx context.Context, spec WebSocketSpec) (Result, error)
+	Hold(ctx context.Context, spec HoldSpec) (Result, error)
+	Download(ctx context.Context, size int64) (Result, error)
+	Upload(ctx context.Context, size int64) (Result, error)
+	Headers(ctx context.Context, spec HeaderSpec) (Result, error)
 }
 
-func NewClient(remoteAddr string, httpClient *http.Client) Client {
+type ClientOption interface {
+	apply(c *client)
+}
+
+// NewClient returns a Client of the server at remoteAddr using httpClient, which must not be nil. If remoteAddr
+// is an http+unix URL, or WithEndpoint is used, httpClient must use an *http.Transport (or the default) or an
+// h2c transport built by NewHTTPClient so that it can be redialed; NewClient panics otherwise.
+func NewClient(remoteAddr string, httpClient *http.Client, opt ...ClientOption) Client {
 	if httpClient == nil {
 		panic("httpClient must not be nil")
 	}
-	return &client{
+	c := &client{
 		http:   httpClient,
 		server: strings.TrimSuffix(remoteAddr, "/"),
 	}
+	if server, socket, ok := parseUnixURL(remoteAddr); ok {
+		c.server, c.socket = server, socket
+		c.redial("unix", socket, "a unix socket URL")
+	}
+	for _, o := range opt {
+		o.apply(c)
+	}
+	hc := *c.http
+	transport := &clientTransport{next: hc.Transport, creds: c.creds}
+	if u, err := url.Parse(c.server); err == nil {
+		transport.host = u.Host
+	}
+	hc.Transport = transport
+	c.http = &hc
+	return c
 }
 
 type client struct {
-	http   *http.Client
-	server string
+	http      *http.Client
+	server    string
+	endpoint  string
+	protocol  Protocol
+	mutualTLS bool
+	creds     Credentials
+	runID     string
+	socket    string
+	source    sourceAssertion
 }
 
-func (c *client) Check(ctx context.Context) (bool, error) {
-
+func (c *client) logger(ctx context.Context) *zap.Logger {
 	logger := logging.FromContext(ctx).Named("client").With(zap.String("server", c.server))
+	if c.endpoint != "" {
+		logger = logger.With(zap.String("endpoint", c.endpoint))
+	}
+	if c.socket != "" {
+		logger = logger.With(zap.String("socket", c.socket))
+	}
+	if corr, ok := correlationFrom(ctx); ok {
+		logger = logger.With(corr.fields()...)
+	}
+	return logger
+}
+
+// PeerIdentity is the client certificate identity verified by the server.
+type PeerIdentity struct {
+	Subject string
+	SANs    []string
+}
+
+// verifyIdentity records the client identity returned by the server. If mutual TLS is required, MutualTLSErr
+// is returned when the server did not verify a client certificate.
+func (c *client) verifyIdentity(logger *zap.Logger, res *http.Response, result *Result) error {
+	if result.Peer = peerIdentity(res); result.Peer != nil {
+		logger.Info("server verified client certificate", zap.String("subject", result.Peer.Subject), zap.Strings("sans", result.Peer.SANs))
+	} else if c.mutualTLS {
+		logger.Error("server did not verify a client certificate")
+		return result.fail(IdentityFailure, MutualTLSErr)
+	}
+	return nil
+}
+
+func peerIdentity(res *http.Response) *PeerIdentity {
+	subject := res.Header.Get(ClientSubjectHeader)
+	if subject == "" {
+		return nil
+	}
+	id := &PeerIdentity{Subject: subject}
+	if sans := res.Header.Get(ClientSANsHeader); sans != "" {
+		id.SANs = strings.Split(sans, ",")
+	}
+	return id
+}
+
+func (c *client) Check(ctx context.Context) (result Result, err error) {
+
+	ctx = c.correlate(ctx, &result)
+	logger := c.logger(ctx)
 	logger.Info("starting check")
 
-	res, err := c.http.Get(fmt.Sprintf("%s/check", c.server))
-	if err != nil {
+	ctx, trace := newTracer(ctx)
+	defer func() {
+		result.Timings = trace.done(logger)
+	}()
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/check", c.server), nil); err != nil {
+		logger.Error("an error occurred generating the check request", zap.Error(err))
+		return result, result.fail(RequestFailure, err)
+	}
+
+	var res *http.Response
+	if res, err = c.http.Do(req); err != nil {
 		logger.Error("an error occurred during check", zap.Error(err))
-		return false, err
+		return result, result.fail(classifyError(err), err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	result.StatusCode = res.StatusCode
+
+	if res.StatusCode == http.StatusUnauthorized {
+		logger.Error("check failed because the server rejected the client's credentials", zap.Strings("challenges", res.Header.Values("WWW-Authenticate")))
+		return result, result.fail(StatusFailure, UnauthorizedErr)
+	} else if res.StatusCode != http.StatusOK {
+		logger.Error("check failed with an non-200 HTTP status code", zap.Int("statusCode", res.StatusCode))
+		return result, result.fail(StatusFailure, HttpStatusCodeErr)
+	}
+
+	if err = c.verifyProtocol(logger, res, &result); err != nil {
+		return
+	}
+
+	if err = c.verifyIdentity(logger, res, &result); err != nil {
+		return
+	}
+
+	if err = c.verifySource(logger, res, trace, &result); err != nil {
+		return
 	}
 
 	if res.ContentLength != int64(len(micCheck)) {
 		logger.Error("unexpected content-length in check response", zap.Int("expected", len(micCheck)), zap.Int64("actual", res.ContentLength))
-		return false, nil
+		return result, result.fail(HeaderFailure, nil)
 	}
 
-	if body, err := io.ReadAll(res.Body); err != nil {
-		logger.Error("an error occurred while reading the check response", zap.Error(err))
-		return false, err
+	if body, e := io.ReadAll(res.Body); e != nil {
+		result.BytesReceived = int64(len(body))
+		logger.Error("an error occurred while reading the check response", zap.Error(e))
+		return result, result.fail(classifyBodyError(e), e)
 	} else if b := string(body); b != micCheck {
+		result.BytesReceived = int64(len(body))
 		logger.Warn("check response did not matched expected string", zap.String("expected", micCheck), zap.String("actual", b))
-		return false, nil
+		return result, result.fail(BodyFailure, nil)
+	} else {
+		result.BytesReceived = int64(len(body))
 	}
 
 	logger.Info("check successful")
-	return true, nil
+	result.OK = true
+	return
 }
 
-func (c *client) ReplayN(ctx context.Context, body io.Reader, len int64) (bool, error) {
+// Identify requests the identity of the server instance, which is returned as Result.Backend. The connection
+// is closed after the request so that consecutive requests may be balanced to different backends.
+func (c *client) Identify(ctx context.Context) (result Result, err error) {
 
-	logger := logging.FromContext(ctx).Named("client").With(zap.String("server", c.server))
+	ctx = c.correlate(ctx, &result)
+	logger := c.logger(ctx)
 
-	// Tee Body to calculate a digest as it's read/sent
+	ctx, trace := newTracer(ctx)
+	defer func() {
+		result.Timings = trace.done(logger)
+	}()
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/identity", c.server), nil); err != nil {
+		logger.Error("an error occurred generating the identity request", zap.Error(err))
+		return result, result.fail(RequestFailure, err)
+	}
+	req.Close = true
+
+	var res *http.Response
+	if res, err = c.http.Do(req); err != nil {
+		logger.Error("an error occurred during identity request", zap.Error(err))
+		return result, result.fail(classifyError(err), err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	result.StatusCode = res.StatusCode
+
+	if res.StatusCode != http.StatusOK {
+		logger.Error("identity request failed with an non-200 HTTP status code", zap.Int("statusCode", res.StatusCode))
+		return result, result.fail(StatusFailure, HttpStatusCodeErr)
+	}
+
+	if err = c.verifyProtocol(logger, res, &result); err != nil {
+		return
+	}
+
+	if err = c.verifyIdentity(logger, res, &result); err != nil {
+		return
+	}
+
+	if err = c.verifySource(logger, res, trace, &result); err != nil {
+		return
+	}
+
+	backend := &BackendIdentity{}
+	counter := &byteCounter{}
+	if e := json.NewDecoder(io.TeeReader(res.Body, counter)).Decode(backend); e != nil {
+		result.BytesReceived = counter.n.Load()
+		logger.Error("an error occurred while decoding the identity response", zap.Error(e))
+		return result, result.fail(BodyFailure, nil)
+	} else if result.BytesReceived = counter.n.Load(); backend.StartupID == "" {
+		logger.Error("identity response did not include a startup ID")
+		return result, result.fail(BodyFailure, nil)
+	}
+	result.Backend = backend
+
+	logger.Info("identity received", zap.String("backend", backend.String()), zap.String("node", backend.Node))
+	result.OK = true
+	return
+}
+
+func (c *client) ReplayN(ctx context.Context, body io.Reader, len int64) (Result, error) {
+	return c.replay(ctx, body, len, 0, replayEncodings{IdentityEncoding, IdentityEncoding})
+}
+
+// ReplayChunked replays count chunks of chunkSize bytes using chunked transfer-encoding. The request
+// has no Content-Length, so the server must echo it without knowing its size in advance. InvalidChunksErr
+// is returned if chunkSize or count is not positive.
+func (c *client) ReplayChunked(ctx context.Context, body io.Reader, chunkSize int64, count int64) (result Result, err error) {
+	if chunkSize <= 0 || count <= 0 {
+		return result, result.fail(RequestFailure, InvalidChunksErr)
+	}
+	return c.replay(ctx, io.LimitReader(body, chunkSize*count), -1, chunkSize, replayEncodings{IdentityEncoding, IdentityEncoding})
+}
+
+// Replay replays the body generated by spec, in chunks if the spec is chunked. If the spec has a content
+// encoding, the request body is compressed as it is sent; if it has an accept encoding, the response body is
+// requested to be compressed. The request fails with ContentEncodingErr if either encoding did not reach its
+// destination unchanged (e.g., a proxy decompressed the request, or compressed the response again), and the
+// digest of the decoded response is compared to that of the uncompressed request.
+func (c *client) Replay(ctx context.Context, spec ReplaySpec) (Result, error) {
+	encodings := replayEncodings{content: spec.ContentEncoding(), accept: spec.AcceptEncoding()}
+	if spec.Chunks() > 0 {
+		return c.replay(ctx, io.LimitReader(spec.Generate(), spec.ChunkSize()*spec.Chunks()), -1, spec.ChunkSize(), encodings)
+	}
+	return c.replay(ctx, spec.Generate(), spec.Size(), 0, encodings)
+}
+
+// replayEncodings are the content-encoding of a replay request and the encoding it accepts in response.
+type replayEncodings struct {
+	content Encoding
+	accept  Encoding
+}
+
+// replay sends body to the server and validates the response. If chunkSize is positive, the request is sent
+// using chunked transfer-encoding with chunks of chunkSize bytes. If the request is compressed, len is ignored
+// since its compressed length is unknown.
+func (c *client) replay(ctx context.Context, body io.Reader, len int64, chunkSize int64, encodings replayEncodings) (result Result, err error) {
+
+	ctx = c.correlate(ctx, &result)
+	logger := c.logger(ctx)
+
+	ctx, trace := newTracer(ctx)
+
+	// Tee Body to calculate a digest and length as it's read/sent
 	expected := crypto.SHA256.New()
-	body = io.TeeReader(body, expected)
+	sent := &byteCounter{}
+	body = io.TeeReader(body, io.MultiWriter(expected, sent))
+	wire := sent
+	if encodings.content != IdentityEncoding {
+		wire = &byteCounter{}
+		encoded := encodeBody(body, encodings.content, wire)
+		defer func() {
+			_ = encoded.Close()
+		}()
+		body, len = encoded, -1
+	}
+	if chunkSize > 0 {
+		body = &chunkedBody{Reader: body, size: chunkSize}
+	}
+
+	defer func() {
+		result.BytesSent = sent.n.Load()
+		result.WireBytesSent = wire.n.Load()
+		result.Timings = trace.done(logger)
+	}()
 
 	var req *http.Request
-	if r, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/replay", c.server), body); err == nil {
-		r.ContentLength = len
-		r.Header.Set(contentType, "application/octet-stream")
-		req = r
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/replay", c.server), body); err == nil {
+		req.ContentLength = len
+		req.Header.Set(contentType, "application/octet-stream")
+		if encodings.content != IdentityEncoding {
+			req.Header.Set(contentEncoding, string(encodings.content))
+		}
+
+		// Accept-Encoding is always set so that the transport does not request, and transparently decode, gzip
+		req.Header.Set(acceptEncoding, string(encodings.accept))
 	} else {
 		logger.Error("an error occurred generating the replay request", zap.Error(err))
+		return result, result.fail(RequestFailure, err)
 	}
 
 	var res *http.Response
-	logger.Debug("initiating replay request", zap.Int64("len", req.ContentLength))
-	if r, err := c.http.Do(req); err == nil {
-		res = r
+	logger.Debug("initiating replay request",
+		zap.Int64("len", req.ContentLength),
+		zap.Int64("chunkSize", chunkSize),
+		zap.String("encoding", string(encodings.content)),
+		zap.String("accept", string(encodings.accept)))
+	if res, err = c.http.Do(req); err == nil {
 		defer func() {
 			_ = res.Body.Close()
 		}()
-		logger.Info("received replay response", zap.Int("code", res.StatusCode), zap.Int64("len", res.ContentLength), zap.String("content", res.Header.Get(contentType)))
+		result.StatusCode = res.StatusCode
+		logger.Info("received replay response",
+			zap.Int("code", res.StatusCode),
+			zap.Int64("len", res.ContentLength),
+			zap.String("content", res.Header.Get(contentType)),
+			zap.Strings("encoding", res.Header.Values(contentEncoding)))
 	} else {
 		logger.Error("replay request failed", zap.Error(err))
+		return result, result.fail(classifyError(err), err)
 	}
 
 	// Validate the response headers
 	if res.StatusCode != http.StatusOK {
-		err := HttpStatusCodeErr
+		err = HttpStatusCodeErr
 		if res.StatusCode == http.StatusRequestEntityTooLarge {
 			err = ExceedsMaxRequestSizeErr
 			logger.Error("replay request failed because it exceed the server's maximum request size")
+		} else if res.StatusCode == http.StatusUnauthorized {
+			err = UnauthorizedErr
+			logger.Error("replay request failed because the server rejected the client's credentials", zap.Strings("challenges", res.Header.Values("WWW-Authenticate")))
+		} else if res.StatusCode == http.StatusUnsupportedMediaType {
+			err = fmt.Errorf("%w: the server does not support %s", ContentEncodingErr, encodings.content)
+			logger.Error("replay request failed because the server did not support its content-encoding", zap.String("encoding", string(encodings.content)))
+		} else if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+			err = ServerBusyErr
+			logger.Error("replay request failed because the server was busy", zap.Int("statusCode", res.StatusCode), zap.String("retryAfter", res.Header.Get("Retry-After")))
 		} else {
 			logger.Error("replay request failed with an non-200 HTTP status code", zap.Int("statusCode", res.StatusCode))
 		}
-		return false, err
-	} else if res.ContentLength != req.ContentLength {
+		return result, result.fail(StatusFailure, err)
+	} else if err = c.verifyProtocol(logger, res, &result); err != nil {
+		return
+	} else if err = c.verifyIdentity(logger, res, &result); err != nil {
+		return
+	} else if err = verifyEncodings(logger, res, encodings, &result); err != nil {
+		return
+	} else if req.ContentLength >= 0 && encodings.accept == IdentityEncoding && res.ContentLength != req.ContentLength {
 		logger.Error(
 			"replay request failed because the response content-length did not match the request length",
 			zap.Int64("reqContentLength", req.ContentLength),
 			zap.Int64("resContentLength", res.ContentLength),
 		)
-		return false, nil
+		return result, result.fail(HeaderFailure, nil)
 	} else if res.Header.Get(contentType) != "application/octet-stream" {
 		logger.Error(
 			"replay request failed because the response content-type was not 'application/octet-stream",
 			zap.String("resContentType", res.Header.Get(contentType)),
 		)
-		return false, nil
+		return result, result.fail(HeaderFailure, nil)
 	}
 
-	// Validate the response body
+	// Validate the decoded response body; the length is compared to the bytes sent since chunked and
+	// compressed responses have no content-length
+	raw := &wireReader{Reader: res.Body}
+	defer func() {
+		result.WireBytesReceived = raw.n
+	}()
 	actual := crypto.SHA256.New()
-	if n, err := io.CopyN(actual, res.Body, res.ContentLength); err != nil {
-		logger.Error("an error occurred while reading the response", zap.Error(err))
-		return false, nil
-	} else if n != res.ContentLength {
-		logger.Error("response body length did not match specified content length", zap.Int64("actual", n), zap.Int64("expected", res.ContentLength))
-		return false, nil
+	if n, e := decodeBody(actual, raw, encodings.accept); e != nil {
+		result.BytesReceived = n
+		if raw.err == nil {
+			logger.Error("an error occurred while decoding the response", zap.Error(e), zap.String("encoding", string(encodings.accept)))
+			return result, result.fail(BodyFailure, nil)
+		}
+		logger.Error("an error occurred while reading the response", zap.Error(e))
+		return result, result.fail(classifyBodyError(e), nil)
+	} else if result.BytesReceived = n; n != sent.n.Load() {
+		logger.Error("response body length did not match request body length", zap.Int64("actual", n), zap.Int64("expected", sent.n.Load()))
+		return result, result.fail(LengthFailure, nil)
 	}
 
 	// Compare digests to determine success
-	if exp, act := "sha256:"+hex.EncodeToString(expected.Sum(nil)), "sha256:"+hex.EncodeToString(actual.Sum([]byte(nil))); exp == act {
-		logger.Info("replay successful", zap.String("digest", act))
-		return true, nil
+	result.ExpectedDigest = "sha256:" + hex.EncodeToString(expected.Sum(nil))
+	result.ActualDigest = "sha256:" + hex.EncodeToString(actual.Sum(nil))
+	if result.ExpectedDigest == result.ActualDigest {
+		logger.Info("replay successful", zap.String("digest", result.ActualDigest), zap.Int64("wireBytesSent", wire.n.Load()), zap.Int64("wireBytesReceived", raw.n))
+		result.OK = true
 	} else {
-		logger.Warn("response body did not match request body", zap.String("expectedDigest", exp), zap.String("actualDigest", act))
-		return false, nil
+		logger.Warn("response body did not match request body", zap.String("expectedDigest", result.ExpectedDigest), zap.String("actualDigest", result.ActualDigest))
+		result.fail(DigestFailure, nil)
 	}
+	return
+}
+
+// byteCounter is an io.Writer that counts the bytes written to it. Request bodies are written by the
+// http.Transport, so the count is safe for concurrent use.
+type byteCounter struct {
+	n atomic.Int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// chunkedBody is a request body that writes itself in chunks of the specified size. The http.Transport
+// copies bodies implementing io.WriterTo directly to its chunked writer, so each Write becomes one chunk.
+type chunkedBody struct {
+	io.Reader
+	size int64
+}
+
+func (b *chunkedBody) WriteTo(w io.Writer) (total int64, err error) {
+	buf := make([]byte, b.size)
+	for {
+		n, rerr := io.ReadFull(b.Reader, buf)
+		if n > 0 {
+			var m int
+			m, err = w.Write(buf[:n])
+			total += int64(m)
+			if err != nil {
+				return
+			}
+		}
+		if errors.Is(rerr, io.EOF) || errors.Is(rerr, io.ErrUnexpectedEOF) {
+			return
+		} else if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+// WithMutualTLS requires the server to verify the client's certificate. Requests for which the server does
+// not return a verified client identity fail with MutualTLSErr.
+func WithMutualTLS() ClientOption {
+	return mutualTLSOption{}
+}
+
+type mutualTLSOption struct{}
+
+func (o mutualTLSOption) apply(c *client) {
+	c.mutualTLS = true
 }
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -39,31 +40,141 @@ var _ = Describe("Client", func() {
 
 	It("Checks out", func(ctx context.Context) {
 		ctx = logging.NewContext(ctx, logger)
-		Expect(client.Check(ctx)).To(BeTrue())
+		Expect(client.Check(ctx)).To(BeSuccessful())
+	})
+
+	It("Records request timings", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		httpClient, err := NewHTTPClient(ClientConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		client = NewClient(fmt.Sprintf("http://%s", server.Addr), httpClient)
+
+		result, err := client.Check(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeSuccessful())
+		Expect(result.Timings.Reused).To(BeFalse())
+		Expect(result.Timings.Connect).To(BeNumerically(">", 0))
+		Expect(result.Timings.TTFB).To(BeNumerically(">", 0))
+		Expect(result.Timings.Total).To(BeNumerically(">=", result.Timings.Connect+result.Timings.TTFB))
+
+		result, err = client.Check(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Timings.Reused).To(BeTrue())
+		Expect(result.Timings.Connect).To(BeZero())
+	})
+
+	It("Identifies the backend", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		result, err := client.Identify(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeSuccessful())
+		Expect(result.Backend).To(HaveValue(Equal(Identity)))
 	})
 
 	It("Replays small messages", func(ctx context.Context) {
 		ctx = logging.NewContext(ctx, logger)
 		buf := bytes.NewBuffer([]byte("All work and no play makes Jack a dull boy. 😎"))
-		Expect(client.ReplayN(ctx, buf, int64(buf.Len()))).To(BeTrue())
+		size := int64(buf.Len())
+		result, err := client.ReplayN(ctx, buf, size)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeSuccessful())
+		Expect(result.Failure).To(Equal(NoFailure))
+		Expect(result.StatusCode).To(Equal(http.StatusOK))
+		Expect(result.BytesSent).To(Equal(size))
+		Expect(result.BytesReceived).To(Equal(size))
+		Expect(result.ActualDigest).To(HavePrefix("sha256:"))
+		Expect(result.ActualDigest).To(Equal(result.ExpectedDigest))
 	})
 
 	It("Replays large messages", func(ctx context.Context) {
 		ctx = logging.NewContext(ctx, logger)
 		var size int64 = 128 * 1024 * 1024
 		msg := source.New(size)
-		Expect(client.ReplayN(ctx, msg, int64(size))).To(BeTrue())
+		Expect(client.ReplayN(ctx, msg, int64(size))).To(BeSuccessful())
 	})
 
 	It("Handles RequestEntityTooLarge errors", func(ctx context.Context) {
 		ctx = logging.NewContext(ctx, logger)
 		var size int64 = 129 * 1024 * 1024
 		msg := source.New(size)
-		ok, err := client.ReplayN(ctx, msg, size)
-		Expect(ok).To(BeFalse())
+		result, err := client.ReplayN(ctx, msg, size)
+		Expect(result.OK).To(BeFalse())
+		Expect(result.Failure).To(Equal(StatusFailure))
+		Expect(result.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(err).To(MatchError(ExceedsMaxRequestSizeErr))
+	})
+
+	It("Honours canceled contexts", func(ctx context.Context) {
+		ctx, cancel := context.WithCancel(logging.NewContext(ctx, logger))
+		cancel()
+		result, err := client.Check(ctx)
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(result.OK).To(BeFalse())
+		Expect(result.Failure).To(Equal(CanceledFailure))
+		result, err = client.ReplayN(ctx, source.New(1024), 1024)
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(result.Failure).To(Equal(CanceledFailure))
+	})
+
+	It("Categorizes refused connections", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		addr := listener.Addr().String()
+		Expect(listener.Close()).To(Succeed())
+
+		result, err := NewClient(fmt.Sprintf("http://%s", addr), http.DefaultClient).ReplayN(ctx, source.New(1024), 1024)
+		Expect(err).To(HaveOccurred())
+		Expect(result.OK).To(BeFalse())
+		Expect(result.Failure).To(Equal(RefusedFailure))
+		Expect(result.StatusCode).To(BeZero())
+	})
+
+	It("Replays chunked messages", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		Expect(client.ReplayChunked(ctx, source.New(1024*1024), 4096, 256)).To(BeSuccessful())
+	})
+
+	It("Replays chunked messages with large chunks", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		Expect(client.ReplayChunked(ctx, source.New(64*1024*1024), 1024*1024, 64)).To(BeSuccessful())
+	})
+
+	It("Rejects invalid chunks", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		result, err := client.ReplayChunked(ctx, source.New(1024), 0, 4)
+		Expect(err).To(MatchError(InvalidChunksErr))
+		Expect(result.Failure).To(Equal(RequestFailure))
+	})
+
+	It("Handles RequestEntityTooLarge errors for chunked messages", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		result, err := client.ReplayChunked(ctx, source.New(129*1024*1024), 1024*1024, 129)
+		Expect(result.OK).To(BeFalse())
 		Expect(err).To(MatchError(ExceedsMaxRequestSizeErr))
 	})
 
+	Context("when streaming", func() {
+
+		It("Replays messages", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			var size int64 = 8 * 1024 * 1024
+			msg := source.New(size)
+			Expect(client.ReplayN(ctx, msg, size)).To(BeSuccessful())
+		})
+
+		It("Replays chunked messages", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			Expect(client.ReplayChunked(ctx, source.New(4*1024*1024), 64*1024, 64)).To(BeSuccessful())
+		})
+
+		BeforeEach(func() {
+			srv := httptest.NewServer(NewHandler(WithStreamedReplays()))
+			DeferCleanup(srv.Close)
+			client = NewClient(srv.URL, http.DefaultClient)
+		})
+	})
+
 	BeforeEach(func() {
 		client = NewClient(fmt.Sprintf("http://%s", server.Addr), http.DefaultClient)
 	})
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Correlation headers are sent with each client request and echoed by the server, which adds them to every log
+// line for the request so that client and server logs can be correlated.
+const (
+	RequestIDHeader = "X-Request-Id"
+	SpecHeader      = "X-Konfirm-Spec"
+	RunIDHeader     = "X-Konfirm-Run-Id"
+)
+
+// maxCorrelationLength limits the length of correlation header values logged by the server.
+const maxCorrelationLength = 128
+
+// NewID returns a random ID suitable for a request or run ID.
+func NewID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// correlation identifies a request, the spec it is part of, and the inspection run that sent it.
+type correlation struct {
+	requestID string
+	spec      string
+	runID     string
+}
+
+// fields returns the zap fields of the set IDs.
+func (c correlation) fields() []zap.Field {
+	fields := []zap.Field{zap.String("requestId", c.requestID)}
+	if c.spec != "" {
+		fields = append(fields, zap.String("spec", c.spec))
+	}
+	if c.runID != "" {
+		fields = append(fields, zap.String("runId", c.runID))
+	}
+	return fields
+}
+
+// set sets the correlation headers of the set IDs.
+func (c correlation) set(header http.Header) {
+	for k, v := range map[string]string{RequestIDHeader: c.requestID, SpecHeader: c.spec, RunIDHeader: c.runID} {
+		if v != "" {
+			header.Set(k, v)
+		}
+	}
+}
+
+type correlationKey struct{}
+type specKey struct{}
+
+// WithSpec names the spec of requests made using ctx (e.g., a replay spec), which is sent to the server.
+func WithSpec(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, specKey{}, name)
+}
+
+// WithRunID identifies the inspection run that sent the client's requests, which is sent to the server.
+func WithRunID(id string) ClientOption {
+	return runIDOption(id)
+}
+
+type runIDOption string
+
+func (o runIDOption) apply(c *client) {
+	c.runID = string(o)
+}
+
+// correlate returns a context identifying a new request, whose ID is recorded in result. The client's logger
+// and transport add the request's correlation IDs to its log lines and headers.
+func (c *client) correlate(ctx context.Context, result *Result) context.Context {
+	spec, _ := ctx.Value(specKey{}).(string)
+	result.RequestID = NewID()
+	return context.WithValue(ctx, correlationKey{}, correlation{requestID: result.RequestID, spec: spec, runID: c.runID})
+}
+
+// correlationFrom returns the correlation of the request made using ctx, if any.
+func correlationFrom(ctx context.Context) (correlation, bool) {
+	c, ok := ctx.Value(correlationKey{}).(correlation)
+	return c, ok
+}
+
+type requestLoggerKey struct{}
+
+// correlateRequests wraps next, adding the correlation IDs of each request to the logger returned by
+// requestLogger and echoing them in the response headers. Requests without a request ID are assigned one.
+func correlateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		truncate := func(s string) string {
+			return s[:min(len(s), maxCorrelationLength)]
+		}
+		c := correlation{
+			requestID: truncate(req.Header.Get(RequestIDHeader)),
+			spec:      truncate(req.Header.Get(SpecHeader)),
+			runID:     truncate(req.Header.Get(RunIDHeader)),
+		}
+		if c.requestID == "" {
+			c.requestID = NewID()
+		}
+		c.set(res.Header())
+		fields := c.fields()
+		if name := listenerName(req.Context()); name != "" {
+			fields = append(fields, zap.String("listener", name))
+		}
+		ctx := context.WithValue(req.Context(), requestLoggerKey{}, logger.Named("server").With(fields...))
+		next.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+// requestLogger returns the server logger of req, including its correlation IDs if set by correlateRequests.
+func requestLogger(req *http.Request) *zap.Logger {
+	if l, ok := req.Context().Value(requestLoggerKey{}).(*zap.Logger); ok {
+		return l
+	}
+	return logger.Named("server")
+}
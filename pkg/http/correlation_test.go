@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var _ = Describe("Correlation", func() {
+
+	var srv *httptest.Server
+	var logs *observer.ObservedLogs
+
+	BeforeEach(func() {
+		var core zapcore.Core
+		core, logs = observer.New(zapcore.DebugLevel)
+		previous := logger
+		SetServerLogger(zap.New(core))
+		DeferCleanup(SetServerLogger, previous)
+		srv = httptest.NewServer(NewHandler())
+		DeferCleanup(srv.Close)
+	})
+
+	// serverLogs returns the server log entries of the request
+	serverLogs := func(requestID string) []observer.LoggedEntry {
+		return logs.Filter(func(e observer.LoggedEntry) bool {
+			return e.ContextMap()["requestId"] == requestID
+		}).All()
+	}
+
+	It("adds the request, spec, and run IDs to the server's logs", func(ctx context.Context) {
+		ctx = WithSpec(logging.NewContext(ctx, logger), "small:1Ki")
+		client := NewClient(srv.URL, &http.Client{}, WithRunID("run-1"))
+
+		result, err := client.ReplayN(ctx, source.New(1024), 1024)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequestID).NotTo(BeEmpty())
+		entries := serverLogs(result.RequestID)
+		Expect(entries).NotTo(BeEmpty())
+		for _, e := range entries {
+			Expect(e.ContextMap()).To(HaveKeyWithValue("spec", "small:1Ki"))
+			Expect(e.ContextMap()).To(HaveKeyWithValue("runId", "run-1"))
+		}
+
+		// Each request has its own ID
+		next, err := client.Check(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(next.RequestID).NotTo(Equal(result.RequestID))
+		Expect(serverLogs(next.RequestID)).NotTo(BeEmpty())
+	})
+
+	It("correlates websocket upgrades", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		result, err := NewClient(srv.URL, &http.Client{}).WebSocket(ctx, WebSocketSpec{TextMessages: 1, MessageSize: 16})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(serverLogs(result.RequestID)).NotTo(BeEmpty())
+	})
+
+	It("echoes correlation headers", func() {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/check", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set(RequestIDHeader, "req-1")
+		req.Header.Set(SpecHeader, strings.Repeat("s", 2*maxCorrelationLength))
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		_ = res.Body.Close()
+		Expect(res.Header.Get(RequestIDHeader)).To(Equal("req-1"))
+		Expect(res.Header.Get(SpecHeader)).To(HaveLen(maxCorrelationLength))
+		Expect(res.Header.Get(RunIDHeader)).To(BeEmpty())
+	})
+
+	It("assigns request IDs to requests without one", func() {
+		res, err := http.Get(srv.URL + "/check")
+		Expect(err).NotTo(HaveOccurred())
+		_ = res.Body.Close()
+		id := res.Header.Get(RequestIDHeader)
+		Expect(id).NotTo(BeEmpty())
+		Expect(serverLogs(id)).NotTo(BeEmpty())
+	})
+})
@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"go.uber.org/zap"
+)
+
+var UnsupportedEncodingErr = errors.New("content encodings must be one of identity, gzip, deflate, or br")
+var ContentEncodingErr = errors.New("the content-encoding was not preserved between the client and server")
+
+const (
+	contentEncoding = "Content-Encoding"
+	acceptEncoding  = "Accept-Encoding"
+
+	// RequestEncodingHeader is the response header in which the server returns the content-encoding of the
+	// replay request it received, so that the client can detect encodings added or removed by a proxy.
+	RequestEncodingHeader = "X-Konfirm-Request-Encoding"
+)
+
+// Encoding is an HTTP content-coding with which replay bodies may be compressed.
+type Encoding string
+
+const (
+	// IdentityEncoding is an uncompressed body.
+	IdentityEncoding Encoding = "identity"
+
+	// GzipEncoding is a body compressed using gzip (RFC 1952).
+	GzipEncoding Encoding = "gzip"
+
+	// DeflateEncoding is a body compressed using the zlib format (RFC 1950), as HTTP defines deflate.
+	DeflateEncoding Encoding = "deflate"
+
+	// BrotliEncoding is a body compressed using Brotli (RFC 7932).
+	BrotliEncoding Encoding = "br"
+)
+
+// ParseEncoding returns the Encoding named by s, which is case-insensitive. An empty s is IdentityEncoding.
+func ParseEncoding(s string) (Encoding, error) {
+	switch e := Encoding(strings.ToLower(strings.TrimSpace(s))); e {
+	case "", IdentityEncoding:
+		return IdentityEncoding, nil
+	case GzipEncoding, DeflateEncoding, BrotliEncoding:
+		return e, nil
+	default:
+		return e, UnsupportedEncodingErr
+	}
+}
+
+// encodeWriter is a compressing writer that can flush the data written so far, as streamed replays require.
+type encodeWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encoder returns a writer compressing to w. It must not be called for IdentityEncoding.
+func (e Encoding) encoder(w io.Writer) encodeWriter {
+	switch e {
+	case GzipEncoding:
+		return gzip.NewWriter(w)
+	case DeflateEncoding:
+		return zlib.NewWriter(w)
+	case BrotliEncoding:
+		return brotli.NewWriter(w)
+	default:
+		panic(fmt.Sprintf("unsupported encoding %q", e))
+	}
+}
+
+// decoder returns a reader decompressing r, which for IdentityEncoding is r.
+func (e Encoding) decoder(r io.Reader) (io.ReadCloser, error) {
+	switch e {
+	case IdentityEncoding:
+		return io.NopCloser(r), nil
+	case GzipEncoding:
+		return gzip.NewReader(r)
+	case DeflateEncoding:
+		return zlib.NewReader(r)
+	case BrotliEncoding:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	default:
+		return nil, UnsupportedEncodingErr
+	}
+}
+
+// negotiateEncodings decodes the body of req and selects the encoding of the response from its
+// Accept-Encoding header, which is set as the response's Content-Encoding. The request's encoding is returned
+// in the RequestEncodingHeader. Requests with an unsupported encoding are rejected with 415 Unsupported Media
+// Type and undecodable requests with 400 Bad Request, in which case ok is false. Since the decoded length of
+// an encoded request is unknown, its ContentLength is set to -1.
+func negotiateEncodings(logger *zap.Logger, res http.ResponseWriter, req *http.Request) (Encoding, bool) {
+
+	headers := res.Header()
+	reqEncoding, err := ParseEncoding(strings.Join(req.Header.Values(contentEncoding), ", "))
+	if err != nil {
+		logger.Warn("unsupported request content-encoding", zap.Strings("encoding", req.Header.Values(contentEncoding)))
+		headers.Set(acceptEncoding, "gzip, deflate, br")
+		res.WriteHeader(http.StatusUnsupportedMediaType)
+		return IdentityEncoding, false
+	}
+	if reqEncoding != IdentityEncoding {
+		body, err := reqEncoding.decoder(req.Body)
+		if err != nil {
+			logger.Warn("unable to decode request body", zap.String("encoding", string(reqEncoding)), zap.Error(err))
+			res.WriteHeader(http.StatusBadRequest)
+			return IdentityEncoding, false
+		}
+		req.Body, req.ContentLength = body, -1
+	}
+	headers.Set(RequestEncodingHeader, string(reqEncoding))
+
+	resEncoding := acceptedEncoding(req.Header.Values(acceptEncoding))
+	if resEncoding != IdentityEncoding {
+		headers.Set(contentEncoding, string(resEncoding))
+	}
+	headers.Add("Vary", acceptEncoding)
+	logger.Debug("negotiated replay encodings", zap.String("request", string(reqEncoding)), zap.String("response", string(resEncoding)))
+	return resEncoding, true
+}
+
+// acceptedEncoding returns the supported encoding with the highest quality in the Accept-Encoding values,
+// preferring those listed first, or IdentityEncoding if none are acceptable.
+func acceptedEncoding(values []string) Encoding {
+	accepted, best := IdentityEncoding, 0.0
+	for _, v := range values {
+		for _, coding := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			e, err := ParseEncoding(name)
+			if err != nil || e == IdentityEncoding {
+				continue
+			}
+			q := 1.0
+			if p, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if q, err = strconv.ParseFloat(p, 64); err != nil {
+					continue
+				}
+			}
+			if q > best {
+				accepted, best = e, q
+			}
+		}
+	}
+	return accepted
+}
+
+// encodeBody returns a reader of body compressed using e, counting the compressed bytes in wire. Compression
+// happens as the reader is read; closing the reader stops it.
+func encodeBody(body io.Reader, e Encoding, wire io.Writer) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		enc := e.encoder(io.MultiWriter(w, wire))
+		_, err := io.Copy(enc, body)
+		_ = w.CloseWithError(errors.Join(err, enc.Close()))
+	}()
+	return r
+}
+
+// verifyEncodings verifies that the server received the replay request with its content-encoding, and that
+// the response has the accepted content-encoding. Responses without a RequestEncodingHeader are assumed to
+// have received an uncompressed request.
+func verifyEncodings(logger *zap.Logger, res *http.Response, encodings replayEncodings, result *Result) error {
+	received := res.Header.Get(RequestEncodingHeader)
+	if received == "" {
+		received = string(IdentityEncoding)
+	}
+	if received != string(encodings.content) {
+		logger.Error("replay request failed because the server did not receive the request's content-encoding",
+			zap.String("sent", string(encodings.content)),
+			zap.String("received", received))
+		return result.fail(HeaderFailure, fmt.Errorf("%w: the request was sent as %s but received as %s", ContentEncodingErr, encodings.content, received))
+	}
+
+	encoded := strings.Join(res.Header.Values(contentEncoding), ", ")
+	if encoded == "" {
+		encoded = string(IdentityEncoding)
+	}
+	if encoded != string(encodings.accept) {
+		logger.Error("replay request failed because the response content-encoding was not the one accepted",
+			zap.String("accepted", string(encodings.accept)),
+			zap.String("received", encoded))
+		return result.fail(HeaderFailure, fmt.Errorf("%w: %s was accepted but the response was %s", ContentEncodingErr, encodings.accept, encoded))
+	}
+	return nil
+}
+
+// decodeBody copies r, decoded using e, to w, returning the number of decoded bytes copied.
+func decodeBody(w io.Writer, r io.Reader, e Encoding) (int64, error) {
+	decoded, err := e.decoder(r)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = decoded.Close()
+	}()
+	return io.Copy(w, decoded)
+}
+
+// wireReader counts the bytes of a response body as received on the wire, and records the error, if any,
+// reading it so that errors receiving the body can be distinguished from errors decoding it.
+type wireReader struct {
+	io.Reader
+	n   int64
+	err error
+}
+
+func (r *wireReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.n += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.err = err
+	}
+	return
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+// gzipWriter compresses a response again, as a misconfigured proxy might, appending to its Content-Encoding.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Add(contentEncoding, string(GzipEncoding))
+		w.Header().Del(contentLength)
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.gz.Write(p)
+}
+
+var _ = Describe("Encodings", func() {
+
+	replay := func(ctx context.Context, url string, desc string) (Result, error) {
+		spec, err := NewReplaySpec(desc)
+		Expect(err).NotTo(HaveOccurred())
+		return NewClient(url, &http.Client{}).Replay(ctx, spec)
+	}
+
+	DescribeTable("parses encodings", func(s string, expected Encoding, valid bool) {
+		e, err := ParseEncoding(s)
+		if valid {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(e).To(Equal(expected))
+		} else {
+			Expect(err).To(MatchError(UnsupportedEncodingErr))
+		}
+	},
+		Entry("empty", "", IdentityEncoding, true),
+		Entry("identity", "identity", IdentityEncoding, true),
+		Entry("gzip", "GZIP", GzipEncoding, true),
+		Entry("deflate", "deflate", DeflateEncoding, true),
+		Entry("brotli", "BR", BrotliEncoding, true),
+		Entry("zstd", "zstd", IdentityEncoding, false),
+		Entry("layered", "gzip, gzip", IdentityEncoding, false),
+	)
+
+	DescribeTable("selects the accepted encoding", func(accept string, expected Encoding) {
+		Expect(acceptedEncoding([]string{accept})).To(Equal(expected))
+	},
+		Entry("none", "", IdentityEncoding),
+		Entry("first", "deflate, gzip", DeflateEncoding),
+		Entry("highest quality", "gzip;q=0.5, deflate;q=0.8", DeflateEncoding),
+		Entry("brotli", "zstd, br", BrotliEncoding),
+		Entry("unsupported", "zstd, compress", IdentityEncoding),
+		Entry("unacceptable", "zstd, gzip;q=0", IdentityEncoding),
+	)
+
+	DescribeTable("replays compressed bodies", func(ctx context.Context, desc string, stream bool) {
+		ctx = logging.NewContext(ctx, logger)
+		var opts []HandlerOption
+		if stream {
+			opts = append(opts, WithStreamedReplays())
+		}
+		srv := httptest.NewServer(NewHandler(opts...))
+		DeferCleanup(srv.Close)
+
+		spec, err := NewReplaySpec(desc)
+		Expect(err).NotTo(HaveOccurred())
+		result, err := NewClient(srv.URL, &http.Client{}).Replay(ctx, spec)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeSuccessful())
+		Expect(result.BytesSent).To(Equal(spec.Size()))
+		Expect(result.BytesReceived).To(Equal(spec.Size()))
+		if spec.ContentEncoding() == IdentityEncoding {
+			Expect(result.WireBytesSent).To(Equal(result.BytesSent))
+		} else {
+			Expect(result.WireBytesSent).To(BeNumerically("<", result.BytesSent))
+		}
+		if spec.AcceptEncoding() == IdentityEncoding {
+			Expect(result.WireBytesReceived).To(Equal(result.BytesReceived))
+		} else {
+			Expect(result.WireBytesReceived).To(BeNumerically("<", result.BytesReceived))
+		}
+	},
+		Entry("uncompressed", "plain:64Ki", false),
+		Entry("gzip request", "gzip:64Ki,encoding=gzip", false),
+		Entry("deflate response", "deflate:64Ki,accept=deflate", false),
+		Entry("both", "both:1Mi,encoding=gzip,accept=deflate", false),
+		Entry("chunked", "chunky:16x4Ki,encoding=deflate,accept=gzip", false),
+		Entry("brotli", "brotli:1Mi,encoding=br,accept=br", false),
+		Entry("streamed", "streamed:1Mi,encoding=gzip,accept=gzip", true),
+		Entry("streamed and chunked", "streamed:64x16Ki,encoding=deflate,accept=deflate", true),
+		Entry("streamed brotli", "streamed:1Mi,encoding=br,accept=br", true),
+	)
+
+	It("fails if a proxy decompresses the request", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		handler := NewHandler()
+		srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.Header.Get(contentEncoding) == string(GzipEncoding) {
+				body, err := gzip.NewReader(req.Body)
+				Expect(err).NotTo(HaveOccurred())
+				req.Body = body
+				req.Header.Del(contentEncoding)
+			}
+			handler.ServeHTTP(res, req)
+		}))
+		DeferCleanup(srv.Close)
+
+		result, err := replay(ctx, srv.URL, "stripped:64Ki,encoding=gzip")
+		Expect(err).To(MatchError(ContentEncodingErr))
+		Expect(result.Failure).To(Equal(HeaderFailure))
+	})
+
+	It("fails if a proxy compresses the response again", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		handler := NewHandler()
+		srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			w := &gzipWriter{ResponseWriter: res, gz: gzip.NewWriter(res)}
+			handler.ServeHTTP(w, req)
+			Expect(w.gz.Close()).To(Succeed())
+		}))
+		DeferCleanup(srv.Close)
+
+		result, err := replay(ctx, srv.URL, "double:64Ki,accept=gzip")
+		Expect(err).To(MatchError(ContentEncodingErr))
+		Expect(err.Error()).To(ContainSubstring("gzip, gzip"))
+		Expect(result.Failure).To(Equal(HeaderFailure))
+
+		_, err = replay(ctx, srv.URL, "uncompressed:64Ki")
+		Expect(err).To(MatchError(ContentEncodingErr))
+	})
+
+	It("rejects unsupported request encodings", func() {
+		srv := httptest.NewServer(NewHandler())
+		DeferCleanup(srv.Close)
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/replay", strings.NewReader("not really zstd"))
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set(contentEncoding, "zstd")
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		_ = res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusUnsupportedMediaType))
+		Expect(res.Header.Get(acceptEncoding)).To(Equal("gzip, deflate, br"))
+	})
+})
@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"bufio"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var InvalidFaultProbabilityErr = errors.New("fault probabilities must be between 0 and 1")
+
+// FaultConfig describes the faults injected into responses, each with the probability (between 0 and 1) it is
+// injected into a given response. Faults are chosen independently, so a response may have several.
+type FaultConfig struct {
+
+	// Corrupt flips CorruptBytes bytes of the response body.
+	Corrupt      float64
+	CorruptBytes int
+
+	// Truncate sends only half of the response body.
+	Truncate float64
+
+	// ContentType sends the wrong Content-Type.
+	ContentType float64
+
+	// Delay waits DelayDuration before handling the request, delaying the response headers.
+	Delay         float64
+	DelayDuration time.Duration
+
+	// Reset resets the connection without responding.
+	Reset float64
+
+	// Error responds with a random 5xx status code without handling the request.
+	Error float64
+}
+
+// Validate returns InvalidFaultProbabilityErr if any probability is not between 0 and 1.
+func (c FaultConfig) Validate() error {
+	for _, p := range []float64{c.Corrupt, c.Truncate, c.ContentType, c.Delay, c.Reset, c.Error} {
+		if p < 0 || p > 1 {
+			return InvalidFaultProbabilityErr
+		}
+	}
+	return nil
+}
+
+// Enabled is true if any fault may be injected.
+func (c FaultConfig) Enabled() bool {
+	return c.Corrupt > 0 || c.Truncate > 0 || c.ContentType > 0 || c.Delay > 0 || c.Reset > 0 || c.Error > 0
+}
+
+// WithFaults injects faults into the handler's responses.
+func WithFaults(cfg FaultConfig) HandlerOption {
+	return faultOption(cfg)
+}
+
+type faultOption FaultConfig
+
+func (o faultOption) apply(h *handlerConfig) {
+	h.faults = FaultConfig(o)
+}
+
+var errorStatusCodes = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+func roll(p float64) bool {
+	return p > 0 && rand.Float64() < p
+}
+
+// injectFaults wraps next, injecting faults into its responses according to cfg.
+func injectFaults(next http.Handler, cfg FaultConfig) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		logger := requestLogger(req).Named("faults").With(zap.String("uri", req.RequestURI))
+
+		if roll(cfg.Delay) {
+			logger.Info("delaying response", zap.Duration("delay", cfg.DelayDuration))
+			select {
+			case <-time.After(cfg.DelayDuration):
+			case <-req.Context().Done():
+				return
+			}
+		}
+
+		if roll(cfg.Reset) {
+			logger.Info("resetting connection")
+			resetConnection(res)
+			return
+		}
+
+		if roll(cfg.Error) {
+			code := errorStatusCodes[rand.IntN(len(errorStatusCodes))]
+			logger.Info("responding with an error", zap.Int("statusCode", code))
+			res.WriteHeader(code)
+			return
+		}
+
+		w := &faultyWriter{ResponseWriter: res}
+		if roll(cfg.Corrupt) {
+			w.corrupt = max(cfg.CorruptBytes, 1)
+			logger.Info("corrupting response body", zap.Int("bytes", w.corrupt))
+		}
+		if roll(cfg.Truncate) {
+			w.truncate = true
+			logger.Info("truncating response body")
+		}
+		if roll(cfg.ContentType) {
+			w.contentType = true
+			logger.Info("sending the wrong content-type")
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// resetConnection closes the underlying connection with an RST if possible (i.e., HTTP/1.x over TCP), and
+// otherwise aborts the handler, which resets the HTTP/2 stream.
+func resetConnection(res http.ResponseWriter) {
+	if conn, _, err := http.NewResponseController(res).Hijack(); err == nil {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			_ = tcp.SetLinger(0)
+		}
+		_ = conn.Close()
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// faultyWriter is an http.ResponseWriter that corrupts, truncates, or mislabels the response.
+type faultyWriter struct {
+	http.ResponseWriter
+	corrupt     int
+	truncate    bool
+	contentType bool
+
+	wroteHeader bool
+	limit       int64
+	written     int64
+}
+
+func (w *faultyWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	headers := w.Header()
+	if w.contentType {
+		if headers.Get(contentType) == "text/html" {
+			headers.Set(contentType, "application/xml")
+		} else {
+			headers.Set(contentType, "text/html")
+		}
+	}
+	w.limit = -1
+	if w.truncate {
+		if n, err := strconv.ParseInt(headers.Get(contentLength), 10, 64); err == nil {
+			w.limit = n / 2
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *faultyWriter) Write(p []byte) (int, error) {
+
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// Responses of unknown length are truncated to half of the first write
+	n := len(p)
+	if w.truncate && w.limit < 0 {
+		w.limit = int64(n / 2)
+	}
+	if w.limit >= 0 {
+		if remaining := w.limit - w.written; remaining <= 0 {
+			return n, nil
+		} else if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+
+	if w.corrupt > 0 && len(p) > 0 {
+		p = append([]byte(nil), p...)
+		for ; w.corrupt > 0; w.corrupt-- {
+			p[rand.IntN(len(p))] ^= 0xFF
+		}
+	}
+
+	m, err := w.ResponseWriter.Write(p)
+	w.written += int64(m)
+	if err != nil {
+		return m, err
+	}
+	return n, nil
+}
+
+// Hijack allows connections to be upgraded (e.g., to a WebSocket), in which case no faults are injected.
+func (w *faultyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *faultyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var _ = Describe("Faults", func() {
+
+	newClient := func(cfg FaultConfig) Client {
+		return NewClient(newTestServer(WithFaults(cfg)).URL, &http.Client{Transport: &http.Transport{DisableKeepAlives: true}})
+	}
+
+	It("rejects invalid probabilities", func() {
+		Expect(FaultConfig{Reset: 1.5}.Validate()).To(MatchError(InvalidFaultProbabilityErr))
+		Expect(FaultConfig{Error: -0.1}.Validate()).To(MatchError(InvalidFaultProbabilityErr))
+		Expect(FaultConfig{Corrupt: 1, Truncate: 0.5}.Validate()).To(Succeed())
+	})
+
+	It("injects nothing with zero probabilities", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := newClient(FaultConfig{CorruptBytes: 1, DelayDuration: time.Second})
+		Expect(client.Check(ctx)).To(BeSuccessful())
+		Expect(client.ReplayN(ctx, source.New(4096), 4096)).To(BeSuccessful())
+	})
+
+	It("corrupts response bodies", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := newClient(FaultConfig{Corrupt: 1, CorruptBytes: 8})
+		result, err := client.ReplayN(ctx, source.New(4096), 4096)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Failure).To(Equal(DigestFailure))
+		Expect(result.BytesReceived).To(Equal(int64(4096)))
+		result, _ = client.ReplayChunked(ctx, source.New(4096), 1024, 4)
+		Expect(result.Failure).To(Equal(DigestFailure))
+	})
+
+	It("truncates response bodies", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := newClient(FaultConfig{Truncate: 1})
+		result, _ := client.ReplayN(ctx, source.New(4096), 4096)
+		Expect(result.OK).To(BeFalse())
+		Expect(result.Failure).To(Equal(LengthFailure))
+		Expect(result.BytesReceived).To(Equal(int64(2048)))
+		Expect(result.Denied()).To(BeFalse())
+		result, _ = client.ReplayChunked(ctx, source.New(4096), 1024, 4)
+		Expect(result.Failure).To(Equal(LengthFailure))
+		Expect(result.Denied()).To(BeFalse())
+	})
+
+	It("sends the wrong content-type", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := newClient(FaultConfig{ContentType: 1})
+		result, _ := client.ReplayN(ctx, source.New(4096), 4096)
+		Expect(result.Failure).To(Equal(HeaderFailure))
+	})
+
+	It("delays response headers", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := newClient(FaultConfig{Delay: 1, DelayDuration: 200 * time.Millisecond})
+		result, err := client.Check(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeSuccessful())
+		Expect(result.Timings.TTFB).To(BeNumerically(">=", 200*time.Millisecond))
+	})
+
+	It("resets connections", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		result, err := newClient(FaultConfig{Reset: 1}).Check(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(result.Failure).To(Equal(ResetFailure))
+		Expect(result.Denied()).To(BeFalse())
+	})
+
+	It("responds with 5xx status codes", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		result, err := newClient(FaultConfig{Error: 1}).Check(ctx)
+		Expect(err).To(MatchError(HttpStatusCodeErr))
+		Expect(result.Failure).To(Equal(StatusFailure))
+		Expect(result.StatusCode).To(BeNumerically(">=", 500))
+	})
+})
@@ -0,0 +1,351 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var InvalidHeaderChangeErr = errors.New("header changes must be one of unchanged, modified, removed, added, or absent")
+var HeaderChangedErr = errors.New("a header did not arrive at the server as expected")
+
+// RequestEcho is the request metadata returned by the handler's headers endpoint, as received by the server.
+type RequestEcho struct {
+	Method           string      `json:"method"`
+	URI              string      `json:"uri"`
+	Proto            string      `json:"proto"`
+	Host             string      `json:"host"`
+	RemoteAddr       string      `json:"remoteAddr"`
+	ContentLength    int64       `json:"contentLength"`
+	TransferEncoding []string    `json:"transferEncoding,omitempty"`
+	Header           http.Header `json:"header"`
+	Trailer          http.Header `json:"trailer,omitempty"`
+	BodyBytes        int64       `json:"bodyBytes"`
+	TLSVersion       string      `json:"tlsVersion,omitempty"`
+	ServerName       string      `json:"serverName,omitempty"`
+}
+
+// echoHeaders returns the metadata of requests of any method as JSON. The body, if any, is read and counted.
+func echoHeaders(res http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req).With(zap.String("handler", "headers"))
+	logRequest(logger, req)
+
+	counter := &byteCounter{}
+	if _, err := io.Copy(counter, req.Body); err != nil {
+		logger.Error("error reading request body", zap.Error(err))
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	echo := RequestEcho{
+		Method:           req.Method,
+		URI:              req.RequestURI,
+		Proto:            req.Proto,
+		Host:             req.Host,
+		RemoteAddr:       req.RemoteAddr,
+		ContentLength:    req.ContentLength,
+		TransferEncoding: req.TransferEncoding,
+		Header:           req.Header,
+		Trailer:          req.Trailer,
+		BodyBytes:        counter.n.Load(),
+	}
+	if req.TLS != nil {
+		echo.TLSVersion = tls.VersionName(req.TLS.Version)
+		echo.ServerName = req.TLS.ServerName
+	}
+
+	identifyClient(logger, res, req)
+	res.Header().Set(contentType, "application/json")
+	res.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(res).Encode(echo); err != nil {
+		logger.Error("error handling request", zap.Error(err))
+	}
+}
+
+// HeaderChange describes how a request header arrived at the server.
+type HeaderChange string
+
+const (
+	// HeaderUnchanged is a header sent by the client that arrived with the same values.
+	HeaderUnchanged HeaderChange = "unchanged"
+
+	// HeaderModified is a header sent by the client that arrived with different values.
+	HeaderModified HeaderChange = "modified"
+
+	// HeaderRemoved is a header sent by the client that did not arrive.
+	HeaderRemoved HeaderChange = "removed"
+
+	// HeaderAdded is a header not sent by the client that arrived (e.g., X-Forwarded-For added by a proxy).
+	HeaderAdded HeaderChange = "added"
+
+	// HeaderAbsent is a header neither sent by the client nor arrived.
+	HeaderAbsent HeaderChange = "absent"
+)
+
+// ParseHeaderChange returns the HeaderChange named by s.
+func ParseHeaderChange(s string) (HeaderChange, error) {
+	switch c := HeaderChange(s); c {
+	case HeaderUnchanged, HeaderModified, HeaderRemoved, HeaderAdded, HeaderAbsent:
+		return c, nil
+	default:
+		return c, InvalidHeaderChangeErr
+	}
+}
+
+// HeaderDiff reports how a request header arrived at the server, and how it was expected to.
+type HeaderDiff struct {
+	Name     string
+	Change   HeaderChange
+	Expected HeaderChange
+	Sent     []string
+	Received []string
+}
+
+// OK is true if the header arrived as expected.
+func (d HeaderDiff) OK() bool {
+	return d.Change == d.Expected
+}
+
+// maxLoggedHeaderValues is the total length of a header's values above which only their size is logged.
+const maxLoggedHeaderValues = 256
+
+func (d HeaderDiff) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("name", d.Name)
+	enc.AddString("change", string(d.Change))
+	enc.AddString("expected", string(d.Expected))
+	for _, v := range []struct {
+		key    string
+		values []string
+	}{{"sent", d.Sent}, {"received", d.Received}} {
+		if n := valuesLength(v.values); n > maxLoggedHeaderValues {
+			enc.AddInt(v.key+"Bytes", n)
+		} else if len(v.values) > 0 {
+			_ = enc.AddArray(v.key, zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+				for _, value := range v.values {
+					arr.AppendString(value)
+				}
+				return nil
+			}))
+		}
+	}
+	return nil
+}
+
+func valuesLength(values []string) (n int) {
+	for _, v := range values {
+		n += len(v)
+	}
+	return
+}
+
+// HeaderSpec describes the headers sent by Client.Headers, and how each is expected to arrive at the server.
+type HeaderSpec struct {
+
+	// Header is sent with the request. A Host header overrides the request's host.
+	Header http.Header
+
+	// Expect is how headers, by name, are expected to arrive. Headers that are sent, and the Host, are
+	// expected to arrive unchanged unless specified. Other headers that arrive (e.g., added by a proxy) are
+	// reported but not asserted unless specified.
+	Expect map[string]HeaderChange
+}
+
+// LargeHeaderValue returns a header value of size bytes for testing the header size limits of proxies.
+func LargeHeaderValue(size int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	var b strings.Builder
+	b.Grow(size)
+	for i := 0; i < size; i++ {
+		b.WriteByte(alphabet[i%len(alphabet)])
+	}
+	return b.String()
+}
+
+// unreportedHeaders are set by the client or its transport rather than by a HeaderSpec, and are not reported
+// as added unless expected.
+var unreportedHeaders = []string{
+	"Accept-Encoding",
+	"Authorization",
+	"Content-Length",
+	"User-Agent",
+	NonceHeader,
+	RequestIDHeader,
+	RunIDHeader,
+	SpecHeader,
+	TimestampHeader,
+}
+
+// Headers sends the headers described by spec to the server's headers endpoint and reports how each arrived,
+// sorted by name, as Result.Headers. The request fails with HeaderChangedErr if any did not arrive as expected.
+func (c *client) Headers(ctx context.Context, spec HeaderSpec) (result Result, err error) {
+
+	ctx = c.correlate(ctx, &result)
+	logger := c.logger(ctx)
+	logger.Info("starting headers")
+
+	ctx, trace := newTracer(ctx)
+	defer func() {
+		result.Timings = trace.done(logger)
+	}()
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/headers", c.server), nil); err != nil {
+		logger.Error("an error occurred generating the headers request", zap.Error(err))
+		return result, result.fail(RequestFailure, err)
+	}
+	sent := make(http.Header, len(spec.Header))
+	for k, v := range spec.Header {
+		sent[http.CanonicalHeaderKey(k)] = v
+	}
+	if host := sent.Get("Host"); host != "" {
+		req.Host = host
+	}
+	sent.Del("Host")
+	for k, v := range sent {
+		req.Header[k] = v
+	}
+
+	var res *http.Response
+	if res, err = c.http.Do(req); err != nil {
+		logger.Error("an error occurred during headers request", zap.Error(err))
+		return result, result.fail(classifyError(err), err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	result.StatusCode = res.StatusCode
+
+	// A proxy (or the server) rejecting large headers typically responds with 400 or 431
+	if res.StatusCode != http.StatusOK {
+		logger.Error("headers request failed with an non-200 HTTP status code", zap.Int("statusCode", res.StatusCode), zap.Int("headerBytes", headerLength(sent)))
+		return result, result.fail(StatusFailure, HttpStatusCodeErr)
+	}
+
+	if err = c.verifyProtocol(logger, res, &result); err != nil {
+		return
+	}
+
+	if err = c.verifyIdentity(logger, res, &result); err != nil {
+		return
+	}
+
+	echo := RequestEcho{}
+	counter := &byteCounter{}
+	if e := json.NewDecoder(io.TeeReader(res.Body, counter)).Decode(&echo); e != nil {
+		result.BytesReceived = counter.n.Load()
+		logger.Error("an error occurred while decoding the headers response", zap.Error(e))
+		return result, result.fail(BodyFailure, nil)
+	}
+	result.BytesReceived = counter.n.Load()
+
+	sent.Set("Host", req.Host)
+	received := echo.Header.Clone()
+	if received == nil {
+		received = make(http.Header)
+	}
+	received.Set("Host", echo.Host)
+	result.Headers = diffHeaders(sent, received, spec.Expect)
+
+	var unexpected []string
+	for _, d := range result.Headers {
+		if d.OK() {
+			logger.Debug("header arrived as expected", zap.Object("header", d))
+		} else {
+			logger.Error("header did not arrive as expected", zap.Object("header", d))
+			unexpected = append(unexpected, d.Name)
+		}
+	}
+	if len(unexpected) > 0 {
+		return result, result.fail(HeaderFailure, fmt.Errorf("%w: %s", HeaderChangedErr, strings.Join(unexpected, ", ")))
+	}
+
+	logger.Info("headers arrived as expected")
+	result.OK = true
+	return
+}
+
+// diffHeaders compares the sent and received headers, which must have canonical keys.
+func diffHeaders(sent, received http.Header, expect map[string]HeaderChange) (diffs []HeaderDiff) {
+	expected := make(map[string]HeaderChange, len(expect))
+	for k, v := range expect {
+		expected[http.CanonicalHeaderKey(k)] = v
+	}
+
+	names := make(map[string]struct{})
+	for k := range sent {
+		names[k] = struct{}{}
+	}
+	for k := range received {
+		if _, ok := expected[k]; ok || !slices.Contains(unreportedHeaders, k) {
+			names[k] = struct{}{}
+		}
+	}
+	for k := range expected {
+		names[k] = struct{}{}
+	}
+
+	for name := range names {
+		d := HeaderDiff{Name: name, Sent: sent[name], Received: received[name]}
+		switch {
+		case len(d.Sent) == 0 && len(d.Received) == 0:
+			d.Change = HeaderAbsent
+		case len(d.Sent) == 0:
+			d.Change = HeaderAdded
+		case len(d.Received) == 0:
+			d.Change = HeaderRemoved
+		case slices.Equal(d.Sent, d.Received):
+			d.Change = HeaderUnchanged
+		default:
+			d.Change = HeaderModified
+		}
+		var ok bool
+		if d.Expected, ok = expected[name]; !ok {
+			if len(d.Sent) > 0 {
+				d.Expected = HeaderUnchanged
+			} else {
+				d.Expected = d.Change
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	slices.SortFunc(diffs, func(a, b HeaderDiff) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return
+}
+
+// headerLength approximates the size of header on the wire, as formatted by HTTP/1.1.
+func headerLength(header http.Header) (n int) {
+	for k, values := range header {
+		for _, v := range values {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+var _ = Describe("Headers", func() {
+
+	// change matches a HeaderDiff by its name, change, and expected change
+	change := func(name string, change, expected HeaderChange) any {
+		return MatchFields(IgnoreExtras, Fields{
+			"Name":     Equal(name),
+			"Change":   Equal(change),
+			"Expected": Equal(expected),
+		})
+	}
+
+	It("echoes the request metadata", func() {
+		srv := httptest.NewServer(NewHandler())
+		DeferCleanup(srv.Close)
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/headers?q=1", strings.NewReader("hello"))
+		Expect(err).NotTo(HaveOccurred())
+		req.Host = "example.com"
+		req.Header.Add("X-Multi", "a")
+		req.Header.Add("X-Multi", "b")
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		var echo RequestEcho
+		Expect(json.NewDecoder(res.Body).Decode(&echo)).To(Succeed())
+		Expect(echo.Method).To(Equal(http.MethodPost))
+		Expect(echo.URI).To(Equal("/headers?q=1"))
+		Expect(echo.Host).To(Equal("example.com"))
+		Expect(echo.ContentLength).To(Equal(int64(5)))
+		Expect(echo.BodyBytes).To(Equal(int64(5)))
+		Expect(echo.Header.Values("X-Multi")).To(Equal([]string{"a", "b"}))
+		Expect(res.Header.Get(ClientAddrHeader)).To(Equal(echo.RemoteAddr))
+	})
+
+	It("reports headers that arrive unchanged", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewHandler())
+		DeferCleanup(srv.Close)
+
+		spec := HeaderSpec{Header: http.Header{"x-custom": {"value"}, "X-Large": {LargeHeaderValue(8 * 1024)}}}
+		result, err := NewClient(srv.URL, &http.Client{}).Headers(ctx, spec)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.OK).To(BeTrue())
+		Expect(result.Headers).To(ConsistOf(
+			change("Host", HeaderUnchanged, HeaderUnchanged),
+			change("X-Custom", HeaderUnchanged, HeaderUnchanged),
+			change("X-Large", HeaderUnchanged, HeaderUnchanged),
+		))
+	})
+
+	Context("through a proxy that rewrites headers", func() {
+
+		var srv *httptest.Server
+		BeforeEach(func() {
+			handler := NewHandler()
+			srv = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				req.Header.Del("Connection")
+				req.Header.Set("X-Modified", "rewritten")
+				req.Header.Add("X-Forwarded-For", "203.0.113.7")
+				req.Host = "backend.internal"
+				handler.ServeHTTP(res, req)
+			}))
+			DeferCleanup(srv.Close)
+		})
+
+		spec := func() HeaderSpec {
+			return HeaderSpec{Header: http.Header{
+				"Connection": {"keep-alive"},
+				"X-Modified": {"original"},
+				"X-Kept":     {"kept"},
+			}}
+		}
+
+		It("reports each change", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			result, err := NewClient(srv.URL, &http.Client{}).Headers(ctx, spec())
+			Expect(err).To(MatchError(HeaderChangedErr))
+			Expect(err.Error()).To(ContainSubstring("Connection, Host, X-Modified"))
+			Expect(result.Failure).To(Equal(HeaderFailure))
+			Expect(result.Headers).To(ConsistOf(
+				change("Connection", HeaderRemoved, HeaderUnchanged),
+				change("Host", HeaderModified, HeaderUnchanged),
+				change("X-Forwarded-For", HeaderAdded, HeaderAdded),
+				change("X-Kept", HeaderUnchanged, HeaderUnchanged),
+				change("X-Modified", HeaderModified, HeaderUnchanged),
+			))
+		})
+
+		It("succeeds if the changes are expected", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			s := spec()
+			s.Expect = map[string]HeaderChange{
+				"connection":      HeaderRemoved,
+				"Host":            HeaderModified,
+				"X-Modified":      HeaderModified,
+				"X-Real-Ip":       HeaderAbsent,
+				"X-Forwarded-For": HeaderAdded,
+			}
+			result, err := NewClient(srv.URL, &http.Client{}).Headers(ctx, s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Headers).To(ContainElement(change("X-Real-Ip", HeaderAbsent, HeaderAbsent)))
+
+			s.Expect["X-Real-Ip"] = HeaderAdded
+			_, err = NewClient(srv.URL, &http.Client{}).Headers(ctx, s)
+			Expect(err).To(MatchError(HeaderChangedErr))
+		})
+	})
+
+	It("fails if headers are too large", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewUnstartedServer(NewHandler())
+		srv.Config.MaxHeaderBytes = 1024
+		srv.Start()
+		DeferCleanup(srv.Close)
+
+		result, err := NewClient(srv.URL, &http.Client{}).Headers(ctx, HeaderSpec{Header: http.Header{"X-Large": {LargeHeaderValue(64 * 1024)}}})
+		Expect(err).To(MatchError(HttpStatusCodeErr))
+		Expect(result.StatusCode).To(Equal(http.StatusRequestHeaderFieldsTooLarge))
+	})
+
+	It("parses header changes", func() {
+		Expect(ParseHeaderChange("added")).To(Equal(HeaderAdded))
+		_, err := ParseHeaderChange("stripped")
+		Expect(err).To(MatchError(InvalidHeaderChangeErr))
+	})
+})
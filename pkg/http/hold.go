@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var StreamClosedErr = errors.New("the stream was closed before the target duration")
+var StreamStalledErr = errors.New("no event was received on the stream within the expected interval")
+
+// MaxHoldDuration is the maximum duration a hold request may ask the server to hold the stream open.
+var MaxHoldDuration = 24 * time.Hour
+
+const (
+	eventOpen      = "open"
+	eventHeartbeat = "heartbeat"
+	eventDone      = "done"
+)
+
+// holdGrace is how late an expected event may be before the stream is considered stalled.
+var holdGrace = 5 * time.Second
+
+// HoldSpec describes a Server-Sent Events stream held open by Client.Hold.
+type HoldSpec struct {
+
+	// Duration is how long the stream must survive.
+	Duration time.Duration
+
+	// Interval is how often the server sends a heartbeat. If zero, the server is silent between opening and
+	// closing the stream, as an idle long-poll is.
+	Interval time.Duration
+}
+
+// hold holds an SSE stream open for the requested duration, sending an open event immediately, a heartbeat
+// at the requested interval (if any), and a done event before cleanly ending the response.
+func hold(res http.ResponseWriter, req *http.Request) {
+
+	logger := requestLogger(req).With(zap.String("handler", "hold"))
+	logRequest(logger, req)
+
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	duration, err := time.ParseDuration(query.Get("duration"))
+	if err != nil || duration <= 0 || duration > MaxHoldDuration {
+		logger.Info("invalid hold duration", zap.String("duration", query.Get("duration")))
+		http.Error(res, fmt.Sprintf("duration must be a positive duration up to %s", MaxHoldDuration), http.StatusBadRequest)
+		return
+	}
+	var interval time.Duration
+	if s := query.Get("interval"); s != "" {
+		if interval, err = time.ParseDuration(s); err != nil || interval < 0 {
+			logger.Info("invalid hold interval", zap.String("interval", s))
+			http.Error(res, "interval must be a non-negative duration", http.StatusBadRequest)
+			return
+		}
+	}
+	logger = logger.With(zap.Duration("duration", duration), zap.Duration("interval", interval))
+
+	ctrl := http.NewResponseController(res)
+	identifyClient(logger, res, req)
+	headers := res.Header()
+	headers.Set(contentType, "text/event-stream")
+	headers.Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+
+	start := time.Now()
+	seq := 0
+	send := func(event string) bool {
+		seq++
+		if _, err := fmt.Fprintf(res, "event: %s\ndata: %d\n\n", event, seq); err != nil {
+			logger.Error("error sending event", zap.Error(err), zap.Duration("elapsed", time.Since(start)))
+			return false
+		} else if err = ctrl.Flush(); err != nil {
+			logger.Error("error flushing event", zap.Error(err), zap.Duration("elapsed", time.Since(start)))
+			return false
+		}
+		return true
+	}
+	if !send(eventOpen) {
+		return
+	}
+
+	done := time.NewTimer(duration)
+	defer done.Stop()
+	var heartbeat <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-req.Context().Done():
+			logger.Info("stream closed by the client", zap.Duration("elapsed", time.Since(start)))
+			return
+		case <-heartbeat:
+			if !send(eventHeartbeat) {
+				return
+			}
+		case <-done.C:
+			if send(eventDone) {
+				logger.Info("stream held successfully", zap.Int("events", seq))
+			}
+			return
+		}
+	}
+}
+
+// Hold asks the server to hold a Server-Sent Events stream open as described by spec, and verifies it
+// survives for spec.Duration. The time the stream lasted is returned as Result.Lasted. A stream closed
+// cleanly before the server finished fails with StreamClosedErr (ClosedFailure), and one that is reset fails
+// with ResetFailure. If an expected event is late, as when a connection is silently dropped, the stream fails
+// with StreamStalledErr (TimeoutFailure).
+func (c *client) Hold(ctx context.Context, spec HoldSpec) (result Result, err error) {
+
+	ctx = c.correlate(ctx, &result)
+	logger := c.logger(ctx).With(zap.Duration("duration", spec.Duration), zap.Duration("interval", spec.Interval))
+	logger.Info("starting hold")
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	ctx, trace := newTracer(ctx)
+	defer func() {
+		result.Timings = trace.done(logger)
+	}()
+
+	query := url.Values{"duration": []string{spec.Duration.String()}, "interval": []string{spec.Interval.String()}}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/hold?%s", c.server, query.Encode()), nil); err != nil {
+		logger.Error("an error occurred generating the hold request", zap.Error(err))
+		return result, result.fail(RequestFailure, err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The stream stalls if the next event is not received in time
+	expect := func(next time.Duration) time.Duration {
+		return next + max(spec.Interval, holdGrace)
+	}
+	stall := time.AfterFunc(expect(spec.Duration), func() {
+		cancel(StreamStalledErr)
+	})
+	defer stall.Stop()
+
+	var res *http.Response
+	if res, err = c.http.Do(req); err != nil {
+		err = holdError(ctx, err)
+		logger.Error("an error occurred during hold request", zap.Error(err))
+		return result, result.fail(classifyError(err), err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	result.StatusCode = res.StatusCode
+	opened := time.Now()
+
+	if res.StatusCode != http.StatusOK {
+		logger.Error("hold failed with an non-200 HTTP status code", zap.Int("statusCode", res.StatusCode))
+		return result, result.fail(StatusFailure, HttpStatusCodeErr)
+	} else if err = c.verifyProtocol(logger, res, &result); err != nil {
+		return
+	} else if err = c.verifyIdentity(logger, res, &result); err != nil {
+		return
+	} else if ct := res.Header.Get(contentType); !strings.HasPrefix(ct, "text/event-stream") {
+		logger.Error("hold response was not an event stream", zap.String("contentType", ct))
+		return result, result.fail(HeaderFailure, nil)
+	}
+
+	// Read events until the server sends done or the stream ends
+	counter := &byteCounter{}
+	scanner := bufio.NewScanner(io.TeeReader(res.Body, counter))
+	var event string
+	events := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event:"); ok {
+			event = strings.TrimSpace(name)
+			continue
+		} else if line != "" {
+			continue
+		}
+
+		// A blank line dispatches the event
+		events++
+		result.Lasted = time.Since(opened)
+		logger.Debug("received event", zap.String("event", event), zap.Duration("lasted", result.Lasted))
+		if event == eventDone {
+			break
+		}
+		if spec.Interval > 0 {
+			stall.Reset(expect(spec.Interval))
+		} else {
+			stall.Reset(expect(spec.Duration - result.Lasted))
+		}
+		event = ""
+	}
+	result.Lasted = time.Since(opened)
+	result.BytesReceived = counter.n.Load()
+	logger = logger.With(zap.Duration("lasted", result.Lasted), zap.Int("events", events))
+
+	if err = scanner.Err(); err != nil {
+		err = holdError(ctx, err)
+		logger.Error("the stream was interrupted", zap.Error(err))
+		return result, result.fail(classifyError(err), err)
+	} else if event != eventDone {
+		logger.Error("the stream was closed before the target duration")
+		return result, result.fail(ClosedFailure, StreamClosedErr)
+	} else if result.Lasted < spec.Duration {
+		logger.Error("the stream ended before the target duration")
+		return result, result.fail(ClosedFailure, StreamClosedErr)
+	}
+
+	logger.Info("hold successful")
+	result.OK = true
+	return
+}
+
+// holdError returns StreamStalledErr if the request was canceled because the stream stalled.
+func holdError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, StreamStalledErr) {
+		return errors.Join(StreamStalledErr, context.DeadlineExceeded)
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+var _ = Describe("Hold", func() {
+
+	It("holds a stream with heartbeats", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewHandler())
+		DeferCleanup(srv.Close)
+
+		result, err := NewClient(srv.URL, http.DefaultClient).Hold(ctx, HoldSpec{Duration: 500 * time.Millisecond, Interval: 100 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeSuccessful())
+		Expect(result.Lasted).To(BeNumerically(">=", 500*time.Millisecond))
+		Expect(result.BytesReceived).To(BeNumerically(">", 0))
+	})
+
+	It("holds a silent stream", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewH2CHandler(NewHandler()))
+		DeferCleanup(srv.Close)
+
+		result, err := NewClient(srv.URL, http.DefaultClient).Hold(ctx, HoldSpec{Duration: 300 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeSuccessful())
+		Expect(result.Lasted).To(BeNumerically(">=", 300*time.Millisecond))
+	})
+
+	It("rejects invalid durations", func() {
+		srv := httptest.NewServer(NewHandler())
+		DeferCleanup(srv.Close)
+
+		for _, q := range []string{"", "duration=0s", "duration=25h", "duration=1s&interval=-1s", "duration=1s&interval=x"} {
+			res, err := http.Get(srv.URL + "/hold?" + q)
+			Expect(err).NotTo(HaveOccurred())
+			_ = res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest), q)
+		}
+	})
+
+	Context("when the stream is cut", func() {
+
+		// cut opens an event stream, then calls fn
+		cut := func(fn func(res http.ResponseWriter)) *httptest.Server {
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.Header().Set(contentType, "text/event-stream")
+				res.WriteHeader(http.StatusOK)
+				_, _ = fmt.Fprintf(res, "event: %s\ndata: 1\n\n", eventOpen)
+				_ = http.NewResponseController(res).Flush()
+				fn(res)
+			}))
+			DeferCleanup(srv.Close)
+			return srv
+		}
+
+		It("reports a clean close", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			srv := cut(func(http.ResponseWriter) {})
+
+			result, err := NewClient(srv.URL, http.DefaultClient).Hold(ctx, HoldSpec{Duration: time.Second})
+			Expect(err).To(MatchError(StreamClosedErr))
+			Expect(result.Failure).To(Equal(ClosedFailure))
+			Expect(result.Lasted).To(BeNumerically("<", time.Second))
+		})
+
+		It("reports a reset", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			srv := cut(resetConnection)
+
+			result, err := NewClient(srv.URL, http.DefaultClient).Hold(ctx, HoldSpec{Duration: time.Second})
+			Expect(err).To(HaveOccurred())
+			Expect(result.Failure).To(Equal(ResetFailure))
+		})
+
+		It("reports a stall", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			grace := holdGrace
+			holdGrace = 100 * time.Millisecond
+			DeferCleanup(func() {
+				holdGrace = grace
+			})
+			srv := cut(func(http.ResponseWriter) {
+				time.Sleep(time.Second)
+			})
+
+			result, err := NewClient(srv.URL, http.DefaultClient).Hold(ctx, HoldSpec{Duration: time.Second, Interval: 50 * time.Millisecond})
+			Expect(err).To(MatchError(StreamStalledErr))
+			Expect(result.Failure).To(Equal(TimeoutFailure))
+			Expect(result.Lasted).To(BeNumerically("<", time.Second))
+		})
+	})
+})
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// Environment variables from which the server's identity is read. In Kubernetes they are expected to be set
+// using the downward API.
+const (
+	PodNameEnv      = "POD_NAME"
+	PodNamespaceEnv = "POD_NAMESPACE"
+	NodeNameEnv     = "NODE_NAME"
+)
+
+// BackendIdentity identifies the server instance that handled a request.
+type BackendIdentity struct {
+	Pod       string `json:"pod"`
+	Namespace string `json:"namespace,omitempty"`
+	Node      string `json:"node,omitempty"`
+
+	// StartupID is generated when the server starts, distinguishing restarted instances with the same name.
+	StartupID string `json:"startupId"`
+}
+
+// String returns the pod and startup ID, which together uniquely identify a backend.
+func (id BackendIdentity) String() string {
+	return id.Pod + "/" + id.StartupID
+}
+
+// Identity is the identity returned by the handler's identity endpoint.
+var Identity = NewBackendIdentity()
+
+// NewBackendIdentity reads the identity from the environment with a new StartupID. If PodNameEnv is not set,
+// the hostname is used.
+func NewBackendIdentity() BackendIdentity {
+	id := BackendIdentity{
+		Pod:       os.Getenv(PodNameEnv),
+		Namespace: os.Getenv(PodNamespaceEnv),
+		Node:      os.Getenv(NodeNameEnv),
+	}
+	if id.Pod == "" {
+		if host, err := os.Hostname(); err == nil {
+			id.Pod = host
+		} else {
+			id.Pod = "unknown"
+		}
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	id.StartupID = hex.EncodeToString(b)
+	return id
+}
+
+func identity(res http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req).With(zap.String("handler", "identity"))
+	logRequest(logger, req)
+
+	// Only support GET requests
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	identifyClient(logger, res, req)
+	res.Header().Set(contentType, "application/json")
+	res.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(res).Encode(Identity); err != nil {
+		logger.Error("error handling request", zap.Error(err))
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var InvalidReplayLimitsErr = errors.New("replay limits must not be negative")
+var ServerBusyErr = errors.New("the server was too busy to handle the request")
+
+// ReplayLimits limit the replays handled at once so that, together, they cannot exhaust the server's memory.
+// Buffered replays count their Content-Length (or MaxReplayRequestSize if chunked or encoded) against
+// MaxBytes; streamed replays count only their buffer.
+type ReplayLimits struct {
+
+	// MaxBytes is the total size of the replays that may be in flight at once. Zero is unlimited.
+	MaxBytes int64
+
+	// MaxConcurrent is the number of replays that may be in flight at once. Zero is unlimited.
+	MaxConcurrent int
+
+	// QueueTimeout is how long a replay waits for capacity before it is rejected with 503 Service Unavailable.
+	// If zero, replays are rejected immediately.
+	QueueTimeout time.Duration
+
+	// RetryAfter is sent in the Retry-After header of rejected replays, rounded up to whole seconds.
+	RetryAfter time.Duration
+}
+
+// Validate returns InvalidReplayLimitsErr if any limit is negative.
+func (l ReplayLimits) Validate() error {
+	if l.MaxBytes < 0 || l.MaxConcurrent < 0 || l.QueueTimeout < 0 || l.RetryAfter < 0 {
+		return InvalidReplayLimitsErr
+	}
+	return nil
+}
+
+// Enabled is true if replays are limited.
+func (l ReplayLimits) Enabled() bool {
+	return l.MaxBytes > 0 || l.MaxConcurrent > 0
+}
+
+// WithReplayLimits limits the replays the handler handles at once.
+func WithReplayLimits(l ReplayLimits) HandlerOption {
+	return replayLimitsOption(l)
+}
+
+type replayLimitsOption ReplayLimits
+
+func (o replayLimitsOption) apply(h *handlerConfig) {
+	h.replayLimits = ReplayLimits(o)
+}
+
+// Reasons a replay was rejected, which are also the values of the replay_rejections_total reason label.
+const (
+	limitBytes       = "bytes"
+	limitConcurrency = "concurrency"
+)
+
+// replayLimiter is a weighted semaphore limiting the bytes and number of replays in flight. Waiting replays
+// are not queued in order; each retries whenever capacity is released.
+type replayLimiter struct {
+	limits ReplayLimits
+
+	mu       sync.Mutex
+	bytes    int64
+	count    int
+	released chan struct{}
+}
+
+func newReplayLimiter(limits ReplayLimits) *replayLimiter {
+	return &replayLimiter{limits: limits, released: make(chan struct{})}
+}
+
+// tryAcquire reserves n bytes and one replay if both are available, and otherwise returns the limit that
+// was exhausted and a channel closed when capacity is next released.
+func (l *replayLimiter) tryAcquire(n int64) (string, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if m := l.limits.MaxConcurrent; m > 0 && l.count >= m {
+		return limitConcurrency, l.released
+	} else if m := l.limits.MaxBytes; m > 0 && l.bytes+n > m {
+		return limitBytes, l.released
+	}
+	l.bytes += n
+	l.count++
+	return "", nil
+}
+
+// acquire reserves n bytes and one replay, waiting until they are available or ctx is done. If ctx is done
+// first, the limit that was exhausted is returned.
+func (l *replayLimiter) acquire(ctx context.Context, n int64) string {
+	for {
+		exhausted, released := l.tryAcquire(n)
+		if exhausted == "" {
+			return ""
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return exhausted
+		}
+	}
+}
+
+// release returns n bytes and one replay, waking any waiting replays.
+func (l *replayLimiter) release(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytes -= n
+	l.count--
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// limitReplays wraps next, which handles replays, so that they are limited as described by limits. If stream
+// is true, next streams replays rather than buffering them.
+func limitReplays(next http.Handler, limits ReplayLimits, stream bool) http.Handler {
+
+	limiter := newReplayLimiter(limits)
+	retryAfter := strconv.Itoa(max(1, int(math.Ceil(limits.RetryAfter.Seconds()))))
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		// Requests that will be rejected anyway are not limited
+		if req.Method != http.MethodPost || (!stream && req.ContentLength > MaxReplayRequestSize) {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		// Determine how much memory the replay may use; a replay larger than the budget is handled alone. The
+		// decoded length of an encoded replay is unknown.
+		n := int64(replayBufferSize)
+		if !stream && req.ContentLength >= 0 && req.Header.Get(contentEncoding) == "" {
+			n = req.ContentLength
+		} else if !stream {
+			n = MaxReplayRequestSize
+		}
+		if limits.MaxBytes > 0 {
+			n = min(n, limits.MaxBytes)
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), limits.QueueTimeout)
+		defer cancel()
+		start := time.Now()
+		if exhausted := limiter.acquire(ctx, n); exhausted != "" {
+			requestLogger(req).Warn("replay rejected because the server is busy",
+				zap.String("limit", exhausted),
+				zap.Int64("bytes", n),
+				zap.Duration("waited", time.Since(start)))
+			serverReplayRejections.WithLabelValues(exhausted).Inc()
+			res.Header().Set("Retry-After", retryAfter)
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer limiter.release(n)
+		next.ServeHTTP(res, req)
+	})
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var _ = Describe("ReplayLimits", func() {
+
+	var srv *httptest.Server
+	serve := func(limits ReplayLimits) Client {
+		srv = newTestServer(WithReplayLimits(limits))
+		return NewClient(srv.URL, &http.Client{Transport: &http.Transport{DisableKeepAlives: true}})
+	}
+
+	// hold starts a chunked replay that is in flight until the returned func is called
+	hold := func(ctx context.Context, client Client) func() {
+		r, w := io.Pipe()
+		done := make(chan Result)
+		go func() {
+			defer GinkgoRecover()
+			result, _ := client.ReplayChunked(ctx, r, 4, 2)
+			done <- result
+		}()
+		_, _ = w.Write([]byte("1234"))
+		Eventually(func() float64 {
+			return testutil.ToFloat64(serverInFlight.WithLabelValues("replay"))
+		}).Should(BeNumerically(">=", 1))
+		return func() {
+			_, _ = w.Write([]byte("5678"))
+			_ = w.Close()
+			Eventually(done).Should(Receive(BeSuccessful()))
+		}
+	}
+
+	It("rejects negative limits", func() {
+		Expect(ReplayLimits{MaxBytes: -1}.Validate()).To(MatchError(InvalidReplayLimitsErr))
+		Expect(ReplayLimits{QueueTimeout: -time.Second}.Validate()).To(MatchError(InvalidReplayLimitsErr))
+		Expect(ReplayLimits{MaxConcurrent: 2}.Validate()).To(Succeed())
+		Expect(ReplayLimits{}.Enabled()).To(BeFalse())
+	})
+
+	It("rejects replays exceeding the concurrency limit", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := serve(ReplayLimits{MaxConcurrent: 1, RetryAfter: 1500 * time.Millisecond})
+		rejections := testutil.ToFloat64(serverReplayRejections.WithLabelValues(limitConcurrency))
+
+		release := hold(ctx, client)
+		var result Result
+		Eventually(func() (err error) {
+			result, err = client.ReplayN(ctx, source.New(1024), 1024)
+			return
+		}).Should(MatchError(ServerBusyErr))
+		Expect(result.Failure).To(Equal(StatusFailure))
+		Expect(result.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(testutil.ToFloat64(serverReplayRejections.WithLabelValues(limitConcurrency))).To(Equal(rejections + 1))
+
+		res, err := http.Post(srv.URL+"/replay", "application/octet-stream", strings.NewReader("1234"))
+		Expect(err).NotTo(HaveOccurred())
+		_ = res.Body.Close()
+		Expect(res.Header.Get("Retry-After")).To(Equal("2"))
+
+		release()
+		Expect(client.ReplayN(ctx, source.New(1024), 1024)).To(BeSuccessful())
+	})
+
+	It("rejects replays exceeding the byte limit", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := serve(ReplayLimits{MaxBytes: 4096})
+		rejections := testutil.ToFloat64(serverReplayRejections.WithLabelValues(limitBytes))
+
+		// Chunked replays may be up to MaxReplayRequestSize, so one exhausts the budget
+		release := hold(ctx, client)
+		Eventually(func() error {
+			_, err := client.ReplayN(ctx, source.New(1024), 1024)
+			return err
+		}).Should(MatchError(ServerBusyErr))
+		Expect(testutil.ToFloat64(serverReplayRejections.WithLabelValues(limitBytes))).To(Equal(rejections + 1))
+		release()
+
+		// Replays within the budget are handled concurrently
+		Expect(client.ReplayN(ctx, source.New(1024), 1024)).To(BeSuccessful())
+	})
+
+	It("queues replays until capacity is released", func(ctx context.Context) {
+		limiter := newReplayLimiter(ReplayLimits{MaxBytes: 4096, MaxConcurrent: 2})
+		Expect(limiter.acquire(ctx, 4096)).To(BeEmpty())
+
+		expired, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		Expect(limiter.acquire(expired, 1)).To(Equal(limitBytes))
+
+		acquired := make(chan string)
+		go func() {
+			acquired <- limiter.acquire(ctx, 2048)
+		}()
+		Consistently(acquired, 100*time.Millisecond).ShouldNot(Receive())
+		limiter.release(4096)
+		Eventually(acquired).Should(Receive(BeEmpty()))
+
+		Expect(limiter.acquire(ctx, 1)).To(BeEmpty())
+		name, _ := limiter.tryAcquire(1)
+		Expect(name).To(Equal(limitConcurrency))
+	})
+})
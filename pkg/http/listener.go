@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var InvalidListenerErr = errors.New("listeners must be formatted as [NAME=]NETWORK://ADDRESS, where NETWORK is tcp, tcp4, tcp6, or unix, optionally suffixed with +tls")
+
+// Unix socket URL schemes are dialed by clients using the socket path, percent-encoded, as the URL's host
+// (e.g., http+unix://%2Frun%2Fkonfirm%2Fhttp.sock/check). Requests are sent with the host localhost.
+const (
+	UnixScheme    = "http+unix"
+	UnixTLSScheme = "https+unix"
+)
+
+// ListenerSpec describes a listener the server is served on.
+type ListenerSpec struct {
+
+	// Name labels the listener in logs and metrics. If empty, the listener's String is used.
+	Name string
+
+	// Network is tcp, tcp4, tcp6, or unix.
+	Network string
+
+	// Address is a host and port, or the path of a unix socket.
+	Address string
+
+	// TLS is true if the listener serves TLS.
+	TLS bool
+}
+
+// ParseListenerSpec parses a listener formatted as [NAME=]NETWORK://ADDRESS (e.g., tcp6://[::]:8080,
+// unix:///run/konfirm/http.sock, or public=tcp+tls://:8443).
+func ParseListenerSpec(s string) (spec ListenerSpec, err error) {
+	name, rest, named := strings.Cut(s, "=")
+	if !named || strings.Contains(name, "://") {
+		name, rest = "", s
+	}
+	network, addr, ok := strings.Cut(rest, "://")
+	if !ok || addr == "" || (named && name == "") {
+		return spec, InvalidListenerErr
+	}
+	network, spec.TLS = strings.CutSuffix(network, "+tls")
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return spec, InvalidListenerErr
+	}
+	spec.Network, spec.Address = network, addr
+	spec.Name = name
+	if spec.Name == "" {
+		spec.Name = spec.String()
+	}
+	return spec, nil
+}
+
+// String formats the listener as NETWORK://ADDRESS, without its name.
+func (l ListenerSpec) String() string {
+	network := l.Network
+	if l.TLS {
+		network += "+tls"
+	}
+	return network + "://" + l.Address
+}
+
+// Listen listens on the described address. A stale unix socket (e.g., left by a server that was killed), which
+// refuses connections, is removed first; a socket another server is listening on is not, and Listen fails with
+// an address in use error. The socket is removed again when the listener is closed.
+func (l ListenerSpec) Listen() (net.Listener, error) {
+	if l.Network == "unix" {
+		if fi, err := os.Stat(l.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.DialTimeout("unix", l.Address, time.Second); err == nil {
+				_ = conn.Close()
+			} else if errors.Is(err, syscall.ECONNREFUSED) {
+				_ = os.Remove(l.Address)
+			}
+		}
+	}
+	return net.Listen(l.Network, l.Address)
+}
+
+type listenerKey struct{}
+
+// LabelListener labels the requests and connections served by srv, which serves a single listener, with name
+// in logs and metrics.
+func LabelListener(srv *http.Server, name string) {
+	baseContext := srv.BaseContext
+	srv.BaseContext = func(ln net.Listener) context.Context {
+		ctx := context.Background()
+		if baseContext != nil {
+			ctx = baseContext(ln)
+		}
+		return context.WithValue(ctx, listenerKey{}, name)
+	}
+	connState := srv.ConnState
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			serverConnections.WithLabelValues(name).Inc()
+			serverOpenConnections.WithLabelValues(name).Inc()
+		case http.StateHijacked, http.StateClosed:
+			serverOpenConnections.WithLabelValues(name).Dec()
+		}
+		if connState != nil {
+			connState(conn, state)
+		}
+	}
+}
+
+// listenerName returns the name of the listener that accepted the request made using ctx, if labelled.
+func listenerName(ctx context.Context) string {
+	name, _ := ctx.Value(listenerKey{}).(string)
+	return name
+}
+
+// parseUnixURL returns the server URL, with the host localhost, and the socket path of a unix socket URL.
+func parseUnixURL(raw string) (server string, socket string, ok bool) {
+	scheme, rest, _ := strings.Cut(raw, "://")
+	if scheme != UnixScheme && scheme != UnixTLSScheme {
+		return "", "", false
+	}
+	host, path, _ := strings.Cut(rest, "/")
+	if p, err := url.PathUnescape(host); err == nil && p != "" {
+		socket = p
+	} else {
+		return "", "", false
+	}
+	server = strings.TrimSuffix(strings.TrimSuffix(scheme, "+unix")+"://localhost/"+path, "/")
+	return server, socket, true
+}
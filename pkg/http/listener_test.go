@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var _ = Describe("Listeners", func() {
+
+	DescribeTable("parses listener specs", func(s string, expected ListenerSpec) {
+		Expect(ParseListenerSpec(s)).To(Equal(expected))
+	},
+		Entry("tcp", "tcp://:8080", ListenerSpec{Name: "tcp://:8080", Network: "tcp", Address: ":8080"}),
+		Entry("tcp6", "tcp6://[::]:8080", ListenerSpec{Name: "tcp6://[::]:8080", Network: "tcp6", Address: "[::]:8080"}),
+		Entry("unix", "unix:///run/http.sock", ListenerSpec{Name: "unix:///run/http.sock", Network: "unix", Address: "/run/http.sock"}),
+		Entry("named tls", "public=tcp4+tls://0.0.0.0:8443", ListenerSpec{Name: "public", Network: "tcp4", Address: "0.0.0.0:8443", TLS: true}),
+	)
+
+	DescribeTable("rejects invalid listener specs", func(s string) {
+		_, err := ParseListenerSpec(s)
+		Expect(err).To(MatchError(InvalidListenerErr))
+	},
+		Entry("no network", ":8080"),
+		Entry("unknown network", "udp://:8080"),
+		Entry("no address", "tcp://"),
+		Entry("empty name", "=tcp://:8080"),
+	)
+
+	DescribeTable("parses unix socket URLs", func(raw, server, socket string) {
+		s, p, ok := parseUnixURL(raw)
+		Expect(ok).To(Equal(server != ""))
+		Expect(s).To(Equal(server))
+		Expect(p).To(Equal(socket))
+	},
+		Entry("http", "http+unix://%2Frun%2Fhttp.sock", "http://localhost", "/run/http.sock"),
+		Entry("https with path", "https+unix://%2Frun%2Fhttp.sock/healthz?ready=1", "https://localhost/healthz?ready=1", "/run/http.sock"),
+		Entry("not unix", "http://localhost:8080", "", ""),
+		Entry("no socket", "http+unix:///check", "", ""),
+	)
+
+	It("serves and dials unix sockets", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+
+		// A stale socket is replaced
+		spec, err := ParseListenerSpec("sock=unix://" + filepath.Join(GinkgoT().TempDir(), "http.sock"))
+		Expect(err).NotTo(HaveOccurred())
+		stale, err := spec.Listen()
+		Expect(err).NotTo(HaveOccurred())
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		Expect(stale.Close()).To(Succeed())
+
+		ln, err := spec.Listen()
+		Expect(err).NotTo(HaveOccurred())
+		srv := &http.Server{Handler: NewHandler()}
+		LabelListener(srv, spec.Name)
+		go func() {
+			_ = srv.Serve(ln)
+		}()
+		DeferCleanup(srv.Close)
+
+		// A socket in use is not
+		_, err = spec.Listen()
+		Expect(err).To(MatchError(syscall.EADDRINUSE))
+
+		connections := testutil.ToFloat64(serverConnections.WithLabelValues("sock"))
+		requests := testutil.ToFloat64(serverListenerRequests.WithLabelValues("sock"))
+
+		client := NewClient(UnixScheme+"://"+url.PathEscape(spec.Address), &http.Client{})
+		Expect(client.Check(ctx)).To(BeSuccessful())
+		Expect(client.ReplayN(ctx, source.New(1024), 1024)).To(BeSuccessful())
+		Expect(client.WebSocket(ctx, WebSocketSpec{TextMessages: 1, MessageSize: 16})).To(BeSuccessful())
+		Expect(testutil.ToFloat64(serverConnections.WithLabelValues("sock"))).To(BeNumerically(">", connections))
+		Expect(testutil.ToFloat64(serverListenerRequests.WithLabelValues("sock"))).To(Equal(requests + 3))
+
+		// The socket is removed when the server is closed
+		Expect(srv.Close()).To(Succeed())
+		Eventually(func() error {
+			_, err := os.Stat(spec.Address)
+			return err
+		}).Should(MatchError(os.ErrNotExist))
+	})
+})
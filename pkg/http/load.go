@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+// LoadOptions control how many times, and how concurrently, a request is repeated by RunLoad.
+type LoadOptions struct {
+
+	// Concurrency is the number of workers sending requests. Values less than one are treated as one.
+	Concurrency int
+
+	// Iterations is the total number of requests sent across all workers. If zero, requests are sent until
+	// Duration elapses, or once if Duration is also zero.
+	Iterations int
+
+	// Duration limits how long new requests are started. Requests in flight when it elapses are completed. If
+	// zero, only Iterations limits the run.
+	Duration time.Duration
+}
+
+// IsSingleShot is true if the options send exactly one request.
+func (o LoadOptions) IsSingleShot() bool {
+	return o.Concurrency <= 1 && o.Iterations <= 1 && o.Duration <= 0
+}
+
+// MaxFailedRequestIDs limits the request IDs recorded in LoadReport.FailedRequestIDs.
+const MaxFailedRequestIDs = 10
+
+// LoadReport summarizes the Results of a RunLoad.
+type LoadReport struct {
+
+	// Requests is the number of requests sent.
+	Requests int
+
+	// Successes is the number of successful requests.
+	Successes int
+
+	// Failures is the number of unsuccessful requests by FailureCategory.
+	Failures map[FailureCategory]int
+
+	// FailedRequestIDs are the request IDs of the first MaxFailedRequestIDs unsuccessful requests, which
+	// identify them in the server's logs.
+	FailedRequestIDs []string
+
+	// BytesReceived is the total number of response body bytes received.
+	BytesReceived int64
+
+	// Elapsed is the wall time of the run.
+	Elapsed time.Duration
+
+	// Latencies are the total durations of each request, in ascending order.
+	Latencies []time.Duration
+}
+
+// SuccessRate is the fraction of requests that were successful.
+func (r LoadReport) SuccessRate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Successes) / float64(r.Requests)
+}
+
+// Throughput is the rate at which response body bytes were received in bytes/sec.
+func (r LoadReport) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.BytesReceived) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the nearest-rank latency percentile, where p is between 0 and 1 (e.g., 0.99).
+func (r LoadReport) Percentile(p float64) time.Duration {
+	return percentile(r.Latencies, p)
+}
+
+// percentile returns the nearest-rank percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+func (r LoadReport) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddInt("requests", r.Requests)
+	enc.AddInt("successes", r.Successes)
+	enc.AddFloat64("successRate", r.SuccessRate())
+	enc.AddFloat64("throughput", r.Throughput())
+	enc.AddDuration("elapsed", r.Elapsed)
+	enc.AddDuration("p50", r.Percentile(0.5))
+	enc.AddDuration("p90", r.Percentile(0.9))
+	enc.AddDuration("p99", r.Percentile(0.99))
+	if len(r.FailedRequestIDs) > 0 {
+		_ = enc.AddArray("failedRequestIds", zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+			for _, id := range r.FailedRequestIDs {
+				enc.AppendString(id)
+			}
+			return nil
+		}))
+	}
+	return nil
+}
+
+// RunLoad repeatedly calls request according to opts and reports the results. Each Result is also passed to
+// observe, if not nil, as it completes; observe may be called concurrently. The run stops early if ctx is
+// done.
+func RunLoad(ctx context.Context, opts LoadOptions, request func(context.Context) (Result, error), observe func(Result)) LoadReport {
+
+	logger := logging.FromContext(ctx).Named("load")
+
+	workers := max(opts.Concurrency, 1)
+	iterations := opts.Iterations
+	if iterations <= 0 && opts.Duration <= 0 {
+		iterations = 1
+	}
+	var deadline time.Time
+	if opts.Duration > 0 {
+		deadline = time.Now().Add(opts.Duration)
+	}
+
+	var mu sync.Mutex
+	report := LoadReport{Failures: make(map[FailureCategory]int)}
+	started := 0
+
+	// next reserves the next iteration, returning false when the run is complete
+	next := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Err() != nil || (iterations > 0 && started >= iterations) || (!deadline.IsZero() && time.Now().After(deadline)) {
+			return false
+		}
+		started++
+		return true
+	}
+
+	logger.Info("starting load", zap.Int("concurrency", workers), zap.Int("iterations", iterations), zap.Duration("duration", opts.Duration))
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for next() {
+				result, _ := request(ctx)
+				if observe != nil {
+					observe(result)
+				}
+				mu.Lock()
+				report.Requests++
+				if result.OK {
+					report.Successes++
+				} else {
+					report.Failures[result.Failure]++
+					if len(report.FailedRequestIDs) < MaxFailedRequestIDs && result.RequestID != "" {
+						report.FailedRequestIDs = append(report.FailedRequestIDs, result.RequestID)
+					}
+				}
+				report.BytesReceived += result.BytesReceived
+				report.Latencies = append(report.Latencies, result.Timings.Total)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+	slices.Sort(report.Latencies)
+
+	logger.Info("load complete", zap.Object("report", report))
+	return report
+}
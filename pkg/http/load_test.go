@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var _ = Describe("RunLoad", func() {
+
+	It("sends a single request by default", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		var calls atomic.Int32
+		report := RunLoad(ctx, LoadOptions{}, func(_ context.Context) (Result, error) {
+			calls.Add(1)
+			return Result{OK: true}, nil
+		}, nil)
+		Expect(calls.Load()).To(BeEquivalentTo(1))
+		Expect(report.Requests).To(Equal(1))
+		Expect(report.SuccessRate()).To(Equal(1.0))
+	})
+
+	It("summarizes results", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		var calls atomic.Int32
+		var observed atomic.Int32
+		report := RunLoad(ctx, LoadOptions{Concurrency: 4, Iterations: 100}, func(_ context.Context) (Result, error) {
+			n := calls.Add(1)
+			r := Result{OK: n%10 != 0, BytesReceived: 1024, Timings: Timings{Total: time.Duration(n) * time.Millisecond}}
+			if !r.OK {
+				r.Failure = ResetFailure
+				r.RequestID = fmt.Sprint(n)
+			}
+			return r, nil
+		}, func(_ Result) {
+			observed.Add(1)
+		})
+		Expect(calls.Load()).To(BeEquivalentTo(100))
+		Expect(observed.Load()).To(BeEquivalentTo(100))
+		Expect(report.Requests).To(Equal(100))
+		Expect(report.Successes).To(Equal(90))
+		Expect(report.Failures).To(HaveKeyWithValue(ResetFailure, 10))
+		Expect(report.FailedRequestIDs).To(ConsistOf("10", "20", "30", "40", "50", "60", "70", "80", "90", "100"))
+		Expect(report.SuccessRate()).To(Equal(0.9))
+		Expect(report.BytesReceived).To(BeEquivalentTo(100 * 1024))
+		Expect(report.Throughput()).To(BeNumerically(">", 0))
+		Expect(report.Percentile(0.5)).To(Equal(50 * time.Millisecond))
+		Expect(report.Percentile(0.9)).To(Equal(90 * time.Millisecond))
+		Expect(report.Percentile(0.99)).To(Equal(99 * time.Millisecond))
+	})
+
+	It("stops starting requests when the duration elapses", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		report := RunLoad(ctx, LoadOptions{Concurrency: 2, Duration: 100 * time.Millisecond}, func(_ context.Context) (Result, error) {
+			time.Sleep(10 * time.Millisecond)
+			return Result{OK: true}, nil
+		}, nil)
+		Expect(report.Requests).To(BeNumerically(">", 2))
+		Expect(report.Elapsed).To(BeNumerically("<", time.Second))
+	})
+
+	It("replays concurrently", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := NewClient(fmt.Sprintf("http://%s", server.Addr), http.DefaultClient)
+		report := RunLoad(ctx, LoadOptions{Concurrency: 8, Iterations: 64}, func(ctx context.Context) (Result, error) {
+			return client.ReplayN(ctx, source.New(64*1024), 64*1024)
+		}, nil)
+		Expect(report.Successes).To(Equal(64))
+		Expect(report.BytesReceived).To(BeEquivalentTo(64 * 64 * 1024))
+	})
+})
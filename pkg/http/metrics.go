@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "konfirm"
+	metricsSubsystem = "http_server"
+)
+
+// Server metrics are recorded by every handler returned by NewHandler, and exposed once registered using
+// RegisterServerMetrics. Requests are labelled by handler (i.e., the endpoint without its leading slash).
+var (
+	serverRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "requests_total",
+		Help:      "The number of requests handled.",
+	}, []string{"handler", "code"})
+
+	serverInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "requests_in_flight",
+		Help:      "The number of requests being handled.",
+	}, []string{"handler"})
+
+	serverDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "request_duration_seconds",
+		Help:      "The time taken to handle requests, including streamed and held responses.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"handler", "code"})
+
+	serverRequestBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "request_bytes_total",
+		Help:      "The number of request body bytes read.",
+	}, []string{"handler", "code"})
+
+	serverResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "response_bytes_total",
+		Help:      "The number of response body bytes written.",
+	}, []string{"handler", "code"})
+
+	serverTooLarge = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "requests_too_large_total",
+		Help:      "The number of requests rejected because they exceeded the maximum request size.",
+	}, []string{"handler"})
+
+	serverReplayErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "replay_errors_total",
+		Help: "The number of replays that could not be echoed intact, by reason: the request body could not be " +
+			"read (read), did not match its Content-Length (length), or the response could not be written (write).",
+	}, []string{"reason"})
+
+	serverTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "connections_timed_out_total",
+		Help:      "The number of connections closed by each server timeout (read_header, read, write, or idle).",
+	}, []string{"timeout"})
+
+	serverReplayRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "replay_rejections_total",
+		Help:      "The number of replays rejected because the replay byte (bytes) or concurrency (concurrency) limit was exhausted.",
+	}, []string{"reason"})
+
+	serverConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "connections_total",
+		Help:      "The number of connections accepted by each listener.",
+	}, []string{"listener"})
+
+	serverOpenConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "connections_open",
+		Help:      "The number of open connections of each listener, excluding connections hijacked by WebSockets.",
+	}, []string{"listener"})
+
+	serverListenerRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "listener_requests_total",
+		Help:      "The number of requests handled by each listener.",
+	}, []string{"listener"})
+
+	serverProxyHeaders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "proxy_headers_total",
+		Help:      "The number of connections accepted with a PROXY protocol header by version (v1 or v2), or without one (none) if optional.",
+	}, []string{"version"})
+
+	serverProxyErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "proxy_header_errors_total",
+		Help:      "The number of connections rejected because their PROXY protocol header was missing (if required) or invalid.",
+	}, []string{"reason"})
+
+	serverUnauthorized = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "unauthorized_total",
+		Help: "The number of requests rejected because their credentials were missing, invalid, expired (an HMAC " +
+			"timestamp outside the allowed clock skew), or replayed (a reused HMAC nonce).",
+	}, []string{"reason"})
+)
+
+// Reasons a replay could not be echoed intact. Digest mismatches are detected only by clients, which are the
+// only party that knows what was sent; these are the corresponding failures the server can observe.
+const (
+	replayReadError   = "read"
+	replayLengthError = "length"
+	replayWriteError  = "write"
+)
+
+// RegisterServerMetrics registers the server metrics with reg (e.g., prometheus.DefaultRegisterer). Registering
+// them with the same reg more than once is not an error.
+func RegisterServerMetrics(reg prometheus.Registerer) error {
+	var errs []error
+	for _, c := range []prometheus.Collector{
+		serverRequests,
+		serverInFlight,
+		serverDuration,
+		serverRequestBytes,
+		serverResponseBytes,
+		serverTooLarge,
+		serverReplayErrors,
+		serverReplayRejections,
+		serverTimeouts,
+		serverUnauthorized,
+		serverConnections,
+		serverOpenConnections,
+		serverListenerRequests,
+		serverProxyHeaders,
+		serverProxyErrors,
+	} {
+		if err := reg.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if !errors.As(err, &are) || are.ExistingCollector != c {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// instrument wraps next, recording the server metrics of each request labelled by the mux pattern that
+// handles it. Requests not handled by a registered pattern are labelled "other".
+func instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		handler := "other"
+		if _, pattern := mux.Handler(req); strings.HasPrefix(pattern, "/") && len(pattern) > 1 {
+			handler = pattern[1:]
+		}
+
+		if name := listenerName(req.Context()); name != "" {
+			serverListenerRequests.WithLabelValues(name).Inc()
+		}
+
+		inFlight := serverInFlight.WithLabelValues(handler)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		w := &metricsWriter{ResponseWriter: res}
+		body := &countingBody{ReadCloser: req.Body}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = body
+		}
+		defer func() {
+			code := strconv.Itoa(w.status())
+			serverRequests.WithLabelValues(handler, code).Inc()
+			serverDuration.WithLabelValues(handler, code).Observe(time.Since(start).Seconds())
+			serverRequestBytes.WithLabelValues(handler, code).Add(float64(body.n.Load()))
+			serverResponseBytes.WithLabelValues(handler, code).Add(float64(w.written))
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// countingBody is a request body that counts the bytes read from it.
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// metricsWriter is an http.ResponseWriter that records the status code and the number of bytes written.
+type metricsWriter struct {
+	http.ResponseWriter
+	code     int
+	written  int64
+	hijacked bool
+}
+
+// status returns the status code sent, which is 101 if the connection was hijacked to be upgraded.
+func (w *metricsWriter) status() int {
+	switch {
+	case w.hijacked:
+		return http.StatusSwitchingProtocols
+	case w.code == 0:
+		return http.StatusOK
+	default:
+		return w.code
+	}
+}
+
+func (w *metricsWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *metricsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	w.hijacked = err == nil
+	return conn, rw, err
+}
+
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
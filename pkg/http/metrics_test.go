@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var _ = Describe("Server metrics", func() {
+
+	It("registers once per registry", func() {
+		reg := prometheus.NewRegistry()
+		Expect(RegisterServerMetrics(reg)).To(Succeed())
+		Expect(RegisterServerMetrics(reg)).To(Succeed())
+		Expect(testutil.GatherAndLint(reg)).To(BeEmpty())
+	})
+
+	It("records requests by handler and status code", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewHandler())
+		DeferCleanup(srv.Close)
+		client := NewClient(srv.URL, http.DefaultClient)
+
+		checks := testutil.ToFloat64(serverRequests.WithLabelValues("check", "200"))
+		replays := testutil.ToFloat64(serverRequests.WithLabelValues("replay", "200"))
+		replayed := testutil.ToFloat64(serverRequestBytes.WithLabelValues("replay", "200"))
+		echoed := testutil.ToFloat64(serverResponseBytes.WithLabelValues("replay", "200"))
+		Expect(client.Check(ctx)).To(BeSuccessful())
+		Expect(client.ReplayN(ctx, source.New(4096), 4096)).To(BeSuccessful())
+		Expect(testutil.ToFloat64(serverRequests.WithLabelValues("check", "200"))).To(Equal(checks + 1))
+		Expect(testutil.ToFloat64(serverRequests.WithLabelValues("replay", "200"))).To(Equal(replays + 1))
+		Expect(testutil.ToFloat64(serverRequestBytes.WithLabelValues("replay", "200"))).To(Equal(replayed + 4096))
+		Expect(testutil.ToFloat64(serverResponseBytes.WithLabelValues("replay", "200"))).To(Equal(echoed + 4096))
+		Expect(testutil.ToFloat64(serverInFlight.WithLabelValues("replay"))).To(BeZero())
+		Expect(testutil.CollectAndCount(serverDuration)).To(BeNumerically(">=", 2))
+
+		// Upgraded connections are recorded as 101
+		upgrades := testutil.ToFloat64(serverRequests.WithLabelValues("websocket", "101"))
+		Expect(client.WebSocket(ctx, WebSocketSpec{TextMessages: 1, MessageSize: 16})).To(BeSuccessful())
+		Eventually(func() float64 {
+			return testutil.ToFloat64(serverRequests.WithLabelValues("websocket", "101"))
+		}).Should(Equal(upgrades + 1))
+	})
+
+	It("counts requests that are too large", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewHandler())
+		DeferCleanup(srv.Close)
+		max := MaxReplayRequestSize
+		MaxReplayRequestSize = 1024
+		DeferCleanup(func() {
+			MaxReplayRequestSize = max
+		})
+
+		tooLarge := testutil.ToFloat64(serverTooLarge.WithLabelValues("replay"))
+		_, err := NewClient(srv.URL, http.DefaultClient).ReplayN(ctx, source.New(2048), 2048)
+		Expect(err).To(MatchError(ExceedsMaxRequestSizeErr))
+		Expect(testutil.ToFloat64(serverTooLarge.WithLabelValues("replay"))).To(Equal(tooLarge + 1))
+		Expect(testutil.ToFloat64(serverRequests.WithLabelValues("replay", "413"))).To(BeNumerically(">=", 1))
+	})
+})
@@ -0,0 +1,397 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var InvalidStatusRangeErr = errors.New("status ranges must be formatted as CODE, NXX, or MIN-MAX (e.g., 204, 2xx, or 200-399)")
+var InvalidHeaderAssertionErr = errors.New("header assertions must be formatted as NAME, NAME=VALUE, or NAME~REGEX")
+var InvalidJSONAssertionErr = errors.New("JSON assertions must be formatted as PATH or PATH=VALUE (e.g., status=ok or items.0.id)")
+var ProbeAssertionErr = errors.New("the probe response did not satisfy an assertion")
+var LatencyExceededErr = errors.New("the probe exceeded the maximum latency")
+var ProbeResponseTooLargeErr = errors.New("the probe response body exceeded the maximum size that can be asserted on")
+
+// MaxProbeResponseSize is the maximum number of bytes of a probe response body that are read and asserted on.
+var MaxProbeResponseSize int64 = 16 * 1024 * 1024 // 16 MiB
+
+// StatusRange is an inclusive range of HTTP status codes.
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// ParseStatusRange parses a single status code (e.g., 204), a class of status codes (e.g., 2xx), or an
+// inclusive range (e.g., 200-399).
+func ParseStatusRange(s string) (StatusRange, error) {
+
+	parse := func(code string) (int, error) {
+		if n, err := strconv.Atoi(code); err == nil && n >= 100 && n <= 599 {
+			return n, nil
+		}
+		return 0, InvalidStatusRangeErr
+	}
+
+	if len(s) == 3 && strings.EqualFold(s[1:], "xx") {
+		if n, err := parse(s[:1] + "00"); err == nil {
+			return StatusRange{Min: n, Max: n + 99}, nil
+		}
+		return StatusRange{}, InvalidStatusRangeErr
+	}
+	if lo, hi, ok := strings.Cut(s, "-"); ok {
+		r := StatusRange{}
+		var err error
+		if r.Min, err = parse(lo); err != nil {
+			return r, err
+		}
+		if r.Max, err = parse(hi); err != nil || r.Max < r.Min {
+			return StatusRange{}, InvalidStatusRangeErr
+		}
+		return r, nil
+	}
+	n, err := parse(s)
+	return StatusRange{Min: n, Max: n}, err
+}
+
+func (r StatusRange) Contains(code int) bool {
+	return code >= r.Min && code <= r.Max
+}
+
+func (r StatusRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// HeaderAssertion asserts a response header is present and, if Value or Pattern is set, that one of its values
+// is equal to Value or matches Pattern.
+type HeaderAssertion struct {
+	Name    string
+	Value   string
+	Pattern *regexp.Regexp
+}
+
+// ParseHeaderAssertion parses NAME (the header is present), NAME=VALUE (a value is equal to VALUE), or
+// NAME~REGEX (a value matches REGEX).
+func ParseHeaderAssertion(s string) (HeaderAssertion, error) {
+	i := strings.IndexAny(s, "=~")
+	if i < 0 {
+		return HeaderAssertion{Name: strings.TrimSpace(s)}, validHeaderName(s)
+	}
+	a := HeaderAssertion{Name: strings.TrimSpace(s[:i])}
+	if err := validHeaderName(a.Name); err != nil {
+		return a, err
+	}
+	if s[i] == '=' {
+		a.Value = s[i+1:]
+		return a, nil
+	}
+	var err error
+	if a.Pattern, err = regexp.Compile(s[i+1:]); err != nil {
+		return a, errors.Join(InvalidHeaderAssertionErr, err)
+	}
+	return a, nil
+}
+
+func validHeaderName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return InvalidHeaderAssertionErr
+	}
+	return nil
+}
+
+func (a HeaderAssertion) matches(header http.Header) bool {
+	values := header.Values(a.Name)
+	if len(values) == 0 {
+		return false
+	}
+	switch {
+	case a.Pattern != nil:
+		return slices.ContainsFunc(values, a.Pattern.MatchString)
+	case a.Value != "":
+		return slices.Contains(values, a.Value)
+	default:
+		return true
+	}
+}
+
+func (a HeaderAssertion) String() string {
+	switch {
+	case a.Pattern != nil:
+		return a.Name + "~" + a.Pattern.String()
+	case a.Value != "":
+		return a.Name + "=" + a.Value
+	default:
+		return a.Name
+	}
+}
+
+// JSONAssertion asserts the value at a dot-separated path (e.g., items.0.id) in a JSON response body is present
+// and, if Value is set, equal to it. Strings are compared to Value as-is, and other values are compared using
+// their JSON encoding (e.g., true, 42, or null).
+type JSONAssertion struct {
+	Path     string
+	Value    string
+	HasValue bool
+}
+
+// ParseJSONAssertion parses PATH (the value is present) or PATH=VALUE (the value is equal to VALUE).
+func ParseJSONAssertion(s string) (JSONAssertion, error) {
+	path, value, hasValue := strings.Cut(s, "=")
+	if path = strings.TrimSpace(path); path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") {
+		return JSONAssertion{}, InvalidJSONAssertionErr
+	}
+	return JSONAssertion{Path: path, Value: value, HasValue: hasValue}, nil
+}
+
+// lookup returns the value at the assertion's path in doc.
+func (a JSONAssertion) lookup(doc any) (any, bool) {
+	for _, key := range strings.Split(a.Path, ".") {
+		switch v := doc.(type) {
+		case map[string]any:
+			var ok bool
+			if doc, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+func (a JSONAssertion) matches(doc any) bool {
+	v, ok := a.lookup(doc)
+	if !ok || !a.HasValue {
+		return ok
+	}
+	if s, isString := v.(string); isString {
+		return s == a.Value
+	}
+	encoded, err := json.Marshal(v)
+	return err == nil && string(encoded) == a.Value
+}
+
+func (a JSONAssertion) String() string {
+	if a.HasValue {
+		return a.Path + "=" + a.Value
+	}
+	return a.Path
+}
+
+// ProbeSpec describes a request sent to an arbitrary URL by Client.Probe, and the assertions on its response.
+type ProbeSpec struct {
+
+	// Method is the request method (default GET).
+	Method string
+
+	// Header is sent with the request. A Host header overrides the request's host.
+	Header http.Header
+
+	// Body is sent with the request, if not empty.
+	Body []byte
+
+	// FollowRedirects causes redirects to be followed, in which case the assertions apply to the final response.
+	FollowRedirects bool
+
+	// Status is the acceptable status codes (default 2xx).
+	Status []StatusRange
+
+	Headers      []HeaderAssertion
+	BodyContains []string
+	BodyPatterns []*regexp.Regexp
+	JSON         []JSONAssertion
+
+	// MaxLatency is the maximum time from sending the request to reading the response body, if positive. The
+	// probe is canceled once it is exceeded.
+	MaxLatency time.Duration
+}
+
+// assertsBody is true if the spec has assertions on the response body.
+func (s ProbeSpec) assertsBody() bool {
+	return len(s.BodyContains) > 0 || len(s.BodyPatterns) > 0 || len(s.JSON) > 0
+}
+
+// probeError returns the FailureCategory of err, an error sending a probe or reading its response, using
+// classify, and the error to return. Errors caused by the probe exceeding its maximum latency, which cancels
+// ctx, are a LatencyFailure.
+func probeError(ctx context.Context, err error, classify func(error) FailureCategory) (FailureCategory, error) {
+	if errors.Is(context.Cause(ctx), LatencyExceededErr) {
+		return LatencyFailure, fmt.Errorf("%w: %w", LatencyExceededErr, err)
+	}
+	return classify(err), err
+}
+
+// Probe sends the request described by spec to the server URL as-is, rather than to one of the konfirm server's
+// handlers, and asserts on the response. Since the server need not be a konfirm server, the client identity
+// is not verified even if WithMutualTLS is set, and credentials set using WithCredentials are not sent.
+func (c *client) Probe(ctx context.Context, spec ProbeSpec) (result Result, err error) {
+
+	ctx = c.correlate(ctx, &result)
+	logger := c.logger(ctx)
+	logger.Info("starting probe")
+
+	ctx, trace := newTracer(ctx)
+	defer func() {
+		result.Timings = trace.done(logger)
+	}()
+
+	// Cancel the probe once the maximum latency is exceeded, so that a stalled server fails it promptly
+	if spec.MaxLatency > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, spec.MaxLatency, LatencyExceededErr)
+		defer cancel()
+	}
+
+	method := spec.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if len(spec.Body) > 0 {
+		body = bytes.NewReader(spec.Body)
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, method, c.server, body); err != nil {
+		logger.Error("an error occurred generating the probe request", zap.Error(err))
+		return result, result.fail(RequestFailure, err)
+	}
+	for k, v := range spec.Header {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	result.BytesSent = int64(len(spec.Body))
+
+	httpClient := *c.http
+	if t, ok := httpClient.Transport.(*clientTransport); ok {
+		anonymous := *t
+		anonymous.creds = Credentials{}
+		httpClient.Transport = &anonymous
+	}
+	if !spec.FollowRedirects {
+		httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	start := time.Now()
+	var res *http.Response
+	if res, err = httpClient.Do(req); err != nil {
+		logger.Error("an error occurred during probe", zap.Error(err))
+		return result, result.fail(probeError(ctx, err, classifyError))
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	result.StatusCode = res.StatusCode
+
+	status := spec.Status
+	if len(status) == 0 {
+		status = []StatusRange{{Min: 200, Max: 299}}
+	}
+	if !slices.ContainsFunc(status, func(r StatusRange) bool { return r.Contains(res.StatusCode) }) {
+		logger.Error("probe failed with an unexpected HTTP status code", zap.Int("statusCode", res.StatusCode), zap.Stringers("expected", status))
+		return result, result.fail(StatusFailure, HttpStatusCodeErr)
+	}
+
+	if err = c.verifyProtocol(logger, res, &result); err != nil {
+		return
+	}
+
+	for _, a := range spec.Headers {
+		if !a.matches(res.Header) {
+			logger.Error("probe response header did not match", zap.Stringer("assertion", a), zap.Strings("actual", res.Header.Values(a.Name)))
+			return result, result.fail(HeaderFailure, fmt.Errorf("%w: header %s", ProbeAssertionErr, a))
+		}
+	}
+
+	// One byte more than the maximum is read to detect bodies that are too large to assert on
+	resBody, e := io.ReadAll(io.LimitReader(res.Body, MaxProbeResponseSize+1))
+	latency := time.Since(start)
+	result.BytesReceived = int64(len(resBody))
+	if e != nil {
+		logger.Error("an error occurred while reading the probe response", zap.Error(e))
+		return result, result.fail(probeError(ctx, e, classifyBodyError))
+	} else if result.BytesReceived > MaxProbeResponseSize {
+		if spec.assertsBody() {
+			logger.Error("probe response body is too large to assert on", zap.Int64("maxSize", MaxProbeResponseSize))
+			return result, result.fail(LengthFailure, fmt.Errorf("%w: %d bytes", ProbeResponseTooLargeErr, MaxProbeResponseSize))
+		}
+		logger.Warn("probe response body exceeds the maximum size and was not read in full", zap.Int64("maxSize", MaxProbeResponseSize))
+	}
+
+	for _, s := range spec.BodyContains {
+		if !bytes.Contains(resBody, []byte(s)) {
+			logger.Error("probe response body did not contain the expected string", zap.String("expected", s))
+			return result, result.fail(BodyFailure, fmt.Errorf("%w: body contains %q", ProbeAssertionErr, s))
+		}
+	}
+	for _, p := range spec.BodyPatterns {
+		if !p.Match(resBody) {
+			logger.Error("probe response body did not match the expected pattern", zap.Stringer("pattern", p))
+			return result, result.fail(BodyFailure, fmt.Errorf("%w: body matches %q", ProbeAssertionErr, p))
+		}
+	}
+	if len(spec.JSON) > 0 {
+		var doc any
+		if e := json.Unmarshal(resBody, &doc); e != nil {
+			logger.Error("probe response body is not valid JSON", zap.Error(e))
+			return result, result.fail(BodyFailure, fmt.Errorf("%w: body is not valid JSON", ProbeAssertionErr))
+		}
+		for _, a := range spec.JSON {
+			if !a.matches(doc) {
+				logger.Error("probe response JSON did not match", zap.Stringer("assertion", a))
+				return result, result.fail(BodyFailure, fmt.Errorf("%w: JSON %s", ProbeAssertionErr, a))
+			}
+		}
+	}
+
+	if spec.MaxLatency > 0 && latency > spec.MaxLatency {
+		logger.Error("probe exceeded the maximum latency", zap.Duration("latency", latency), zap.Duration("max", spec.MaxLatency))
+		return result, result.fail(LatencyFailure, LatencyExceededErr)
+	}
+
+	logger.Info("probe successful", zap.Int("statusCode", res.StatusCode), zap.Duration("latency", latency))
+	result.OK = true
+	return
+}
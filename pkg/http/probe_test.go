@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+var _ = Describe("Probe", func() {
+
+	DescribeTable("parses status ranges", func(s string, expected StatusRange) {
+		Expect(ParseStatusRange(s)).To(Equal(expected))
+	},
+		Entry("code", "204", StatusRange{Min: 204, Max: 204}),
+		Entry("class", "3xx", StatusRange{Min: 300, Max: 399}),
+		Entry("range", "200-404", StatusRange{Min: 200, Max: 404}),
+	)
+
+	DescribeTable("rejects malformed status ranges", func(s string) {
+		_, err := ParseStatusRange(s)
+		Expect(err).To(MatchError(InvalidStatusRangeErr))
+	},
+		Entry("not a code", "ok"),
+		Entry("out of range", "600"),
+		Entry("bad class", "9xx"),
+		Entry("inverted range", "404-200"),
+	)
+
+	It("parses header and JSON assertions", func() {
+		a, err := ParseHeaderAssertion("Content-Type~^application/json")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.Name).To(Equal("Content-Type"))
+		Expect(a.Pattern.String()).To(Equal("^application/json"))
+		a, err = ParseHeaderAssertion("X-Version=1.2=3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.Value).To(Equal("1.2=3"))
+		_, err = ParseHeaderAssertion("=value")
+		Expect(err).To(MatchError(InvalidHeaderAssertionErr))
+
+		j, err := ParseJSONAssertion("items.0.id=42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j).To(Equal(JSONAssertion{Path: "items.0.id", Value: "42", HasValue: true}))
+		_, err = ParseJSONAssertion(".items")
+		Expect(err).To(MatchError(InvalidJSONAssertionErr))
+	})
+
+	Context("with a server", func() {
+
+		var server string
+		BeforeEach(func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api", func(res http.ResponseWriter, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				res.Header().Set("Content-Type", "application/json")
+				res.Header().Set("X-Method", req.Method)
+				res.Header().Set("X-Token", req.Header.Get("X-Token"))
+				_, _ = res.Write([]byte(`{"status":"ok","version":"1.2.3","ready":true,"items":[{"id":42}],"echo":"` + string(body) + `"}`))
+			})
+			mux.HandleFunc("/old", func(res http.ResponseWriter, req *http.Request) {
+				http.Redirect(res, req, "/api", http.StatusFound)
+			})
+			mux.HandleFunc("/slow", func(res http.ResponseWriter, req *http.Request) {
+				time.Sleep(100 * time.Millisecond)
+			})
+			mux.HandleFunc("/stall", func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusOK)
+				res.(http.Flusher).Flush()
+				select {
+				case <-req.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+			})
+			mux.HandleFunc("/large", func(res http.ResponseWriter, req *http.Request) {
+				_, _ = res.Write(bytes.Repeat([]byte("a"), int(MaxProbeResponseSize)+1))
+			})
+			srv := httptest.NewServer(mux)
+			DeferCleanup(srv.Close)
+			server = srv.URL
+		})
+
+		probe := func(ctx context.Context, path string, spec ProbeSpec) (Result, error) {
+			return NewClient(server+path, http.DefaultClient).Probe(logging.NewContext(ctx, logger), spec)
+		}
+
+		It("sends the request and asserts on the response", func(ctx context.Context) {
+			result, err := probe(ctx, "/api", ProbeSpec{
+				Method:       http.MethodPost,
+				Header:       http.Header{"X-Token": []string{"secret"}},
+				Body:         []byte("hello"),
+				Headers:      []HeaderAssertion{{Name: "X-Method", Value: "POST"}, {Name: "X-Token", Value: "secret"}},
+				BodyContains: []string{`"status":"ok"`},
+				BodyPatterns: []*regexp.Regexp{regexp.MustCompile(`"version":"\d+\.\d+\.\d+"`)},
+				JSON: []JSONAssertion{
+					{Path: "echo", Value: "hello", HasValue: true},
+					{Path: "ready", Value: "true", HasValue: true},
+					{Path: "items.0.id", Value: "42", HasValue: true},
+				},
+				MaxLatency: 5 * time.Second,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(BeSuccessful())
+			Expect(result.StatusCode).To(Equal(http.StatusOK))
+			Expect(result.BytesSent).To(Equal(int64(5)))
+			Expect(result.BytesReceived).To(BeNumerically(">", 0))
+		})
+
+		It("follows redirects only if configured", func(ctx context.Context) {
+			result, err := probe(ctx, "/old", ProbeSpec{})
+			Expect(err).To(MatchError(HttpStatusCodeErr))
+			Expect(result.StatusCode).To(Equal(http.StatusFound))
+			Expect(probe(ctx, "/old", ProbeSpec{Status: []StatusRange{{Min: 300, Max: 399}}})).To(BeSuccessful())
+			Expect(probe(ctx, "/old", ProbeSpec{FollowRedirects: true, JSON: []JSONAssertion{{Path: "status"}}})).To(BeSuccessful())
+		})
+
+		DescribeTable("fails unsatisfied assertions", func(ctx context.Context, spec ProbeSpec, category FailureCategory) {
+			result, err := probe(ctx, "/api", spec)
+			Expect(err).To(HaveOccurred())
+			Expect(result.Failure).To(Equal(category))
+		},
+			Entry("status", ProbeSpec{Status: []StatusRange{{Min: 201, Max: 299}}}, StatusFailure),
+			Entry("missing header", ProbeSpec{Headers: []HeaderAssertion{{Name: "X-Missing"}}}, HeaderFailure),
+			Entry("header pattern", ProbeSpec{Headers: []HeaderAssertion{{Name: "Content-Type", Pattern: regexp.MustCompile("xml")}}}, HeaderFailure),
+			Entry("body", ProbeSpec{BodyContains: []string{"error"}}, BodyFailure),
+			Entry("body pattern", ProbeSpec{BodyPatterns: []*regexp.Regexp{regexp.MustCompile(`"version":"2\.`)}}, BodyFailure),
+			Entry("JSON value", ProbeSpec{JSON: []JSONAssertion{{Path: "status", Value: "degraded", HasValue: true}}}, BodyFailure),
+			Entry("JSON path", ProbeSpec{JSON: []JSONAssertion{{Path: "items.1.id"}}}, BodyFailure),
+		)
+
+		It("fails when the maximum latency is exceeded", func(ctx context.Context) {
+			result, err := probe(ctx, "/slow", ProbeSpec{MaxLatency: 10 * time.Millisecond})
+			Expect(err).To(MatchError(LatencyExceededErr))
+			Expect(result.Failure).To(Equal(LatencyFailure))
+
+			// Stalled response bodies are canceled once the maximum latency is exceeded
+			start := time.Now()
+			result, err = probe(ctx, "/stall", ProbeSpec{MaxLatency: 50 * time.Millisecond})
+			Expect(err).To(MatchError(LatencyExceededErr))
+			Expect(result.Failure).To(Equal(LatencyFailure))
+			Expect(result.StatusCode).To(Equal(http.StatusOK))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+
+		It("fails body assertions on responses too large to assert on", func(ctx context.Context) {
+			result, err := probe(ctx, "/large", ProbeSpec{BodyContains: []string{"a"}})
+			Expect(err).To(MatchError(ProbeResponseTooLargeErr))
+			Expect(result.Failure).To(Equal(LengthFailure))
+			Expect(probe(ctx, "/large", ProbeSpec{})).To(BeSuccessful())
+		})
+	})
+})
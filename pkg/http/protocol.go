@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ProtocolHeader is the response header in which the server returns the protocol it observed (e.g., HTTP/2.0),
+// which may differ from the protocol negotiated by the client if a proxy is in between.
+const ProtocolHeader = "X-Konfirm-Protocol"
+
+var UnsupportedProtocolErr = errors.New("protocol must be one of http/1.1, h2, or h2c")
+var ProtocolDowngradeErr = errors.New("the request was downgraded from the expected protocol")
+var H2CSchemeErr = errors.New("h2c requires an http server URL")
+
+var h2cResponseTimeoutErr = fmt.Errorf("h2c: timeout awaiting response headers: %w", os.ErrDeadlineExceeded)
+
+// Protocol is an HTTP protocol a client may be forced to use.
+type Protocol string
+
+const (
+	// DefaultProtocol negotiates HTTP/2 over TLS and uses HTTP/1.1 otherwise.
+	DefaultProtocol Protocol = ""
+
+	// HTTP1 uses HTTP/1.1 only.
+	HTTP1 Protocol = "http/1.1"
+
+	// HTTP2 negotiates HTTP/2 over TLS.
+	HTTP2 Protocol = "h2"
+
+	// H2C uses cleartext HTTP/2 with prior knowledge, so it requires an http server URL. Its connections are
+	// dialed directly; HTTP proxies (e.g., HTTP_PROXY) are not used.
+	H2C Protocol = "h2c"
+)
+
+// ParseProtocol returns the Protocol named by s.
+func ParseProtocol(s string) (Protocol, error) {
+	switch p := Protocol(s); p {
+	case DefaultProtocol, HTTP1, HTTP2, H2C:
+		return p, nil
+	default:
+		return p, UnsupportedProtocolErr
+	}
+}
+
+// ValidateURL returns H2CSchemeErr if the protocol is H2C and serverURL is not an http URL.
+func (p Protocol) ValidateURL(serverURL string) error {
+	if p != H2C {
+		return nil
+	}
+	if server, _, ok := parseUnixURL(serverURL); ok {
+		serverURL = server
+	}
+	if u, err := url.Parse(serverURL); err != nil {
+		return err
+	} else if u.Scheme != "http" {
+		return H2CSchemeErr
+	}
+	return nil
+}
+
+// major is the HTTP major version of the protocol, or zero for DefaultProtocol.
+func (p Protocol) major() int {
+	switch p {
+	case HTTP1:
+		return 1
+	case HTTP2, H2C:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// transport returns a RoundTripper that forces the protocol, based on transport.
+func (p Protocol) transport(transport *http.Transport) (http.RoundTripper, error) {
+	switch p {
+	case DefaultProtocol:
+		return transport, nil
+	case HTTP1:
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		return transport, nil
+	case HTTP2:
+		transport.ForceAttemptHTTP2 = true
+		return transport, nil
+	case H2C:
+		return newH2CTransport(transport), nil
+	default:
+		return nil, UnsupportedProtocolErr
+	}
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// h2cTransport uses cleartext HTTP/2 with prior knowledge. Like an http.Transport, it limits how long to wait
+// for the response headers once the request is written, which http2.Transport does not.
+type h2cTransport struct {
+	transport       *http2.Transport
+	dial            dialFunc
+	responseTimeout time.Duration
+}
+
+// newH2CTransport returns an h2cTransport with the settings of transport that apply to cleartext HTTP/2.
+func newH2CTransport(transport *http.Transport) *h2cTransport {
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t := &h2cTransport{
+		transport: &http2.Transport{
+			DisableCompression: transport.DisableCompression,
+			IdleConnTimeout:    transport.IdleConnTimeout,
+		},
+		responseTimeout: transport.ResponseHeaderTimeout,
+	}
+	if n := transport.MaxResponseHeaderBytes; n > 0 {
+		t.transport.MaxHeaderListSize = uint32(min(n, math.MaxUint32))
+	}
+	return t.withDial(dial)
+}
+
+// withDial returns a copy of t, without its connections, that dials connections using dial.
+func (t *h2cTransport) withDial(dial dialFunc) *h2cTransport {
+	return &h2cTransport{
+		transport: &http2.Transport{
+			AllowHTTP:          true,
+			DisableCompression: t.transport.DisableCompression,
+			IdleConnTimeout:    t.transport.IdleConnTimeout,
+			MaxHeaderListSize:  t.transport.MaxHeaderListSize,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		},
+		dial:            dial,
+		responseTimeout: t.responseTimeout,
+	}
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	// https requests would otherwise be sent in cleartext
+	if req.URL.Scheme != "http" {
+		return nil, H2CSchemeErr
+	}
+	if t.responseTimeout <= 0 {
+		return t.transport.RoundTrip(req)
+	}
+
+	// Cancel the request if its response headers are not received within the timeout of it being written
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(math.MaxInt64, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(_ httptrace.WroteRequestInfo) {
+			timer.Reset(t.responseTimeout)
+		},
+	})
+	res, err := t.transport.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	switch {
+	case timedOut.Load():
+		if err == nil {
+			_ = res.Body.Close()
+		}
+		return nil, h2cResponseTimeoutErr
+	case err != nil:
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelOnClose cancels the context of a response once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// NewH2CHandler wraps handler to also accept cleartext HTTP/2 (h2c) connections, using either prior knowledge
+// or an h2c upgrade.
+func NewH2CHandler(handler http.Handler) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// observeProtocol returns the protocol of each request in the ProtocolHeader of its response.
+func observeProtocol(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set(ProtocolHeader, req.Proto)
+		next.ServeHTTP(res, req)
+	})
+}
+
+// WithProtocol requires requests to use the protocol end-to-end. Requests fail with ProtocolDowngradeErr if
+// the protocol negotiated by the client, or observed by the server, has a lower major version.
+func WithProtocol(p Protocol) ClientOption {
+	return protocolOption(p)
+}
+
+type protocolOption Protocol
+
+func (o protocolOption) apply(c *client) {
+	c.protocol = Protocol(o)
+}
+
+// verifyProtocol records the protocols of the response and, if the client requires a protocol, returns
+// ProtocolDowngradeErr if either was downgraded.
+func (c *client) verifyProtocol(logger *zap.Logger, res *http.Response, result *Result) error {
+
+	result.Protocol = res.Proto
+	result.ServerProtocol = res.Header.Get(ProtocolHeader)
+	logger.Debug("protocol negotiated", zap.String("protocol", result.Protocol), zap.String("serverProtocol", result.ServerProtocol))
+
+	expected := c.protocol.major()
+	if expected == 0 {
+		return nil
+	}
+	var major, minor int
+	if res.ProtoMajor < expected {
+		logger.Error("protocol was downgraded", zap.String("expected", string(c.protocol)), zap.String("protocol", result.Protocol))
+		return result.fail(ProtocolFailure, ProtocolDowngradeErr)
+	} else if _, err := fmt.Sscanf(result.ServerProtocol, "HTTP/%d.%d", &major, &minor); err == nil && major < expected {
+		logger.Error("protocol was downgraded before reaching the server", zap.String("expected", string(c.protocol)), zap.String("serverProtocol", result.ServerProtocol))
+		return result.fail(ProtocolFailure, ProtocolDowngradeErr)
+	}
+	return nil
+}
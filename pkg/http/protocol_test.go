@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var _ = Describe("Protocols", func() {
+
+	It("rejects unsupported protocols", func() {
+		_, err := ParseProtocol("spdy")
+		Expect(err).To(MatchError(UnsupportedProtocolErr))
+		_, err = NewHTTPClient(ClientConfig{Protocol: "spdy"})
+		Expect(err).To(MatchError(UnsupportedProtocolErr))
+	})
+
+	It("uses h2c with prior knowledge", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewH2CHandler(NewHandler()))
+		DeferCleanup(srv.Close)
+
+		httpClient, err := NewHTTPClient(ClientConfig{Protocol: H2C})
+		Expect(err).NotTo(HaveOccurred())
+		client := NewClient(srv.URL, httpClient, WithProtocol(H2C))
+
+		result, err := client.Check(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeSuccessful())
+		Expect(result.Protocol).To(Equal("HTTP/2.0"))
+		Expect(result.ServerProtocol).To(Equal("HTTP/2.0"))
+		Expect(client.ReplayChunked(ctx, source.New(1024*1024), 4096, 256)).To(BeSuccessful())
+
+		// The endpoint can be overridden
+		addr := srv.Listener.Addr().String()
+		_, port, _ := net.SplitHostPort(addr)
+		Expect(NewClient("http://localhost:"+port, httpClient, WithProtocol(H2C), WithEndpoint(addr)).Check(ctx)).To(BeSuccessful())
+	})
+
+	It("rejects h2c with https", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		Expect(H2C.ValidateURL("https://localhost")).To(MatchError(H2CSchemeErr))
+		Expect(H2C.ValidateURL("http+unix://%2Frun%2Fhttp.sock")).To(Succeed())
+		Expect(HTTP2.ValidateURL("https://localhost")).To(Succeed())
+
+		httpClient, err := NewHTTPClient(ClientConfig{Protocol: H2C})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := NewClient("https://localhost:1", httpClient).Check(ctx)
+		Expect(err).To(MatchError(H2CSchemeErr))
+		Expect(result.Failure).To(Equal(RequestFailure))
+	})
+
+	It("times out awaiting h2c response headers", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewH2CHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		})))
+		DeferCleanup(srv.Close)
+
+		httpClient, err := NewHTTPClient(ClientConfig{Protocol: H2C, ResponseTimeout: 100 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := NewClient(srv.URL, httpClient).Check(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(result.Failure).To(Equal(TimeoutFailure))
+
+		// Responses received in time may be read after the timeout
+		srv = httptest.NewServer(NewH2CHandler(NewHandler()))
+		DeferCleanup(srv.Close)
+		client := NewClient(srv.URL, httpClient, WithProtocol(H2C))
+		Expect(client.ReplayN(ctx, source.New(4*1024*1024), 4*1024*1024)).To(BeSuccessful())
+	})
+
+	Context("over TLS", func() {
+
+		var caFile string
+		serve := func(http2 bool) string {
+			ca, cert, err := NewSelfSignedCertificate("localhost", "127.0.0.1")
+			Expect(err).NotTo(HaveOccurred())
+			caFile = filepath.Join(GinkgoT().TempDir(), "ca.crt")
+			Expect(os.WriteFile(caFile, ca, 0600)).To(Succeed())
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			srv := &http.Server{
+				Handler:   NewHandler(),
+				TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+			}
+			if !http2 {
+				srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+			}
+			go func() {
+				defer GinkgoRecover()
+				Expect(srv.ServeTLS(listener, "", "")).To(MatchError(http.ErrServerClosed))
+			}()
+			DeferCleanup(srv.Shutdown)
+			return fmt.Sprintf("https://%s", listener.Addr())
+		}
+
+		newClient := func(server string, p Protocol) Client {
+			httpClient, err := NewHTTPClient(ClientConfig{CACertFile: caFile, Protocol: p})
+			Expect(err).NotTo(HaveOccurred())
+			return NewClient(server, httpClient, WithProtocol(p))
+		}
+
+		It("negotiates h2", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			server := serve(true)
+			result, err := newClient(server, HTTP2).Check(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Protocol).To(Equal("HTTP/2.0"))
+			Expect(result.ServerProtocol).To(Equal("HTTP/2.0"))
+		})
+
+		It("forces http/1.1", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			server := serve(true)
+			result, err := newClient(server, HTTP1).Check(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Protocol).To(Equal("HTTP/1.1"))
+		})
+
+		It("fails when h2 is downgraded", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			server := serve(false)
+			result, err := newClient(server, HTTP2).Check(ctx)
+			Expect(err).To(MatchError(ProtocolDowngradeErr))
+			Expect(result.Failure).To(Equal(ProtocolFailure))
+			Expect(result.Protocol).To(Equal("HTTP/1.1"))
+		})
+	})
+})
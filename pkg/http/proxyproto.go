@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var UnsupportedProxyPolicyErr = errors.New("proxy protocol must be one of optional or required")
+var ProxyHeaderMissingErr = errors.New("the connection did not begin with a PROXY protocol header")
+var ProxyHeaderInvalidErr = errors.New("the connection began with an invalid PROXY protocol header")
+
+// ProxyHeaderTimeout is how long the server waits to read a PROXY protocol header from a new connection.
+var ProxyHeaderTimeout = 10 * time.Second
+
+// ProxyPolicy determines whether a listener accepts HAProxy PROXY protocol (v1 or v2) headers, sent by load
+// balancers ahead of each connection to convey the address of the client they are proxying.
+type ProxyPolicy string
+
+const (
+	// ProxyIgnore does not accept PROXY protocol headers.
+	ProxyIgnore ProxyPolicy = ""
+
+	// ProxyOptional accepts connections with or without a PROXY protocol header.
+	ProxyOptional ProxyPolicy = "optional"
+
+	// ProxyRequired closes connections that do not begin with a PROXY protocol header.
+	ProxyRequired ProxyPolicy = "required"
+)
+
+// ParseProxyPolicy returns the ProxyPolicy named by s.
+func ParseProxyPolicy(s string) (ProxyPolicy, error) {
+	switch p := ProxyPolicy(s); p {
+	case ProxyIgnore, ProxyOptional, ProxyRequired:
+		return p, nil
+	default:
+		return p, UnsupportedProxyPolicyErr
+	}
+}
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Reasons a connection was rejected, and the versions of accepted headers ("none" if optional and absent).
+const (
+	proxyMissing = "missing"
+	proxyInvalid = "invalid"
+	proxyV1      = "v1"
+	proxyV2      = "v2"
+	proxyNone    = "none"
+)
+
+// AcceptProxyHeaders wraps ln so that the PROXY protocol header of each connection, if any, is read before
+// the request and the connection's RemoteAddr and LocalAddr are those of the proxied client and destination.
+// Headers are read when the connection is first used, so that slow proxies do not block accepting others.
+// If policy is ProxyIgnore, ln is returned.
+func AcceptProxyHeaders(ln net.Listener, policy ProxyPolicy) net.Listener {
+	if policy == ProxyIgnore {
+		return ln
+	}
+	return &proxyListener{Listener: ln, required: policy == ProxyRequired}
+}
+
+type proxyListener struct {
+	net.Listener
+	required bool
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), required: l.required}, nil
+}
+
+// proxyConn reads the PROXY protocol header of a connection once, when it is first read or its addresses are
+// requested. Read deadlines set by the server are restored once the header is read.
+type proxyConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	required bool
+
+	once        sync.Once
+	err         error
+	source      net.Addr
+	destination net.Addr
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.once.Do(c.readHeader); c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.once.Do(c.readHeader); c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.once.Do(c.readHeader); c.destination != nil {
+		return c.destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyConn) readHeader() {
+	logger := logger.Named("proxy").With(zap.String("proxyAddr", c.Conn.RemoteAddr().String()))
+
+	_ = c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		_ = c.Conn.SetReadDeadline(c.readDeadline)
+	}()
+
+	var version string
+	first, err := c.reader.Peek(1)
+	switch {
+	case err != nil:
+		// The error is returned by the first Read
+		return
+	case first[0] == proxyV1Prefix[0]:
+		if p, e := c.reader.Peek(len(proxyV1Prefix)); e == nil && string(p) == proxyV1Prefix {
+			version, err = proxyV1, c.readV1()
+		}
+	case first[0] == proxyV2Signature[0]:
+		if p, e := c.reader.Peek(len(proxyV2Signature)); e == nil && bytes.Equal(p, proxyV2Signature) {
+			version, err = proxyV2, c.readV2()
+		}
+	}
+
+	switch {
+	case err != nil:
+		logger.Warn("rejected connection with an invalid PROXY protocol header", zap.Error(err))
+		serverProxyErrors.WithLabelValues(proxyInvalid).Inc()
+		c.err = errors.Join(ProxyHeaderInvalidErr, err)
+	case version == "" && c.required:
+		logger.Warn("rejected connection without a PROXY protocol header")
+		serverProxyErrors.WithLabelValues(proxyMissing).Inc()
+		c.err = ProxyHeaderMissingErr
+	case version == "":
+		serverProxyHeaders.WithLabelValues(proxyNone).Inc()
+	default:
+		fields := []zap.Field{zap.String("version", version)}
+		if c.source != nil {
+			fields = append(fields, zap.String("clientAddr", c.source.String()), zap.String("destinationAddr", c.destination.String()))
+		}
+		logger.Debug("read PROXY protocol header", fields...)
+		serverProxyHeaders.WithLabelValues(version).Inc()
+	}
+}
+
+// readV1 reads a human-readable header (e.g., "PROXY TCP4 203.0.113.7 192.0.2.1 51234 443\r\n"). The
+// addresses of UNKNOWN connections are ignored.
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return errors.New("the header is not terminated by CRLF within 107 bytes")
+	}
+	fields := strings.Split(s, " ")
+	switch {
+	case len(fields) >= 2 && fields[1] == "UNKNOWN":
+		return nil
+	case len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6"):
+		return errors.New("the header must specify TCP4, TCP6, or UNKNOWN and the source and destination addresses")
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	if src.Addr().Is4() != (fields[1] == "TCP4") || dst.Addr().Is4() != (fields[1] == "TCP4") {
+		return errors.New("the addresses do not match the header's protocol")
+	}
+	c.source, c.destination = net.TCPAddrFromAddrPort(src), net.TCPAddrFromAddrPort(dst)
+	return nil
+}
+
+func parseV1Addr(ip string, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+// readV2 reads a binary header. The addresses of LOCAL connections (e.g., health checks made by the proxy
+// itself) and families other than TCP over IPv4 or IPv6 are ignored, as are TLVs.
+func (c *proxyConn) readV2() error {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	verCmd, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	if verCmd>>4 != 2 {
+		return errors.New("the header's version is not 2")
+	}
+	switch verCmd & 0x0F {
+	case 0x00: // LOCAL
+		return nil
+	case 0x01: // PROXY
+	default:
+		return errors.New("the header's command is neither LOCAL nor PROXY")
+	}
+
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = 4
+	case 0x21: // TCP over IPv6
+		size = 16
+	default:
+		return nil
+	}
+	if len(payload) < 2*size+4 {
+		return errors.New("the header is too short for its address family")
+	}
+	src, _ := netip.AddrFromSlice(payload[:size])
+	dst, _ := netip.AddrFromSlice(payload[size : 2*size])
+	ports := payload[2*size:]
+	c.source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(ports)))
+	c.destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(ports[2:])))
+	return nil
+}
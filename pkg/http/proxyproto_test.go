@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var _ = Describe("PROXY protocol", func() {
+
+	var srv *httptest.Server
+	serve := func(policy ProxyPolicy) {
+		srv = httptest.NewUnstartedServer(NewHandler())
+		srv.Listener = AcceptProxyHeaders(srv.Listener, policy)
+		startTestServer(srv)
+	}
+
+	// proxied returns an HTTP client that sends header ahead of each connection, as a load balancer would
+	proxied := func(header []byte) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err == nil {
+					_, err = conn.Write(header)
+				}
+				return conn, err
+			},
+		}}
+	}
+
+	v2 := func(src, dst [4]byte, sport, dport byte) []byte {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x21, 0x11, 0, 12)
+		header = append(header, src[:]...)
+		header = append(header, dst[:]...)
+		return append(header, 0, sport, 0, dport)
+	}
+
+	DescribeTable("parses proxy policies", func(s string, expected ProxyPolicy, valid bool) {
+		p, err := ParseProxyPolicy(s)
+		if valid {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p).To(Equal(expected))
+		} else {
+			Expect(err).To(MatchError(UnsupportedProxyPolicyErr))
+		}
+	},
+		Entry("ignore", "", ProxyIgnore, true),
+		Entry("optional", "optional", ProxyOptional, true),
+		Entry("required", "required", ProxyRequired, true),
+		Entry("unknown", "always", ProxyIgnore, false),
+	)
+
+	DescribeTable("returns the proxied client address", func(ctx context.Context, header []byte, clientAddr string) {
+		ctx = logging.NewContext(ctx, logger)
+		serve(ProxyRequired)
+		client := NewClient(srv.URL, proxied(header))
+		result, err := client.Check(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.ClientAddr).To(Equal(clientAddr))
+		Expect(client.ReplayN(ctx, source.New(1024), 1024)).To(BeSuccessful())
+	},
+		Entry("v1 TCP4", []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 80\r\n"), "203.0.113.7:51234"),
+		Entry("v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51234 80\r\n"), "[2001:db8::7]:51234"),
+		Entry("v2 TCP4", v2([4]byte{203, 0, 113, 7}, [4]byte{192, 0, 2, 1}, 200, 80), "203.0.113.7:200"),
+	)
+
+	It("uses the connection's address for UNKNOWN and LOCAL connections", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		serve(ProxyRequired)
+		local := append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0, 0)
+		for _, header := range [][]byte{[]byte("PROXY UNKNOWN\r\n"), local} {
+			result, err := NewClient(srv.URL, proxied(header)).Identify(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.ClientAddr).To(Equal(result.LocalAddr))
+		}
+	})
+
+	It("rejects connections with missing or invalid headers if required", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		serve(ProxyRequired)
+
+		missing := testutil.ToFloat64(serverProxyErrors.WithLabelValues(proxyMissing))
+		_, err := NewClient(srv.URL, &http.Client{}).Check(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(testutil.ToFloat64(serverProxyErrors.WithLabelValues(proxyMissing))).To(Equal(missing + 1))
+
+		invalid := testutil.ToFloat64(serverProxyErrors.WithLabelValues(proxyInvalid))
+		for _, header := range []string{"PROXY TCP4 203.0.113.7\r\n", "PROXY TCP4 2001:db8::7 192.0.2.1 1 2\r\n", "PROXY TCP4 203.0.113.7 192.0.2.1 1 2\n"} {
+			_, err = NewClient(srv.URL, proxied([]byte(header))).Check(ctx)
+			Expect(err).To(HaveOccurred())
+		}
+		Expect(testutil.ToFloat64(serverProxyErrors.WithLabelValues(proxyInvalid))).To(Equal(invalid + 3))
+	})
+
+	It("accepts connections without headers if optional", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		serve(ProxyOptional)
+		none := testutil.ToFloat64(serverProxyHeaders.WithLabelValues(proxyNone))
+		client := NewClient(srv.URL, &http.Client{}, WithPreservedSource())
+		Expect(client.Check(ctx)).To(BeSuccessful())
+		Expect(client.ReplayN(ctx, source.New(1024), 1024)).To(BeSuccessful())
+		Expect(testutil.ToFloat64(serverProxyHeaders.WithLabelValues(proxyNone))).To(BeNumerically(">", none))
+
+		result, err := NewClient(srv.URL, proxied([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 80\r\n"))).Check(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.ClientAddr).To(Equal("203.0.113.7:51234"))
+	})
+
+	Context("asserting the client's source", func() {
+
+		It("parses source prefixes", func() {
+			Expect(ParseSourcePrefix("203.0.113.7")).To(Equal(netip.MustParsePrefix("203.0.113.7/32")))
+			Expect(ParseSourcePrefix("10.1.2.3/8")).To(Equal(netip.MustParsePrefix("10.0.0.0/8")))
+			Expect(ParseSourcePrefix("2001:db8::/32")).To(Equal(netip.MustParsePrefix("2001:db8::/32")))
+			_, err := ParseSourcePrefix("10.0.0.0/33")
+			Expect(err).To(MatchError(InvalidSourcePrefixErr))
+			_, err = ParseSourcePrefix("localhost")
+			Expect(err).To(MatchError(InvalidSourcePrefixErr))
+		})
+
+		It("fails if the source was not preserved", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			serve(ProxyOptional)
+
+			result, err := NewClient(srv.URL, &http.Client{}, WithPreservedSource()).Identify(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.ClientAddr).To(Equal(result.LocalAddr))
+
+			// A proxy that rewrites the source, but within the expected prefix
+			rewritten := proxied([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 80\r\n"))
+			result, err = NewClient(srv.URL, rewritten, WithPreservedSource()).Check(ctx)
+			Expect(err).To(MatchError(SourceNotPreservedErr))
+			Expect(result.Failure).To(Equal(SourceFailure))
+			Expect(NewClient(srv.URL, rewritten, WithSourcePrefixes(netip.MustParsePrefix("203.0.113.0/24"))).Identify(ctx)).To(BeSuccessful())
+
+			_, err = NewClient(srv.URL, &http.Client{}, WithSourcePrefixes(netip.MustParsePrefix("203.0.113.0/24"))).Check(ctx)
+			Expect(err).To(MatchError(SourceNotPreservedErr))
+		})
+	})
+})
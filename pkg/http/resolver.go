@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var NoEndpointsErr = errors.New("the server name did not resolve to any endpoints")
+
+// Resolver looks up the endpoints of a server. It is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// ResolveEndpoints resolves the host of serverURL (e.g., a headless Service) to the address of each endpoint
+// behind it, sorted. A/AAAA records are used with the URL's port, unless srv is true, in which case the host
+// must be an SRV name (e.g., _http._tcp.my-svc.my-namespace.svc.cluster.local) and the ports are taken from
+// the SRV records.
+func ResolveEndpoints(ctx context.Context, resolver Resolver, serverURL string, srv bool) ([]string, error) {
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []string
+	if srv {
+		_, records, err := resolver.LookupSRV(ctx, "", "", u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			endpoints = append(endpoints, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+		}
+	} else {
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			endpoints = append(endpoints, net.JoinHostPort(a.String(), port))
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return nil, NoEndpointsErr
+	}
+	slices.Sort(endpoints)
+	return slices.Compact(endpoints), nil
+}
+
+// WithEndpoint dials addr for every request instead of the server URL's host. The URL is unchanged, so the
+// Host header and TLS server name still match the server. The client's http.Client must use an
+// *http.Transport (or the default), which is cloned, or an h2c transport built by NewHTTPClient.
+func WithEndpoint(addr string) ClientOption {
+	return endpointOption(addr)
+}
+
+type endpointOption string
+
+func (o endpointOption) apply(c *client) {
+	c.redial("", string(o), "WithEndpoint")
+	c.endpoint = string(o)
+}
+
+// redial dials addr for every request instead of the server URL's host, using network if set or the request's
+// network otherwise. The client's transport is replaced as described by WithEndpoint; caller names the
+// option that requires it if it cannot be.
+func (c *client) redial(network, addr, caller string) {
+
+	override := func(n string) string {
+		if network != "" {
+			return network
+		}
+		return n
+	}
+
+	httpClient := *c.http
+	switch t := c.http.Transport.(type) {
+	case nil, *http.Transport:
+		var transport *http.Transport
+		if t == nil {
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+		} else {
+			transport = t.(*http.Transport).Clone()
+		}
+		dial := transport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+		}
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, n, _ string) (net.Conn, error) {
+			return dial(ctx, override(n), addr)
+		}
+		httpClient.Transport = transport
+	case *h2cTransport:
+		httpClient.Transport = t.withDial(func(ctx context.Context, n, _ string) (net.Conn, error) {
+			return t.dial(ctx, override(n), addr)
+		})
+	default:
+		panic(caller + " requires an *http.Transport or h2c transport")
+	}
+
+	c.http = &httpClient
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+// fakeResolver is a Resolver that answers from static records.
+type fakeResolver struct {
+	ips map[string][]net.IPAddr
+	srv map[string][]*net.SRV
+}
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := r.ips[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	if srv, ok := r.srv[name]; ok {
+		return name, srv, nil
+	}
+	return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+var _ = Describe("ResolveEndpoints", func() {
+
+	resolver := fakeResolver{
+		ips: map[string][]net.IPAddr{
+			"headless.test": {{IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("fd00::1")}},
+			"empty.test":    {},
+		},
+		srv: map[string][]*net.SRV{
+			"_http._tcp.headless.test": {{Target: "pod-1.headless.test.", Port: 8080}, {Target: "pod-0.headless.test.", Port: 8080}},
+		},
+	}
+
+	It("resolves A and AAAA records", func(ctx context.Context) {
+		Expect(ResolveEndpoints(ctx, resolver, "http://headless.test:8080", false)).
+			To(Equal([]string{"10.0.0.1:8080", "10.0.0.2:8080", "[fd00::1]:8080"}))
+		Expect(ResolveEndpoints(ctx, resolver, "https://headless.test", false)).
+			To(Equal([]string{"10.0.0.1:443", "10.0.0.2:443", "[fd00::1]:443"}))
+	})
+
+	It("resolves SRV records", func(ctx context.Context) {
+		Expect(ResolveEndpoints(ctx, resolver, "http://_http._tcp.headless.test", true)).
+			To(Equal([]string{"pod-0.headless.test:8080", "pod-1.headless.test:8080"}))
+	})
+
+	It("fails without endpoints", func(ctx context.Context) {
+		_, err := ResolveEndpoints(ctx, resolver, "http://empty.test", false)
+		Expect(err).To(MatchError(NoEndpointsErr))
+		_, err = ResolveEndpoints(ctx, resolver, "http://missing.test", false)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("panics redialing a transport it cannot clone", func() {
+		httpClient := &http.Client{Transport: http.NewFileTransport(http.Dir("."))}
+		Expect(func() {
+			NewClient("http://headless.test", httpClient, WithEndpoint("127.0.0.1:8080"))
+		}).To(PanicWith(ContainSubstring("WithEndpoint")))
+	})
+
+	It("checks each endpoint with the original host", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+
+		var mu sync.Mutex
+		var hosts []string
+		servers := make([]*httptest.Server, 2)
+		for i := range servers {
+			handler := NewHandler()
+			servers[i] = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				hosts = append(hosts, req.Host)
+				mu.Unlock()
+				handler.ServeHTTP(res, req)
+			}))
+			DeferCleanup(servers[i].Close)
+		}
+
+		// The name resolves to the first server; the second listens on another port, so it is added directly
+		resolver := fakeResolver{ips: map[string][]net.IPAddr{"headless.test": {{IP: net.ParseIP("127.0.0.1")}}}}
+		_, port, _ := net.SplitHostPort(servers[0].Listener.Addr().String())
+		serverURL := fmt.Sprintf("http://headless.test:%s", port)
+		endpoints, err := ResolveEndpoints(ctx, resolver, serverURL, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(endpoints).To(Equal([]string{servers[0].Listener.Addr().String()}))
+		endpoints = append(endpoints, servers[1].Listener.Addr().String())
+
+		for _, endpoint := range endpoints {
+			Expect(NewClient(serverURL, http.DefaultClient, WithEndpoint(endpoint)).Check(ctx)).To(BeSuccessful())
+		}
+		Expect(hosts).To(Equal([]string{"headless.test:" + port, "headless.test:" + port}))
+	})
+})
@@ -0,0 +1,446 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptrace"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// FailureCategory describes why a Client request was unsuccessful.
+type FailureCategory string
+
+const (
+	NoFailure         FailureCategory = ""
+	RequestFailure    FailureCategory = "request"
+	CanceledFailure   FailureCategory = "canceled"
+	TimeoutFailure    FailureCategory = "timeout"
+	RefusedFailure    FailureCategory = "refused"
+	ResetFailure      FailureCategory = "reset"
+	ConnectionFailure FailureCategory = "connection"
+	TLSFailure        FailureCategory = "tls"
+	IdentityFailure   FailureCategory = "identity"
+	ProtocolFailure   FailureCategory = "protocol"
+	StatusFailure     FailureCategory = "status"
+	HeaderFailure     FailureCategory = "header"
+	BodyFailure       FailureCategory = "body"
+	LengthFailure     FailureCategory = "length"
+	DigestFailure     FailureCategory = "digest"
+	LatencyFailure    FailureCategory = "latency"
+	SourceFailure     FailureCategory = "source"
+
+	// ClosedFailure is a stream that was cleanly closed before it was expected to end, as opposed to
+	// ResetFailure.
+	ClosedFailure FailureCategory = "closed"
+
+	// ConnectTimeoutFailure is a timeout while establishing the connection, as opposed to TimeoutFailure,
+	// which occurs once connected (e.g., waiting for the response).
+	ConnectTimeoutFailure FailureCategory = "connect-timeout"
+)
+
+// Denied is true if the category may indicate the server could not be reached because the connection was
+// refused, reset, or timed out while connecting, as happens when a NetworkPolicy or firewall blocks it. Since
+// a connection may also be reset once the server was reached, Result.Denied should be used to decide.
+func (f FailureCategory) Denied() bool {
+	switch f {
+	case RefusedFailure, ResetFailure, ConnectTimeoutFailure:
+		return true
+	default:
+		return false
+	}
+}
+
+// FailureCategories are all categories other than NoFailure.
+var FailureCategories = []FailureCategory{
+	RequestFailure,
+	CanceledFailure,
+	TimeoutFailure,
+	ConnectTimeoutFailure,
+	RefusedFailure,
+	ResetFailure,
+	ConnectionFailure,
+	TLSFailure,
+	IdentityFailure,
+	ProtocolFailure,
+	StatusFailure,
+	HeaderFailure,
+	BodyFailure,
+	LengthFailure,
+	DigestFailure,
+	LatencyFailure,
+	SourceFailure,
+	ClosedFailure,
+}
+
+// classifyError returns the FailureCategory of an error returned while sending a request or reading its
+// response.
+func classifyError(err error) FailureCategory {
+
+	var netErr net.Error
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+
+	switch {
+	case err == nil:
+		return NoFailure
+	case errors.Is(err, H2CSchemeErr):
+		return RequestFailure
+	case errors.Is(err, context.Canceled):
+		return CanceledFailure
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return ConnectTimeoutFailure
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return TimeoutFailure
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return TimeoutFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return RefusedFailure
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrUnexpectedEOF):
+		return ResetFailure
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr):
+		return TLSFailure
+	default:
+		return ConnectionFailure
+	}
+}
+
+// classifyBodyError returns the FailureCategory of an error reading a response body once its headers were
+// received. A body cut short by a reset connection, or that ended unexpectedly, was truncated, which is a
+// LengthFailure rather than a ResetFailure.
+func classifyBodyError(err error) FailureCategory {
+	if f := classifyError(err); f != ResetFailure {
+		return f
+	}
+	return LengthFailure
+}
+
+// Result is the outcome of a Client request.
+type Result struct {
+
+	// OK is true if the request was successful.
+	OK bool
+
+	// Failure describes why the request was unsuccessful. It is NoFailure if OK is true.
+	Failure FailureCategory
+
+	// RequestID identifies the request in the server's logs.
+	RequestID string
+
+	// StatusCode is the HTTP status code of the response, or zero if no response was received.
+	StatusCode int
+
+	// Protocol is the protocol of the response (e.g., HTTP/2.0), and ServerProtocol is the protocol of the
+	// request as observed by the server. They differ if a proxy changed the protocol.
+	Protocol       string
+	ServerProtocol string
+
+	// BytesSent is the number of request body bytes sent.
+	BytesSent int64
+
+	// BytesReceived is the number of response body bytes received.
+	BytesReceived int64
+
+	// WireBytesSent and WireBytesReceived are the number of replay request and response body bytes as sent
+	// and received on the wire. They differ from BytesSent and BytesReceived, which are uncompressed, if the
+	// bodies were compressed.
+	WireBytesSent     int64
+	WireBytesReceived int64
+
+	// ExpectedDigest and ActualDigest are the digests of the expected and actual response bodies, if the
+	// response body was validated using a digest.
+	ExpectedDigest string
+	ActualDigest   string
+
+	// Peer is the client certificate identity verified by the server, if any.
+	Peer *PeerIdentity
+
+	// LocalAddr is the client's address of the connection used for the request, and ClientAddr is the client
+	// address observed by the server. They differ if the client's address was not preserved by a proxy.
+	LocalAddr  string
+	ClientAddr string
+
+	// Headers reports how each header sent by a Headers request, and each added, arrived at the server.
+	Headers []HeaderDiff
+
+	// Backend is the identity of the server instance that responded to an Identify request.
+	Backend *BackendIdentity
+
+	// Timings are the phase timings of the request.
+	Timings Timings
+
+	// Upgrade is the time taken to connect and upgrade to a WebSocket, and RoundTrips are the round-trip times
+	// of each WebSocket message, in the order they were sent.
+	Upgrade    time.Duration
+	RoundTrips []time.Duration
+
+	// Lasted is how long a held stream lasted after its response headers were received.
+	Lasted time.Duration
+
+	// Transfer is the time taken to transfer the body of a download or upload.
+	Transfer time.Duration
+}
+
+// Throughput is the rate at which the body of a download or upload was transferred in bytes/sec, based on
+// the larger of BytesSent and BytesReceived.
+func (r Result) Throughput() float64 {
+	if r.Transfer <= 0 {
+		return 0
+	}
+	return float64(max(r.BytesSent, r.BytesReceived)) / r.Transfer.Seconds()
+}
+
+// RoundTripPercentile returns the nearest-rank percentile of RoundTrips, where p is between 0 and 1.
+func (r Result) RoundTripPercentile(p float64) time.Duration {
+	sorted := slices.Clone(r.RoundTrips)
+	slices.Sort(sorted)
+	return percentile(sorted, p)
+}
+
+// Denied is true if the server could not be reached: no response was received, and the connection was refused,
+// timed out while connecting, or was reset before it was established (including its TLS handshake). A
+// connection reset once established means the server, or a proxy in front of it, was reached.
+func (r Result) Denied() bool {
+	if r.StatusCode != 0 || !r.Failure.Denied() {
+		return false
+	}
+	return r.Failure != ResetFailure || !r.Timings.Connected
+}
+
+// fail sets the Failure category, returning err for convenience.
+func (r *Result) fail(category FailureCategory, err error) error {
+	r.OK = false
+	r.Failure = category
+	return err
+}
+
+func (r Result) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddBool("ok", r.OK)
+	if r.Failure != NoFailure {
+		enc.AddString("failure", string(r.Failure))
+	}
+	if r.RequestID != "" {
+		enc.AddString("requestId", r.RequestID)
+	}
+	enc.AddInt("statusCode", r.StatusCode)
+	if r.Protocol != "" {
+		enc.AddString("protocol", r.Protocol)
+		enc.AddString("serverProtocol", r.ServerProtocol)
+	}
+	enc.AddInt64("bytesSent", r.BytesSent)
+	enc.AddInt64("bytesReceived", r.BytesReceived)
+	if r.WireBytesSent != r.BytesSent || r.WireBytesReceived != r.BytesReceived {
+		enc.AddInt64("wireBytesSent", r.WireBytesSent)
+		enc.AddInt64("wireBytesReceived", r.WireBytesReceived)
+	}
+	if r.ClientAddr != "" {
+		enc.AddString("localAddr", r.LocalAddr)
+		enc.AddString("clientAddr", r.ClientAddr)
+	}
+	if r.Backend != nil {
+		enc.AddString("backend", r.Backend.String())
+	}
+	if r.ActualDigest != "" {
+		enc.AddString("expectedDigest", r.ExpectedDigest)
+		enc.AddString("actualDigest", r.ActualDigest)
+	}
+	if r.Upgrade > 0 {
+		enc.AddDuration("upgrade", r.Upgrade)
+	}
+	if r.Lasted > 0 {
+		enc.AddDuration("lasted", r.Lasted)
+	}
+	if r.Transfer > 0 {
+		enc.AddDuration("transfer", r.Transfer)
+		enc.AddFloat64("throughput", r.Throughput())
+	}
+	return enc.AddObject("timings", r.Timings)
+}
+
+// Timings are the durations of each phase of an HTTP request. Phases that did not occur (e.g., DNS and
+// Connect when a connection is reused) are zero.
+type Timings struct {
+
+	// DNS is the time spent resolving the server's address.
+	DNS time.Duration
+
+	// Connect is the time spent establishing the TCP connection.
+	Connect time.Duration
+
+	// TLSHandshake is the time spent performing the TLS handshake.
+	TLSHandshake time.Duration
+
+	// TTFB is the time from the request headers being written to the first byte of the response, which
+	// approximates the time spent by the server (and any intermediaries).
+	TTFB time.Duration
+
+	// Total is the time from the start of the request until the response was read.
+	Total time.Duration
+
+	// Reused is true if the request used an existing connection.
+	Reused bool
+
+	// Connected is true if a connection was established for the request, including its TLS handshake.
+	Connected bool
+}
+
+// Phases returns the named phase timings, excluding Total.
+func (t Timings) Phases() map[string]time.Duration {
+	return map[string]time.Duration{
+		"dns":     t.DNS,
+		"connect": t.Connect,
+		"tls":     t.TLSHandshake,
+		"ttfb":    t.TTFB,
+	}
+}
+
+func (t Timings) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddDuration("dns", t.DNS)
+	enc.AddDuration("connect", t.Connect)
+	enc.AddDuration("tls", t.TLSHandshake)
+	enc.AddDuration("ttfb", t.TTFB)
+	enc.AddDuration("total", t.Total)
+	enc.AddBool("reused", t.Reused)
+	return nil
+}
+
+// tracer records Timings using an httptrace.ClientTrace. Trace hooks may be called concurrently, so
+// access is synchronized.
+type tracer struct {
+	mu      sync.Mutex
+	start   time.Time
+	timings Timings
+
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wroteHeaders time.Time
+	localAddr    string
+}
+
+// newTracer returns a context that records the timings of requests made with it.
+func newTracer(ctx context.Context) (context.Context, *tracer) {
+	t := &tracer{start: time.Now()}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(_ httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(_ httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.DNS = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(_, _ string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err == nil && t.timings.Connect == 0 {
+				t.timings.Connect = time.Since(t.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, _ error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.TLSHandshake = time.Since(t.tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.Reused = info.Reused
+			t.timings.Connected = true
+			if info.Conn != nil {
+				t.localAddr = info.Conn.LocalAddr().String()
+			}
+		},
+		WroteHeaders: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.wroteHeaders = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if !t.wroteHeaders.IsZero() {
+				t.timings.TTFB = time.Since(t.wroteHeaders)
+			}
+		},
+	}), t
+}
+
+// Timings returns the recorded timings with Total set to the time elapsed since the tracer was created.
+func (t *tracer) Timings() Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timings := t.timings
+	timings.Total = time.Since(t.start)
+	return timings
+}
+
+// LocalAddr returns the client's address of the connection used for the request, or "" if none was obtained.
+func (t *tracer) LocalAddr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.localAddr
+}
+
+// sinceWroteHeaders returns the time elapsed since the request headers were written, or zero if they were not.
+func (t *tracer) sinceWroteHeaders() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.wroteHeaders.IsZero() {
+		return 0
+	}
+	return time.Since(t.wroteHeaders)
+}
+
+// done records the total time and logs the timings.
+func (t *tracer) done(logger *zap.Logger) Timings {
+	timings := t.Timings()
+	logger.Debug("request timings", zap.Object("timings", timings))
+	return timings
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+var _ = Describe("Failures", func() {
+
+	DescribeTable("are classified", func(err error, expected FailureCategory, denied bool) {
+		Expect(classifyError(err)).To(Equal(expected))
+		Expect(expected.Denied()).To(Equal(denied))
+	},
+		Entry("none", nil, NoFailure, false),
+		Entry("canceled", fmt.Errorf("wrapped: %w", context.Canceled), CanceledFailure, false),
+		Entry("deadline", fmt.Errorf("wrapped: %w", context.DeadlineExceeded), TimeoutFailure, false),
+		Entry("connect timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, ConnectTimeoutFailure, true),
+		Entry("read timeout", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, TimeoutFailure, false),
+		Entry("refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, RefusedFailure, true),
+		Entry("reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, ResetFailure, true),
+		Entry("unexpected EOF", io.ErrUnexpectedEOF, ResetFailure, true),
+		Entry("other", errors.New("something else"), ConnectionFailure, false),
+	)
+
+	DescribeTable("are classified when reading bodies", func(err error, expected FailureCategory) {
+		Expect(classifyBodyError(err)).To(Equal(expected))
+	},
+		Entry("unexpected EOF", io.ErrUnexpectedEOF, LengthFailure),
+		Entry("reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, LengthFailure),
+		Entry("read timeout", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, TimeoutFailure),
+		Entry("canceled", context.Canceled, CanceledFailure),
+	)
+
+	Context("when connections are reset", func() {
+
+		var serverURL string
+
+		BeforeEach(func() {
+			// Accept connections and reset them without responding
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(listener.Close)
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					_ = conn.(*net.TCPConn).SetLinger(0)
+					time.Sleep(10 * time.Millisecond)
+					_ = conn.Close()
+				}
+			}()
+			serverURL = listener.Addr().String()
+		})
+
+		It("are denied during the TLS handshake", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+			result, err := NewClient("https://"+serverURL, httpClient).Check(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(result.Failure).To(Equal(ResetFailure))
+			Expect(result.Timings.Connected).To(BeFalse())
+			Expect(result.Denied()).To(BeTrue())
+		})
+
+		It("are not denied once connected", func(ctx context.Context) {
+			ctx = logging.NewContext(ctx, logger)
+			result, err := NewClient("http://"+serverURL, http.DefaultClient).Check(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(result.Failure.Denied()).To(BeTrue(), "unexpected failure %q", result.Failure)
+			Expect(result.Timings.Connected).To(BeTrue())
+			Expect(result.Denied()).To(BeFalse())
+		})
+	})
+
+	It("are not denied once a response is received", func() {
+		Expect(Result{Failure: RefusedFailure}.Denied()).To(BeTrue())
+		Expect(Result{Failure: ResetFailure, StatusCode: http.StatusOK}.Denied()).To(BeFalse())
+		Expect(Result{Failure: ConnectTimeoutFailure, StatusCode: http.StatusOK}.Denied()).To(BeFalse())
+	})
+
+	It("distinguishes response timeouts", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+
+		srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		DeferCleanup(srv.Close)
+
+		httpClient, err := NewHTTPClient(ClientConfig{ConnectTimeout: time.Second, ResponseTimeout: 100 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := NewClient(srv.URL, httpClient).Check(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(result.Failure).To(Equal(TimeoutFailure))
+		Expect(result.Denied()).To(BeFalse())
+	})
+})
@@ -19,9 +19,12 @@ package http
 
 import (
 	"bytes"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"go.uber.org/zap"
 )
@@ -30,25 +33,117 @@ const (
 	micCheck      = "Mic check. One two. One two."
 	contentType   = "Content-Type"
 	contentLength = "Content-Length"
-)
 
-var (
-	MaxReplayRequestSize int64 = 128 * 1024 * 1024 // 128 MiB
+	transferEncoding = "Transfer-Encoding"
+
+	ClientSubjectHeader = "X-Konfirm-Client-Subject"
+	ClientSANsHeader    = "X-Konfirm-Client-SANs"
+
+	// ClientAddrHeader is the response header in which the server returns the client address it observed,
+	// which is the address conveyed by a load balancer's PROXY protocol header if one was accepted.
+	ClientAddrHeader = "X-Konfirm-Client-Addr"
 )
 
-func NewHandler() http.Handler {
+var MaxReplayRequestSize int64 = 128 * 1024 * 1024 // 128 MiB
+
+const replayBufferSize = 32 * 1024 // 32 KiB
+
+// HandlerOption configures the handler returned by NewHandler.
+type HandlerOption interface {
+	apply(*handlerConfig)
+}
+
+type handlerConfig struct {
+	faults        FaultConfig
+	replayLimits  ReplayLimits
+	streamReplays bool
+	timeouts      Timeouts
+	auth          Credentials
+}
+
+// WithStreamedReplays causes replay requests to be echoed as they are received rather than buffered. Streamed
+// replays use constant memory and are not limited by MaxReplayRequestSize.
+func WithStreamedReplays() HandlerOption {
+	return streamedReplaysOption{}
+}
+
+type streamedReplaysOption struct{}
+
+func (streamedReplaysOption) apply(h *handlerConfig) {
+	h.streamReplays = true
+}
+
+func NewHandler(opts ...HandlerOption) http.Handler {
+
+	var cfg handlerConfig
+	for _, o := range opts {
+		o.apply(&cfg)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/check", check)
-	mux.HandleFunc("/replay", replay)
-	return mux
+	replayHandler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		replay(res, req, cfg.streamReplays)
+	})
+	if cfg.replayLimits.Enabled() {
+		mux.Handle("/replay", limitReplays(replayHandler, cfg.replayLimits, cfg.streamReplays))
+	} else {
+		mux.Handle("/replay", replayHandler)
+	}
+	mux.HandleFunc("/identity", identity)
+	mux.HandleFunc("/websocket", echoWebSocket)
+	mux.HandleFunc("/hold", hold)
+	mux.HandleFunc("/download", download)
+	mux.HandleFunc("/upload", upload)
+	mux.HandleFunc("/headers", echoHeaders)
+
+	var handler http.Handler = mux
+	if cfg.timeouts != (Timeouts{}) {
+		handler = enforceTimeouts(mux, handler, cfg.timeouts)
+	}
+	if cfg.faults.Enabled() {
+		handler = injectFaults(handler, cfg.faults)
+	}
+	if cfg.auth.Enabled() {
+		handler = authenticate(handler, cfg.auth)
+	}
+	return correlateRequests(instrument(mux, observeProtocol(handler)))
 }
 
 func logRequest(logger *zap.Logger, req *http.Request) {
 	logger.Info("new request", zap.String("clientAddr", req.RemoteAddr), zap.String("method", req.Method), zap.String("uri", req.RequestURI))
 }
 
+// identifyClient returns the client's address, as observed by the server, and its verified client certificate
+// identity (if any) to the client in the response headers. The identity is also logged.
+func identifyClient(logger *zap.Logger, res http.ResponseWriter, req *http.Request) {
+	res.Header().Set(ClientAddrHeader, req.RemoteAddr)
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	subject, sans := cert.Subject.String(), subjectAltNames(cert)
+	logger.Info("verified client certificate", zap.String("subject", subject), zap.Strings("sans", sans))
+	res.Header().Set(ClientSubjectHeader, subject)
+	if len(sans) > 0 {
+		res.Header().Set(ClientSANsHeader, strings.Join(sans, ","))
+	}
+}
+
+func subjectAltNames(cert *x509.Certificate) (sans []string) {
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return
+}
+
 func check(res http.ResponseWriter, req *http.Request) {
-	logger := logger.Named("server").With(zap.String("handler", "mic"))
+	logger := requestLogger(req).With(zap.String("handler", "mic"))
 	logRequest(logger, req)
 
 	// Only support GET requests
@@ -57,6 +152,7 @@ func check(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	identifyClient(logger, res, req)
 	output := []byte(micCheck)
 
 	headers := res.Header()
@@ -74,9 +170,9 @@ func check(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func replay(res http.ResponseWriter, req *http.Request) {
+func replay(res http.ResponseWriter, req *http.Request, stream bool) {
 
-	logger := logger.Named("server").With(zap.String("handler", "replay"))
+	logger := requestLogger(req).With(zap.String("handler", "replay"))
 	logRequest(logger, req)
 
 	// Only support POST requests
@@ -86,28 +182,70 @@ func replay(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Decode the request body and select the response's encoding
+	encoding, ok := negotiateEncodings(logger, res, req)
+	if !ok {
+		return
+	}
+
+	if stream {
+		streamReplay(logger, res, req, encoding)
+		return
+	}
+
 	// Request size must not exceed MaxReplayRequestSize
 	if m := MaxReplayRequestSize; req.ContentLength > m {
 		logger.Warn("request size exceeds maximum", zap.Int64("size", req.ContentLength), zap.Int64("maxSize", m))
+		serverTooLarge.WithLabelValues("replay").Inc()
 		res.WriteHeader(http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	// Write request body into buffer
+	// Write request body into buffer; requests with an unknown length (i.e., chunked) are read until they
+	// exceed MaxReplayRequestSize
+	limit := req.ContentLength
+	if limit < 0 {
+		limit = MaxReplayRequestSize + 1
+	}
 	buf := &bytes.Buffer{}
-	if n, err := buf.ReadFrom(io.LimitReader(req.Body, req.ContentLength)); err != nil {
+	if n, err := buf.ReadFrom(io.LimitReader(req.Body, limit)); err != nil {
 		logger.Error("error reading request body", zap.Error(err))
+		serverReplayErrors.WithLabelValues(replayReadError).Inc()
 		res.WriteHeader(http.StatusInternalServerError)
 		return
-	} else if n != req.ContentLength {
+	} else if req.ContentLength < 0 && n > MaxReplayRequestSize {
+		logger.Warn("chunked request size exceeds maximum", zap.Int64("maxSize", MaxReplayRequestSize))
+		serverTooLarge.WithLabelValues("replay").Inc()
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	} else if req.ContentLength >= 0 && n != req.ContentLength {
 		logger.Error("request content did not match expected size", zap.Int64("size", n), zap.Int64("expected", req.ContentLength))
+		serverReplayErrors.WithLabelValues(replayLengthError).Inc()
 		res.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Set Content-Type and Content-Length response headers
+	// Compress the response body if the client accepts an encoding, so that its length is still known
+	length := req.ContentLength
+	if encoding != IdentityEncoding {
+		encoded := &bytes.Buffer{}
+		enc := encoding.encoder(encoded)
+		_, err := io.Copy(enc, buf)
+		if err = errors.Join(err, enc.Close()); err != nil {
+			logger.Error("error encoding response body", zap.Error(err))
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		buf = encoded
+		if length >= 0 {
+			length = int64(buf.Len())
+		}
+	}
+
+	// Set Content-Type and Content-Length (or Transfer-Encoding) response headers
+	identifyClient(logger, res, req)
 	headers := res.Header()
-	headers.Set(contentLength, fmt.Sprintf("%d", req.ContentLength))
+	setReplayLength(headers, req, length)
 	if ct := req.Header.Get(contentType); ct != "" {
 		headers.Set(contentType, ct)
 	}
@@ -115,7 +253,102 @@ func replay(res http.ResponseWriter, req *http.Request) {
 	// Write the response body
 	if _, err := io.Copy(res, buf); err != nil {
 		logger.Error("error writing response body", zap.Error(err))
+		serverReplayErrors.WithLabelValues(replayWriteError).Inc()
 	} else {
 		logger.Info("response sent successfully")
 	}
 }
+
+// setReplayLength mirrors the request's framing in the response: a Content-Length of length if it is known,
+// otherwise chunked transfer-encoding (HTTP/1.1 only; HTTP/2 has no transfer-encoding).
+func setReplayLength(headers http.Header, req *http.Request, length int64) {
+	if length >= 0 {
+		headers.Set(contentLength, fmt.Sprintf("%d", length))
+	} else if req.ProtoMajor == 1 && req.ProtoAtLeast(1, 1) {
+		headers.Set(transferEncoding, "chunked")
+	}
+}
+
+// streamReplay echoes the request body as it is received using a full-duplex connection. Encoded responses
+// are flushed after each read, and have no Content-Length.
+func streamReplay(logger *zap.Logger, res http.ResponseWriter, req *http.Request, encoding Encoding) {
+
+	logger = logger.With(zap.Bool("streaming", true))
+	ctrl := http.NewResponseController(res)
+
+	// HTTP/1.1 requires full-duplex to be explicitly enabled; HTTP/2 is always full-duplex
+	if err := ctrl.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Warn("unable to enable full-duplex", zap.Error(err))
+	}
+
+	var w io.Writer = res
+	var enc encodeWriter
+	length := req.ContentLength
+	if encoding != IdentityEncoding {
+		enc = encoding.encoder(res)
+		w, length = enc, -1
+	}
+	flush := func() error {
+		if enc != nil {
+			if err := enc.Flush(); err != nil {
+				return err
+			}
+		}
+		return ctrl.Flush()
+	}
+
+	// Set Content-Type and Content-Length response headers, then send them immediately
+	identifyClient(logger, res, req)
+	headers := res.Header()
+	setReplayLength(headers, req, length)
+	if ct := req.Header.Get(contentType); ct != "" {
+		headers.Set(contentType, ct)
+	}
+	res.WriteHeader(http.StatusOK)
+	if err := ctrl.Flush(); err != nil {
+		logger.Error("error sending response headers", zap.Error(err))
+		return
+	}
+
+	// Echo each read as it arrives
+	var total int64
+	buf := make([]byte, replayBufferSize)
+	for {
+		n, rerr := req.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				logger.Error("error writing response body", zap.Error(err), zap.Int64("bytes", total))
+				serverReplayErrors.WithLabelValues(replayWriteError).Inc()
+				return
+			}
+			if err := flush(); err != nil {
+				logger.Error("error flushing response body", zap.Error(err), zap.Int64("bytes", total))
+				serverReplayErrors.WithLabelValues(replayWriteError).Inc()
+				return
+			}
+			total += int64(n)
+		}
+		if errors.Is(rerr, io.EOF) {
+			break
+		} else if rerr != nil {
+			logger.Error("error reading request body", zap.Error(rerr), zap.Int64("bytes", total))
+			serverReplayErrors.WithLabelValues(replayReadError).Inc()
+			return
+		}
+	}
+
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			logger.Error("error writing response body", zap.Error(err), zap.Int64("bytes", total))
+			serverReplayErrors.WithLabelValues(replayWriteError).Inc()
+			return
+		}
+	}
+
+	if req.ContentLength >= 0 && total != req.ContentLength {
+		logger.Error("request content did not match expected size", zap.Int64("size", total), zap.Int64("expected", req.ContentLength))
+		serverReplayErrors.WithLabelValues(replayLengthError).Inc()
+	} else {
+		logger.Info("response sent successfully", zap.Int64("bytes", total))
+	}
+}
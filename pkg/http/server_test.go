@@ -19,6 +19,7 @@ package http
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -66,4 +67,52 @@ var _ = Describe("Handlers", func() {
 		Expect(err).NotTo(HaveOccurred())
 		Expect(body[5242816:]).To(Equal(seed)) // The last 64 bytes should equal the seed value
 	})
+
+	It("POST /replay (streaming)", func() {
+
+		server := NewHandler(WithStreamedReplays())
+		body := bytes.Repeat([]byte("All work and no play makes Jack a dull boy. 1337 1337 1337 1337\n"), 81920)
+		req := httptest.NewRequest(http.MethodPost, "/replay", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		res := rec.Result()
+
+		Expect(res).To(HaveHTTPStatus(http.StatusOK))
+		Expect(res).To(HaveHTTPHeaderWithValue("Content-Length", "5242880"))
+		Expect(rec.Flushed).To(BeTrue())
+		Expect(io.ReadAll(res.Body)).To(Equal(body))
+	})
+
+	It("POST /replay (chunked)", func() {
+
+		body := bytes.Repeat([]byte("All work and no play makes Jack a dull boy. 1337 1337 1337 1337\n"), 1024)
+		req := httptest.NewRequest(http.MethodPost, "/replay", bytes.NewBuffer(body))
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		res := rec.Result()
+
+		Expect(res).To(HaveHTTPStatus(http.StatusOK))
+		Expect(res).NotTo(HaveHTTPHeaderWithValue("Content-Length", Not(BeEmpty())))
+		Expect(res).To(HaveHTTPHeaderWithValue("Transfer-Encoding", "chunked"))
+		Expect(io.ReadAll(res.Body)).To(Equal(body))
+	})
+
+	It("GET /identity", func() {
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", "/identity", nil))
+		res := rec.Result()
+
+		Expect(res).To(HaveHTTPStatus(http.StatusOK))
+		Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", "application/json"))
+		var id BackendIdentity
+		Expect(json.NewDecoder(res.Body).Decode(&id)).To(Succeed())
+		Expect(id).To(Equal(Identity))
+		Expect(id.Pod).NotTo(BeEmpty())
+		Expect(id.StartupID).NotTo(BeEmpty())
+	})
 })
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var InvalidSourcePrefixErr = errors.New("source prefixes must be formatted as an IP address or CIDR (e.g., 203.0.113.7 or 10.0.0.0/8)")
+var SourceNotPreservedErr = errors.New("the client address observed by the server was not preserved")
+
+// ParseSourcePrefix parses an IP address, which matches only itself, or a CIDR.
+func ParseSourcePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			return p.Masked(), nil
+		}
+	} else if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.Prefix{}, InvalidSourcePrefixErr
+}
+
+type sourceAssertion struct {
+	preserved bool
+	prefixes  []netip.Prefix
+}
+
+func (a sourceAssertion) enabled() bool {
+	return a.preserved || len(a.prefixes) > 0
+}
+
+// WithPreservedSource requires the client address observed by the server (e.g., behind a load balancer that
+// sends PROXY protocol headers) to be the client's own address. Check and Identify requests for which it was
+// not fail with SourceNotPreservedErr. If the client's egress is itself translated, use WithSourcePrefixes.
+func WithPreservedSource() ClientOption {
+	return preservedSourceOption{}
+}
+
+type preservedSourceOption struct{}
+
+func (o preservedSourceOption) apply(c *client) {
+	c.source.preserved = true
+}
+
+// WithSourcePrefixes requires the client address observed by the server to be within one of prefixes. Check
+// and Identify requests for which it is not fail with SourceNotPreservedErr.
+func WithSourcePrefixes(prefixes ...netip.Prefix) ClientOption {
+	return sourcePrefixesOption(prefixes)
+}
+
+type sourcePrefixesOption []netip.Prefix
+
+func (o sourcePrefixesOption) apply(c *client) {
+	c.source.prefixes = append(c.source.prefixes, o...)
+}
+
+// verifySource records the client address observed by the server and, if asserted, verifies it was preserved.
+func (c *client) verifySource(logger *zap.Logger, res *http.Response, trace *tracer, result *Result) error {
+	result.LocalAddr, result.ClientAddr = trace.LocalAddr(), res.Header.Get(ClientAddrHeader)
+	if !c.source.enabled() {
+		return nil
+	}
+
+	observed, err := netip.ParseAddrPort(result.ClientAddr)
+	if err != nil {
+		logger.Error("server did not return a client IP address", zap.String("clientAddr", result.ClientAddr))
+		return result.fail(SourceFailure, SourceNotPreservedErr)
+	}
+	ip := observed.Addr().Unmap()
+
+	if c.source.preserved {
+		local, err := netip.ParseAddrPort(result.LocalAddr)
+		if err != nil || local.Addr().Unmap() != ip {
+			logger.Error("server observed a different client address", zap.String("localAddr", result.LocalAddr), zap.String("clientAddr", result.ClientAddr))
+			return result.fail(SourceFailure, SourceNotPreservedErr)
+		}
+	}
+	if len(c.source.prefixes) > 0 && !containsAddr(c.source.prefixes, ip) {
+		logger.Error("server observed a client address outside the expected prefixes", zap.String("clientAddr", result.ClientAddr), zap.Stringers("prefixes", c.source.prefixes))
+		return result.fail(SourceFailure, SourceNotPreservedErr)
+	}
+	logger.Info("server observed the expected client address", zap.String("clientAddr", result.ClientAddr))
+	return nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var InvalidChunkFormatErr = errors.New("chunked sizes must be formatted as COUNTxSIZE (e.g., 16x4Ki)")
+var InvalidReplayOptionErr = errors.New("replay spec options must be formatted as encoding=ENCODING or accept=ENCODING")
+
+// ReplaySpec is a source.Spec that may be replayed using chunked transfer-encoding.
+type ReplaySpec interface {
+	source.Spec
+
+	// ChunkSize is the size of each chunk, or zero if the spec is not chunked.
+	ChunkSize() int64
+
+	// Chunks is the number of chunks, or zero if the spec is not chunked.
+	Chunks() int64
+
+	// ContentEncoding is the encoding with which the request body is compressed.
+	ContentEncoding() Encoding
+
+	// AcceptEncoding is the encoding with which the response body is requested to be compressed.
+	AcceptEncoding() Encoding
+}
+
+// NewReplaySpec parses a replay spec from its description. Specs are formatted as NAME:SIZE, the same as
+// source.NewSpec, or as NAME:COUNTxSIZE to replay COUNT chunks of SIZE bytes using chunked
+// transfer-encoding (e.g., chunky:16x4Ki). Either may be followed by comma-separated options:
+// encoding=ENCODING compresses the request body, and accept=ENCODING requests a compressed response (e.g.,
+// compressed:64Ki,encoding=gzip,accept=deflate). Sizes are those of the uncompressed bodies.
+func NewReplaySpec(desc string) (ReplaySpec, error) {
+
+	spec, err := parseReplaySize(desc)
+	if err != nil {
+		return nil, err
+	}
+	spec.desc = desc
+
+	_, options, _ := strings.Cut(desc, ",")
+	for _, opt := range strings.Split(options, ",") {
+		if opt == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "encoding":
+			spec.encoding, err = ParseEncoding(value)
+		case "accept":
+			spec.accept, err = ParseEncoding(value)
+		default:
+			err = InvalidReplayOptionErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return spec, nil
+}
+
+// parseReplaySize parses the NAME:SIZE or NAME:COUNTxSIZE prefix of a replay spec.
+func parseReplaySize(desc string) (replaySpec, error) {
+
+	desc, _, _ = strings.Cut(desc, ",")
+	name, size, _ := strings.Cut(desc, ":")
+	count, chunk, chunked := strings.Cut(size, "x")
+	if !chunked {
+		s, err := source.NewSpec(desc, "")
+		if err != nil {
+			return replaySpec{}, err
+		}
+		return replaySpec{name: s.Name(), size: s.Size(), encoding: IdentityEncoding, accept: IdentityEncoding}, nil
+	}
+
+	spec := replaySpec{name: name, encoding: IdentityEncoding, accept: IdentityEncoding}
+	if n, err := strconv.ParseInt(count, 10, 64); err == nil && n > 0 {
+		spec.chunks = n
+	} else {
+		return spec, InvalidChunkFormatErr
+	}
+	if q, err := resource.ParseQuantity(chunk); err == nil && q.Value() > 0 {
+		spec.chunkSize = q.Value()
+	} else {
+		return spec, errors.Join(InvalidChunkFormatErr, err)
+	}
+	spec.size = spec.chunks * spec.chunkSize
+
+	return spec, nil
+}
+
+type replaySpec struct {
+	name      string
+	desc      string
+	size      int64
+	chunkSize int64
+	chunks    int64
+	encoding  Encoding
+	accept    Encoding
+}
+
+func (s replaySpec) Name() string {
+	return s.name
+}
+
+func (s replaySpec) Describe() string {
+	return s.desc
+}
+
+func (s replaySpec) Size() int64 {
+	return s.size
+}
+
+func (s replaySpec) Generate() source.Source {
+	return source.New(s.size)
+}
+
+func (s replaySpec) ChunkSize() int64 {
+	return s.chunkSize
+}
+
+func (s replaySpec) Chunks() int64 {
+	return s.chunks
+}
+
+func (s replaySpec) ContentEncoding() Encoding {
+	return s.encoding
+}
+
+func (s replaySpec) AcceptEncoding() Encoding {
+	return s.accept
+}
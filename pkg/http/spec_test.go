@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReplaySpec", func() {
+
+	It("parses sized specs", func() {
+		spec, err := NewReplaySpec("medium:64Ki")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spec.Name()).To(Equal("medium"))
+		Expect(spec.Describe()).To(Equal("medium:64Ki"))
+		Expect(spec.Size()).To(Equal(int64(65536)))
+		Expect(spec.Chunks()).To(BeZero())
+		Expect(spec.ChunkSize()).To(BeZero())
+	})
+
+	It("parses chunked specs", func() {
+		spec, err := NewReplaySpec("chunky:16x4Ki")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spec.Name()).To(Equal("chunky"))
+		Expect(spec.Describe()).To(Equal("chunky:16x4Ki"))
+		Expect(spec.Size()).To(Equal(int64(65536)))
+		Expect(spec.Chunks()).To(Equal(int64(16)))
+		Expect(spec.ChunkSize()).To(Equal(int64(4096)))
+	})
+
+	It("parses encoding options", func() {
+		spec, err := NewReplaySpec("compressed:16x4Ki,encoding=gzip,accept=deflate")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spec.Name()).To(Equal("compressed"))
+		Expect(spec.Describe()).To(Equal("compressed:16x4Ki,encoding=gzip,accept=deflate"))
+		Expect(spec.Size()).To(Equal(int64(65536)))
+		Expect(spec.ContentEncoding()).To(Equal(GzipEncoding))
+		Expect(spec.AcceptEncoding()).To(Equal(DeflateEncoding))
+
+		spec, err = NewReplaySpec("medium:64Ki")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spec.ContentEncoding()).To(Equal(IdentityEncoding))
+		Expect(spec.AcceptEncoding()).To(Equal(IdentityEncoding))
+	})
+
+	DescribeTable("rejects malformed specs", func(desc string) {
+		_, err := NewReplaySpec(desc)
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("bad size", "bad:lots"),
+		Entry("bad count", "bad:manyx4Ki"),
+		Entry("zero count", "bad:0x4Ki"),
+		Entry("bad chunk size", "bad:16xlots"),
+		Entry("unsupported encoding", "bad:64Ki,encoding=zstd"),
+		Entry("unknown option", "bad:64Ki,level=9"),
+	)
+})
@@ -18,10 +18,12 @@
 package http
 
 import (
+	"net/http/httptest"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/types"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -38,3 +40,21 @@ func TestHttp(t *testing.T) {
 	suiteCfg, reportCfg := GinkgoConfiguration()
 	RunSpecs(t, "HTTP Inspection", suiteCfg, reportCfg)
 }
+
+// BeSuccessful succeeds if the actual value is a successful Result.
+func BeSuccessful() types.GomegaMatcher {
+	return HaveField("OK", BeTrue())
+}
+
+// newTestServer starts a server of NewHandler(opts...), which is closed when the spec ends.
+func newTestServer(opts ...HandlerOption) *httptest.Server {
+	return startTestServer(httptest.NewUnstartedServer(NewHandler(opts...)))
+}
+
+// startTestServer starts srv, which may have been configured (e.g., its Listener wrapped) since it was
+// created, and closes it when the spec ends.
+func startTestServer(srv *httptest.Server) *httptest.Server {
+	srv.Start()
+	DeferCleanup(srv.Close)
+	return srv
+}
@@ -0,0 +1,341 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var InvalidTimeoutsErr = errors.New("timeouts, max header bytes, and the min transfer rate must not be negative")
+
+// Timeouts are the server's timeouts and header limit, protecting it from clients that send or receive slowly
+// (e.g., slowloris). Zero durations are unlimited.
+type Timeouts struct {
+
+	// ReadHeader is how long reading the request headers may take.
+	ReadHeader time.Duration
+
+	// Read is how long reading a request, including its body, may take.
+	Read time.Duration
+
+	// Write is how long writing a response may take, measured from the end of the request headers.
+	Write time.Duration
+
+	// Idle is how long a connection may wait for the next request.
+	Idle time.Duration
+
+	// MaxHeaderBytes is the maximum size of the request headers. If zero, http.DefaultMaxHeaderBytes is used.
+	MaxHeaderBytes int
+
+	// MinTransferRate is the slowest rate, in bytes/sec, at which replay, upload, and download bodies are expected
+	// to be transferred. Their deadlines are extended by the time taken to transfer their size at this rate (twice
+	// for replays, which are echoed). Zero does not extend them.
+	MinTransferRate int64
+}
+
+// Validate returns InvalidTimeoutsErr if any timeout or limit is negative.
+func (t Timeouts) Validate() error {
+	if t.ReadHeader < 0 || t.Read < 0 || t.Write < 0 || t.Idle < 0 || t.MaxHeaderBytes < 0 || t.MinTransferRate < 0 {
+		return InvalidTimeoutsErr
+	}
+	return nil
+}
+
+// Apply sets the server's timeouts and header limit. If srv serves a listener wrapped by WatchTimeouts, it also
+// tracks whether each connection is idle so that timeouts are attributed correctly.
+func (t Timeouts) Apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = t.ReadHeader
+	srv.ReadTimeout = t.Read
+	srv.WriteTimeout = t.Write
+	srv.IdleTimeout = t.Idle
+	srv.MaxHeaderBytes = t.MaxHeaderBytes
+
+	connState := srv.ConnState
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		if c := unwrapWatchedConn(conn); c != nil {
+			c.idle.Store(state == http.StateIdle)
+		}
+		if connState != nil {
+			connState(conn, state)
+		}
+	}
+	connContext := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		if c := unwrapWatchedConn(conn); c != nil {
+			ctx = context.WithValue(ctx, watchedConnKey{}, c)
+		}
+		if connContext != nil {
+			ctx = connContext(ctx, conn)
+		}
+		return ctx
+	}
+}
+
+// WithTimeouts sets per-handler deadlines based on t: replay, upload, and download deadlines are extended by
+// their size at t.MinTransferRate, held streams by their duration, and WebSockets have none.
+func WithTimeouts(t Timeouts) HandlerOption {
+	return timeoutsOption(t)
+}
+
+type timeoutsOption Timeouts
+
+func (o timeoutsOption) apply(h *handlerConfig) {
+	h.timeouts = Timeouts(o)
+}
+
+// Timeouts that close connections, which are also the values of the connections_timed_out_total timeout label.
+const (
+	readHeaderTimeout = "read_header"
+	readTimeout       = "read"
+	writeTimeout      = "write"
+	idleTimeout       = "idle"
+)
+
+// transfer returns the time taken to transfer size bytes at MinTransferRate.
+func (t Timeouts) transfer(size int64) time.Duration {
+	if t.MinTransferRate <= 0 || size <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / float64(t.MinTransferRate) * float64(time.Second))
+}
+
+// requestTimeouts are the read and write timeouts of a request. A zero timeout is unlimited.
+type requestTimeouts struct {
+	read  time.Duration
+	write time.Duration
+
+	// responseRead is true if the read timeout only bounds the response (i.e., it is the write timeout), so
+	// that a read timing out is attributed to the write timeout.
+	responseRead bool
+}
+
+// deadlines returns the timeouts of a request to the endpoint pattern, and whether they differ from the server's.
+// Responses without a request body have the same read and write deadlines, since HTTP/1.1 connections are read in
+// the background while responding, and a read that times out cancels the request.
+func (t Timeouts) deadlines(pattern string, req *http.Request) (requestTimeouts, bool) {
+
+	extend := func(base, by time.Duration) time.Duration {
+		if base == 0 {
+			return 0
+		}
+		return base + by
+	}
+
+	size := req.ContentLength
+	switch pattern {
+	case "/replay":
+		if size < 0 {
+			size = MaxReplayRequestSize
+		}
+		return requestTimeouts{read: extend(t.Read, t.transfer(size)), write: extend(t.Write, 2*t.transfer(size))}, true
+	case "/upload":
+		if size < 0 {
+			size = MaxTransferSize
+		}
+		return requestTimeouts{read: extend(t.Read, t.transfer(size)), write: extend(t.Write, t.transfer(size))}, true
+	case "/download":
+		if size, err := strconv.ParseInt(req.URL.Query().Get("size"), 10, 64); err == nil {
+			write := extend(t.Write, t.transfer(size))
+			return requestTimeouts{read: write, write: write, responseRead: true}, true
+		}
+	case "/hold":
+		if d, err := time.ParseDuration(req.URL.Query().Get("duration")); err == nil {
+			write := extend(t.Write, d)
+			return requestTimeouts{read: write, write: write, responseRead: true}, true
+		}
+	case "/websocket":
+		return requestTimeouts{}, true
+	}
+	return requestTimeouts{}, false
+}
+
+// enforceTimeouts wraps next, setting the deadlines of each request based on the mux pattern that handles it,
+// and marking watched connections as handling a request.
+func enforceTimeouts(mux *http.ServeMux, next http.Handler, t Timeouts) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		c, watched := req.Context().Value(watchedConnKey{}).(*watchedConn)
+		if watched {
+			c.handling.Add(1)
+			defer c.handling.Add(-1)
+		}
+
+		_, pattern := mux.Handler(req)
+		if timeouts, ok := t.deadlines(pattern, req); ok {
+			ctrl := http.NewResponseController(res)
+			now := time.Now()
+			var rd, wd time.Time
+			if timeouts.read > 0 {
+				rd = now.Add(timeouts.read)
+			}
+			if timeouts.write > 0 {
+				wd = now.Add(timeouts.write)
+			}
+			if err := ctrl.SetReadDeadline(rd); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				requestLogger(req).Warn("unable to set read deadline", zap.Error(err))
+			}
+			if err := ctrl.SetWriteDeadline(wd); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				requestLogger(req).Warn("unable to set write deadline", zap.Error(err))
+			}
+
+			// HTTP/2 deadlines are set on the stream rather than the connection
+			if watched && timeouts.responseRead && req.ProtoMajor == 1 {
+				c.readBoundsResponse()
+			}
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// WatchTimeouts wraps ln so that connections closed by a server timeout are logged and counted. The server must
+// be configured using Timeouts.Apply.
+func WatchTimeouts(ln net.Listener) net.Listener {
+	return &watchedListener{Listener: ln}
+}
+
+type watchedListener struct {
+	net.Listener
+}
+
+func (l *watchedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &watchedConn{Conn: conn}, nil
+}
+
+type watchedConnKey struct{}
+
+// watchedConn attributes deadline errors to the timeout that caused them, based on whether the connection
+// was idle or handling a request. Deadlines in the distant past are set by the server to abort reads, not
+// by a timeout, and are ignored.
+type watchedConn struct {
+	net.Conn
+	idle     atomic.Bool
+	handling atomic.Int32
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	responseRead  bool
+	reported      bool
+}
+
+// unwrapWatchedConn returns the watchedConn underlying conn (e.g., a *tls.Conn), if any.
+func unwrapWatchedConn(conn net.Conn) *watchedConn {
+	for {
+		switch c := conn.(type) {
+		case *watchedConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// abortedDeadline is before any deadline set by a timeout.
+var abortedDeadline = time.Unix(1<<30, 0)
+
+func (c *watchedConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.responseRead = false
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *watchedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.responseRead = false
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *watchedConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		timeout := readTimeout
+		if c.idle.Load() {
+			timeout = idleTimeout
+		} else if c.handling.Load() == 0 {
+			timeout = readHeaderTimeout
+		} else if c.readingResponse() {
+			// The read deadline of a response without a request body is its write deadline, so the server's
+			// background read times out alongside the response
+			timeout = writeTimeout
+		}
+		c.timedOut(timeout, func() time.Time { return c.readDeadline })
+	}
+	return n, err
+}
+
+func (c *watchedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.timedOut(writeTimeout, func() time.Time { return c.writeDeadline })
+	}
+	return n, err
+}
+
+// readBoundsResponse records that the current read deadline was set by enforceTimeouts to bound a response, until
+// the read deadline is next set.
+func (c *watchedConn) readBoundsResponse() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responseRead = !c.readDeadline.IsZero()
+}
+
+// readingResponse is true if the current read deadline bounds a response.
+func (c *watchedConn) readingResponse() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.responseRead
+}
+
+// timedOut logs and counts the timeout once per connection, unless the deadline was set to abort a read.
+func (c *watchedConn) timedOut(timeout string, deadline func() time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reported || deadline().Before(abortedDeadline) {
+		return
+	}
+	c.reported = true
+	logger.Named("server").Warn("connection closed by timeout", zap.String("timeout", timeout), zap.String("clientAddr", c.RemoteAddr().String()))
+	serverTimeouts.WithLabelValues(timeout).Inc()
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+var _ = Describe("Timeouts", func() {
+
+	// serve starts a server with t, returning its address
+	serve := func(t Timeouts) string {
+		srv := httptest.NewUnstartedServer(NewHandler(WithTimeouts(t)))
+		t.Apply(srv.Config)
+		srv.Listener = WatchTimeouts(srv.Listener)
+		return startTestServer(srv).Listener.Addr().String()
+	}
+
+	// closed waits for the server to close conn
+	closed := func(conn net.Conn) {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.Copy(io.Discard, conn)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	count := func(timeout string) func() float64 {
+		return func() float64 {
+			return testutil.ToFloat64(serverTimeouts.WithLabelValues(timeout))
+		}
+	}
+
+	It("rejects negative timeouts", func() {
+		Expect(Timeouts{Read: -time.Second}.Validate()).To(MatchError(InvalidTimeoutsErr))
+		Expect(Timeouts{MinTransferRate: -1}.Validate()).To(MatchError(InvalidTimeoutsErr))
+		Expect(Timeouts{ReadHeader: time.Second, MaxHeaderBytes: 1024}.Validate()).To(Succeed())
+	})
+
+	It("closes connections that send headers slowly", func() {
+		addr := serve(Timeouts{ReadHeader: 100 * time.Millisecond})
+		before := count(readHeaderTimeout)()
+
+		conn, err := net.Dial("tcp", addr)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = fmt.Fprint(conn, "GET /check HTTP/1.1\r\nHost: localhost\r\n")
+		Expect(err).NotTo(HaveOccurred())
+		closed(conn)
+		Eventually(count(readHeaderTimeout)).Should(Equal(before + 1))
+	})
+
+	It("closes connections that send bodies slowly", func() {
+		addr := serve(Timeouts{Read: 100 * time.Millisecond, MinTransferRate: 1024 * 1024})
+		before := count(readTimeout)()
+
+		conn, err := net.Dial("tcp", addr)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = fmt.Fprint(conn, "POST /replay HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1024\r\n\r\nslow")
+		Expect(err).NotTo(HaveOccurred())
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.StatusCode).To(Equal(http.StatusInternalServerError))
+		closed(conn)
+		Eventually(count(readTimeout)).Should(Equal(before + 1))
+	})
+
+	It("closes idle connections", func() {
+		addr := serve(Timeouts{Idle: 100 * time.Millisecond})
+		before := count(idleTimeout)()
+
+		conn, err := net.Dial("tcp", addr)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = fmt.Fprint(conn, "GET /check HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		Expect(err).NotTo(HaveOccurred())
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		_, _ = io.Copy(io.Discard, res.Body)
+		Eventually(count(idleTimeout)).Should(Equal(before + 1))
+	})
+
+	It("closes connections that receive responses slowly", func() {
+		addr := serve(Timeouts{Write: 100 * time.Millisecond})
+		before := count(writeTimeout)()
+
+		conn, err := net.Dial("tcp", addr)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = fmt.Fprint(conn, "GET /download?size=1073741824 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(count(writeTimeout)).Should(Equal(before + 1))
+	})
+
+	It("extends deadlines for long-lived and large responses", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		addr := serve(Timeouts{Read: 100 * time.Millisecond, Write: 100 * time.Millisecond, MinTransferRate: 1024 * 1024})
+		client := NewClient("http://"+addr, &http.Client{})
+
+		Expect(client.Hold(ctx, HoldSpec{Duration: 300 * time.Millisecond, Interval: 50 * time.Millisecond})).To(BeSuccessful())
+		Expect(client.WebSocket(ctx, WebSocketSpec{TextMessages: 2, MessageSize: 16})).To(BeSuccessful())
+	})
+})
@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var NoCertificatesErr = errors.New("no PEM encoded certificates were found")
+
+// NewSelfSignedCertificate generates an in-memory CA and a serving certificate signed by that CA.
+// The serving certificate is valid for each of the specified hosts, which may be DNS names or IP
+// addresses, and may also be used as a client certificate. The PEM encoded CA certificate is returned
+// so that it may be distributed to clients.
+func NewSelfSignedCertificate(hosts ...string) (caPEM []byte, cert tls.Certificate, err error) {
+
+	now := time.Now()
+
+	// Generate the CA
+	var caKey *ecdsa.PrivateKey
+	if caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "konfirm-inspections-ca"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	var caDER []byte
+	if caDER, err = x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey); err != nil {
+		return
+	}
+	if ca, err = x509.ParseCertificate(caDER); err != nil {
+		return
+	}
+
+	// Generate the serving certificate
+	var key *ecdsa.PrivateKey
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: "konfirm-inspections"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			leaf.IPAddresses = append(leaf.IPAddresses, ip)
+		} else if h != "" {
+			leaf.DNSNames = append(leaf.DNSNames, h)
+		}
+	}
+	var leafDER []byte
+	if leafDER, err = x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey); err != nil {
+		return
+	}
+
+	cert = tls.Certificate{
+		Certificate: [][]byte{leafDER, caDER},
+		PrivateKey:  key,
+	}
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return
+}
+
+func serialNumber() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// LoadCertPool reads the PEM encoded certificates in the specified file into a new x509.CertPool.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, NoCertificatesErr
+	}
+	return pool, nil
+}
+
+// KeyPairReloader serves a certificate key pair loaded from disk, reloading it when either file
+// changes. This allows certificates mounted from a Kubernetes Secret to be rotated without
+// restarting the server.
+type KeyPairReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	checked time.Time
+	modTime [2]time.Time
+}
+
+// NewKeyPairReloader loads the specified key pair, returning an error if it cannot be loaded. The files
+// are checked for changes no more than once per interval.
+func NewKeyPairReloader(certFile, keyFile string, interval time.Duration) (*KeyPairReloader, error) {
+	r := &KeyPairReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate and is intended for use as tls.Config.GetCertificate.
+func (r *KeyPairReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) >= r.interval {
+		if err := r.reload(); err != nil {
+			logger.Named("tls").Error("error reloading certificate; continuing with the previous certificate", zap.Error(err))
+		}
+	}
+	return r.cert, nil
+}
+
+// reload loads the key pair if either file was modified since it was last loaded. The caller must hold mu
+// (or have exclusive access to r).
+func (r *KeyPairReloader) reload() error {
+
+	r.checked = time.Now()
+
+	var modTime [2]time.Time
+	for i, f := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(f); err == nil {
+			modTime[i] = info.ModTime()
+		} else {
+			return err
+		}
+	}
+	if r.cert != nil && modTime == r.modTime {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	logger.Named("tls").Info("loaded certificate", zap.String("certFile", r.certFile), zap.String("keyFile", r.keyFile))
+	return nil
+}
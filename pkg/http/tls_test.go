@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+// writeKeyPair writes cert to PEM encoded files in dir, returning their paths.
+func writeKeyPair(dir string, cert tls.Certificate) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, "tls.crt")
+	keyFile = filepath.Join(dir, "tls.key")
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(os.WriteFile(certFile, certPEM, 0600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)).To(Succeed())
+	return
+}
+
+var _ = Describe("TLS", func() {
+
+	It("serves with a self-signed certificate", func(ctx context.Context) {
+
+		ca, cert, err := NewSelfSignedCertificate("localhost", "127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		caFile := filepath.Join(GinkgoT().TempDir(), "ca.crt")
+		Expect(os.WriteFile(caFile, ca, 0600)).To(Succeed())
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		srv := &http.Server{
+			Handler:   NewHandler(),
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		}
+		go func() {
+			defer GinkgoRecover()
+			Expect(srv.ServeTLS(listener, "", "")).To(MatchError(http.ErrServerClosed))
+		}()
+		DeferCleanup(srv.Shutdown)
+
+		// Without the CA the server is not trusted
+		httpClient, err := NewHTTPClient(ClientConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := NewClient(fmt.Sprintf("https://%s", listener.Addr()), httpClient).Check(logging.NewContext(ctx, logger))
+		Expect(result.OK).To(BeFalse())
+		Expect(result.Failure).To(Equal(TLSFailure))
+		Expect(err).To(HaveOccurred())
+
+		// With the CA it is
+		httpClient, err = NewHTTPClient(ClientConfig{CACertFile: caFile})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(NewClient(fmt.Sprintf("https://%s", listener.Addr()), httpClient).Check(logging.NewContext(ctx, logger))).To(BeSuccessful())
+	})
+
+	It("verifies client certificates", func(ctx context.Context) {
+
+		ctx = logging.NewContext(ctx, logger)
+		dir := GinkgoT().TempDir()
+		ca, cert, err := NewSelfSignedCertificate("localhost", "127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		caFile := filepath.Join(dir, "ca.crt")
+		Expect(os.WriteFile(caFile, ca, 0600)).To(Succeed())
+		certFile, keyFile := writeKeyPair(dir, cert)
+		pool, err := LoadCertPool(caFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		serve := func(clientAuth tls.ClientAuthType) string {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			srv := &http.Server{
+				Handler: NewHandler(),
+				TLSConfig: &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					ClientCAs:    pool,
+					ClientAuth:   clientAuth,
+				},
+			}
+			go func() {
+				defer GinkgoRecover()
+				Expect(srv.ServeTLS(listener, "", "")).To(MatchError(http.ErrServerClosed))
+			}()
+			DeferCleanup(srv.Shutdown)
+			return fmt.Sprintf("https://%s", listener.Addr())
+		}
+
+		mutual := serve(tls.RequireAndVerifyClientCert)
+		withCert, err := NewHTTPClient(ClientConfig{CACertFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile})
+		Expect(err).NotTo(HaveOccurred())
+		withoutCert, err := NewHTTPClient(ClientConfig{CACertFile: caFile})
+		Expect(err).NotTo(HaveOccurred())
+
+		// The server returns the verified identity
+		Expect(NewClient(mutual, withCert, WithMutualTLS()).Check(ctx)).To(BeSuccessful())
+		body := bytes.NewBufferString("All work and no play makes Jack a dull boy.")
+		Expect(NewClient(mutual, withCert, WithMutualTLS()).ReplayN(ctx, body, int64(body.Len()))).To(BeSuccessful())
+
+		// Clients without a certificate are rejected
+		result, err := NewClient(mutual, withoutCert).Check(ctx)
+		Expect(result.OK).To(BeFalse())
+		Expect(err).To(HaveOccurred())
+
+		// Servers that do not verify the certificate fail when mutual TLS is required
+		result, err = NewClient(serve(tls.NoClientCert), withCert, WithMutualTLS()).Check(ctx)
+		Expect(result.OK).To(BeFalse())
+		Expect(result.Failure).To(Equal(IdentityFailure))
+		Expect(err).To(MatchError(MutualTLSErr))
+	})
+
+	It("reloads rotated certificates", func() {
+
+		dir := GinkgoT().TempDir()
+		_, first, err := NewSelfSignedCertificate("localhost")
+		Expect(err).NotTo(HaveOccurred())
+		certFile, keyFile := writeKeyPair(dir, first)
+
+		reloader, err := NewKeyPairReloader(certFile, keyFile, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reloader.GetCertificate(nil)).To(HaveField("Certificate", first.Certificate))
+
+		_, second, err := NewSelfSignedCertificate("localhost")
+		Expect(err).NotTo(HaveOccurred())
+		writeKeyPair(dir, second)
+		Expect(reloader.GetCertificate(nil)).To(HaveField("Certificate", second.Certificate))
+
+		// A broken rotation keeps the previous certificate
+		Expect(os.WriteFile(keyFile, []byte("garbage"), 0600)).To(Succeed())
+		Expect(reloader.GetCertificate(nil)).To(HaveField("Certificate", second.Certificate))
+	})
+})
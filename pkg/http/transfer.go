@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+// DigestTrailer is the trailer in which the download endpoint sends the digest of the response body. Trailers
+// are sent after the body, so the body is hashed as it is streamed.
+const DigestTrailer = "X-Konfirm-Digest"
+
+// MaxTransferSize is the maximum size of a download or upload. Transfers are streamed, so the server's memory
+// use does not depend on their size.
+var MaxTransferSize int64 = 64 * 1024 * 1024 * 1024 // 64 GiB
+
+// uploadReceipt is the response to an upload request.
+type uploadReceipt struct {
+	Bytes  int64  `json:"bytes"`
+	Digest string `json:"digest"`
+}
+
+// download streams the number of bytes requested by the size query parameter, generated by source.New, and
+// sends their digest in DigestTrailer.
+func download(res http.ResponseWriter, req *http.Request) {
+
+	logger := requestLogger(req).With(zap.String("handler", "download"))
+	logRequest(logger, req)
+
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	size, err := strconv.ParseInt(req.URL.Query().Get("size"), 10, 64)
+	if err != nil || size < 0 || size > MaxTransferSize {
+		logger.Info("invalid download size", zap.String("size", req.URL.Query().Get("size")))
+		http.Error(res, fmt.Sprintf("size must be a number of bytes up to %d", MaxTransferSize), http.StatusBadRequest)
+		return
+	}
+
+	// The Content-Length is not set since HTTP/1.1 trailers require chunked transfer-encoding
+	identifyClient(logger, res, req)
+	headers := res.Header()
+	headers.Set(contentType, "application/octet-stream")
+	headers.Set("Trailer", DigestTrailer)
+	res.WriteHeader(http.StatusOK)
+
+	digest := crypto.SHA256.New()
+	body := io.TeeReader(source.New(size), digest)
+	start := time.Now()
+	if n, err := io.CopyBuffer(res, body, make([]byte, replayBufferSize)); err != nil {
+		logger.Error("error writing response body", zap.Error(err), zap.Int64("bytes", n))
+		return
+	}
+	headers.Set(DigestTrailer, "sha256:"+hex.EncodeToString(digest.Sum(nil)))
+	logger.Info("download sent successfully", zap.Int64("bytes", size), zap.Duration("elapsed", time.Since(start)))
+}
+
+// upload consumes and hashes the request body, responding with its length and digest as an uploadReceipt.
+func upload(res http.ResponseWriter, req *http.Request) {
+
+	logger := requestLogger(req).With(zap.String("handler", "upload"))
+	logRequest(logger, req)
+
+	if req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if req.ContentLength > MaxTransferSize {
+		logger.Warn("request size exceeds maximum", zap.Int64("size", req.ContentLength), zap.Int64("maxSize", MaxTransferSize))
+		serverTooLarge.WithLabelValues("upload").Inc()
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	digest := crypto.SHA256.New()
+	start := time.Now()
+	n, err := io.CopyBuffer(digest, io.LimitReader(req.Body, MaxTransferSize+1), make([]byte, replayBufferSize))
+	if err != nil {
+		logger.Error("error reading request body", zap.Error(err), zap.Int64("bytes", n))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if n > MaxTransferSize {
+		logger.Warn("chunked request size exceeds maximum", zap.Int64("maxSize", MaxTransferSize))
+		serverTooLarge.WithLabelValues("upload").Inc()
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	} else if req.ContentLength >= 0 && n != req.ContentLength {
+		logger.Error("request content did not match expected size", zap.Int64("size", n), zap.Int64("expected", req.ContentLength))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	receipt := uploadReceipt{Bytes: n, Digest: "sha256:" + hex.EncodeToString(digest.Sum(nil))}
+	identifyClient(logger, res, req)
+	res.Header().Set(contentType, "application/json")
+	res.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(res).Encode(receipt); err != nil {
+		logger.Error("error writing response body", zap.Error(err))
+	} else {
+		logger.Info("upload received successfully", zap.Int64("bytes", n), zap.Duration("elapsed", time.Since(start)))
+	}
+}
+
+// Download downloads size bytes from the server and verifies them using the digest the server sends in
+// DigestTrailer, or if a proxy removed the trailer, the digest of the bytes the server is expected to
+// generate. The time taken to receive the response body is returned as Result.Transfer.
+func (c *client) Download(ctx context.Context, size int64) (result Result, err error) {
+
+	ctx = c.correlate(ctx, &result)
+	logger := c.logger(ctx).With(zap.Int64("size", size))
+	logger.Info("starting download")
+
+	ctx, trace := newTracer(ctx)
+	defer func() {
+		result.Timings = trace.done(logger)
+	}()
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/download?size=%d", c.server, size), nil); err != nil {
+		logger.Error("an error occurred generating the download request", zap.Error(err))
+		return result, result.fail(RequestFailure, err)
+	}
+
+	var res *http.Response
+	if res, err = c.http.Do(req); err != nil {
+		logger.Error("an error occurred during download request", zap.Error(err))
+		return result, result.fail(classifyError(err), err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	result.StatusCode = res.StatusCode
+
+	if res.StatusCode != http.StatusOK {
+		logger.Error("download failed with an non-200 HTTP status code", zap.Int("statusCode", res.StatusCode))
+		return result, result.fail(StatusFailure, HttpStatusCodeErr)
+	} else if err = c.verifyProtocol(logger, res, &result); err != nil {
+		return
+	} else if err = c.verifyIdentity(logger, res, &result); err != nil {
+		return
+	} else if res.Header.Get(contentType) != "application/octet-stream" {
+		logger.Error("download response content-type was not 'application/octet-stream'", zap.String("resContentType", res.Header.Get(contentType)))
+		return result, result.fail(HeaderFailure, nil)
+	}
+
+	// Receive the response body, timing only the transfer
+	actual := crypto.SHA256.New()
+	start := time.Now()
+	n, e := io.CopyBuffer(actual, res.Body, make([]byte, replayBufferSize))
+	result.Transfer = time.Since(start)
+	result.BytesReceived = n
+	if e != nil {
+		logger.Error("an error occurred while reading the response", zap.Error(e))
+		return result, result.fail(classifyBodyError(e), e)
+	} else if n != size {
+		logger.Error("response body length did not match the requested size", zap.Int64("actual", n))
+		return result, result.fail(LengthFailure, nil)
+	}
+
+	result.ActualDigest = "sha256:" + hex.EncodeToString(actual.Sum(nil))
+	if result.ExpectedDigest = res.Trailer.Get(DigestTrailer); result.ExpectedDigest == "" {
+		logger.Debug("download response did not include a digest trailer")
+		expected := crypto.SHA256.New()
+		_, _ = io.Copy(expected, source.New(size))
+		result.ExpectedDigest = "sha256:" + hex.EncodeToString(expected.Sum(nil))
+	}
+	if result.ExpectedDigest == result.ActualDigest {
+		logger.Info("download successful", zap.String("digest", result.ActualDigest), zap.Float64("throughput", result.Throughput()))
+		result.OK = true
+	} else {
+		logger.Warn("response body did not match the expected digest", zap.String("expectedDigest", result.ExpectedDigest), zap.String("actualDigest", result.ActualDigest))
+		result.fail(DigestFailure, nil)
+	}
+	return
+}
+
+// Upload uploads size bytes generated by source.New to the server and compares their digest to the digest the
+// server calculated. The time from the request headers being sent until the server responds (i.e., once it has
+// consumed the body) is returned as Result.Transfer.
+func (c *client) Upload(ctx context.Context, size int64) (result Result, err error) {
+
+	ctx = c.correlate(ctx, &result)
+	logger := c.logger(ctx).With(zap.Int64("size", size))
+	logger.Info("starting upload")
+
+	ctx, trace := newTracer(ctx)
+	expected := crypto.SHA256.New()
+	sent := &byteCounter{}
+	defer func() {
+		result.BytesSent = sent.n.Load()
+		result.Timings = trace.done(logger)
+	}()
+
+	var req *http.Request
+	body := io.TeeReader(source.New(size), io.MultiWriter(expected, sent))
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/upload", c.server), body); err != nil {
+		logger.Error("an error occurred generating the upload request", zap.Error(err))
+		return result, result.fail(RequestFailure, err)
+	}
+	req.ContentLength = size
+	req.Header.Set(contentType, "application/octet-stream")
+
+	var res *http.Response
+	if res, err = c.http.Do(req); err != nil {
+		logger.Error("an error occurred during upload request", zap.Error(err))
+		return result, result.fail(classifyError(err), err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	result.Transfer = trace.sinceWroteHeaders()
+	result.BytesSent = sent.n.Load()
+	result.StatusCode = res.StatusCode
+
+	if res.StatusCode != http.StatusOK {
+		err = HttpStatusCodeErr
+		if res.StatusCode == http.StatusRequestEntityTooLarge {
+			err = ExceedsMaxRequestSizeErr
+		}
+		logger.Error("upload failed with an non-200 HTTP status code", zap.Int("statusCode", res.StatusCode))
+		return result, result.fail(StatusFailure, err)
+	} else if err = c.verifyProtocol(logger, res, &result); err != nil {
+		return
+	} else if err = c.verifyIdentity(logger, res, &result); err != nil {
+		return
+	}
+
+	receipt := uploadReceipt{}
+	counter := &byteCounter{}
+	if e := json.NewDecoder(io.TeeReader(res.Body, counter)).Decode(&receipt); e != nil {
+		result.BytesReceived = counter.n.Load()
+		logger.Error("an error occurred while decoding the upload response", zap.Error(e))
+		return result, result.fail(BodyFailure, nil)
+	}
+	result.BytesReceived = counter.n.Load()
+
+	if receipt.Bytes != sent.n.Load() {
+		logger.Error("the server received a different number of bytes than were sent", zap.Int64("received", receipt.Bytes), zap.Int64("sent", sent.n.Load()))
+		return result, result.fail(LengthFailure, nil)
+	}
+	result.ExpectedDigest = "sha256:" + hex.EncodeToString(expected.Sum(nil))
+	result.ActualDigest = receipt.Digest
+	if result.ExpectedDigest == result.ActualDigest {
+		logger.Info("upload successful", zap.String("digest", result.ActualDigest), zap.Float64("throughput", result.Throughput()))
+		result.OK = true
+	} else {
+		logger.Warn("the server's digest did not match the request body", zap.String("expectedDigest", result.ExpectedDigest), zap.String("actualDigest", result.ActualDigest))
+		result.fail(DigestFailure, nil)
+	}
+	return
+}
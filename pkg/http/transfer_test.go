@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+var _ = Describe("Transfer", func() {
+
+	const size = 4*1024*1024 + 17
+
+	It("downloads", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewH2CHandler(NewHandler()))
+		DeferCleanup(srv.Close)
+
+		for _, p := range []Protocol{HTTP1, H2C} {
+			httpClient, err := NewHTTPClient(ClientConfig{Protocol: p})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := NewClient(srv.URL, httpClient, WithProtocol(p)).Download(ctx, size)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(BeSuccessful())
+			Expect(result.BytesReceived).To(Equal(int64(size)))
+			Expect(result.ActualDigest).To(Equal(result.ExpectedDigest))
+			Expect(result.Transfer).To(BeNumerically(">", 0))
+			Expect(result.Throughput()).To(BeNumerically(">", 0))
+		}
+
+		// The digest is sent as a trailer
+		res, err := http.Get(srv.URL + "/download?size=16")
+		Expect(err).NotTo(HaveOccurred())
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+		Expect(res.Trailer.Get(DigestTrailer)).To(HavePrefix("sha256:"))
+	})
+
+	It("uploads", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewH2CHandler(NewHandler()))
+		DeferCleanup(srv.Close)
+
+		for _, p := range []Protocol{HTTP1, H2C} {
+			httpClient, err := NewHTTPClient(ClientConfig{Protocol: p})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := NewClient(srv.URL, httpClient, WithProtocol(p)).Upload(ctx, size)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(BeSuccessful())
+			Expect(result.BytesSent).To(Equal(int64(size)))
+			Expect(result.ActualDigest).To(Equal(result.ExpectedDigest))
+			Expect(result.Throughput()).To(BeNumerically(">", 0))
+		}
+	})
+
+	It("detects corrupt and truncated downloads", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewHandler(WithFaults(FaultConfig{Corrupt: 1, CorruptBytes: 4})))
+		DeferCleanup(srv.Close)
+		result, _ := NewClient(srv.URL, http.DefaultClient).Download(ctx, size)
+		Expect(result.Failure).To(Equal(DigestFailure))
+
+		srv = httptest.NewServer(NewHandler(WithFaults(FaultConfig{Truncate: 1})))
+		DeferCleanup(srv.Close)
+		result, _ = NewClient(srv.URL, http.DefaultClient).Download(ctx, size)
+		Expect(result.Failure).To(Equal(LengthFailure))
+	})
+
+	It("rejects invalid download sizes", func() {
+		srv := httptest.NewServer(NewHandler())
+		DeferCleanup(srv.Close)
+
+		for _, q := range []string{"", "size=-1", "size=x", "size=1099511627776"} {
+			res, err := http.Get(srv.URL + "/download?" + q)
+			Expect(err).NotTo(HaveOccurred())
+			_ = res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest), q)
+		}
+	})
+})
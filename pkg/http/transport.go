@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+var ClientKeyPairErr = errors.New("a client certificate and key must be specified together")
+
+// ClientConfig describes how the underlying http.Client used by a Client is built.
+type ClientConfig struct {
+
+	// CACertFile is a PEM encoded CA bundle used to verify the server's certificate. If empty, the
+	// system roots are used.
+	CACertFile string
+
+	// ClientCertFile and ClientKeyFile are a PEM encoded certificate and private key presented to
+	// servers that request a client certificate.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// ConnectTimeout limits how long establishing a connection may take. If zero, the http.DefaultTransport
+	// timeout is used.
+	ConnectTimeout time.Duration
+
+	// Protocol forces the HTTP protocol used. If DefaultProtocol, HTTP/2 is negotiated over TLS.
+	Protocol Protocol
+
+	// ResponseTimeout limits how long to wait for the response headers once the request is sent. If zero,
+	// there is no limit.
+	ResponseTimeout time.Duration
+}
+
+// NewHTTPClient builds an http.Client from the provided config.
+func NewHTTPClient(cfg ClientConfig) (*http.Client, error) {
+
+	tlsConfig := &tls.Config{}
+	if cfg.CACertFile != "" {
+		if pool, err := LoadCertPool(cfg.CACertFile); err == nil {
+			tlsConfig.RootCAs = pool
+		} else {
+			return nil, err
+		}
+	}
+
+	switch {
+	case cfg.ClientCertFile != "" && cfg.ClientKeyFile != "":
+		if cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile); err == nil {
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		} else {
+			return nil, err
+		}
+	case cfg.ClientCertFile != "" || cfg.ClientKeyFile != "":
+		return nil, ClientKeyPairErr
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ResponseHeaderTimeout = cfg.ResponseTimeout
+	if cfg.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+
+	rt, err := cfg.Protocol.transport(transport)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: rt}, nil
+}
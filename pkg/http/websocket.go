@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+
+	"github.com/raft-tech/konfirm-inspections/pkg/storage/source"
+)
+
+var WebSocketFrameTypeErr = errors.New("the echoed WebSocket message was not the same frame type as the message sent")
+var InvalidWebSocketSpecErr = errors.New("WebSocket message counts and sizes must not be negative, and messages must not exceed MaxReplayRequestSize")
+
+// WebSocketSpec describes the messages exchanged by Client.WebSocket. Text messages are sent first, followed
+// by binary messages; each is sent once the previous message is echoed.
+type WebSocketSpec struct {
+	TextMessages   int
+	BinaryMessages int
+
+	// MessageSize is the size of each message in bytes. The server rejects messages larger than
+	// MaxReplayRequestSize.
+	MessageSize int
+}
+
+// Validate returns InvalidWebSocketSpecErr if any count or size is negative, or messages are larger than the
+// server accepts.
+func (s WebSocketSpec) Validate() error {
+	if s.TextMessages < 0 || s.BinaryMessages < 0 || s.MessageSize < 0 || int64(s.MessageSize) > MaxReplayRequestSize {
+		return InvalidWebSocketSpecErr
+	}
+	return nil
+}
+
+// wsMessage is a WebSocket message and its frame type.
+type wsMessage struct {
+	payloadType byte
+	data        []byte
+}
+
+// wsCodec sends and receives messages, preserving their frame type.
+var wsCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		m := v.(wsMessage)
+		return m.data, m.payloadType, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		*v.(*wsMessage) = wsMessage{payloadType: payloadType, data: data}
+		return nil
+	},
+}
+
+// echoWebSocket echoes each message received on a WebSocket connection using the same frame type. WebSockets
+// are upgraded from HTTP/1.1 only.
+func echoWebSocket(res http.ResponseWriter, req *http.Request) {
+
+	logger := requestLogger(req).With(zap.String("handler", "websocket"))
+	logRequest(logger, req)
+
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if req.ProtoMajor != 1 {
+		logger.Error("websocket upgrades require HTTP/1.1", zap.String("protocol", req.Proto))
+		res.WriteHeader(http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	// The Origin is not checked since clients are not browsers
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.MaxPayloadBytes = int(MaxReplayRequestSize)
+		messages := 0
+		for {
+			var msg wsMessage
+			if err := wsCodec.Receive(ws, &msg); err != nil {
+				if errors.Is(err, io.EOF) {
+					logger.Info("websocket closed", zap.Int("messages", messages))
+				} else {
+					logger.Error("error receiving websocket message", zap.Error(err), zap.Int("messages", messages))
+				}
+				return
+			}
+			if err := wsCodec.Send(ws, msg); err != nil {
+				logger.Error("error echoing websocket message", zap.Error(err), zap.Int("messages", messages))
+				return
+			}
+			messages++
+		}
+	}}.ServeHTTP(res, req)
+}
+
+// dialer returns the function used to dial the server, and the TLS configuration used to connect to it, based
+// on the client's transport. The transport's Proxy is not used.
+func (c *client) dialer() (func(ctx context.Context, network, addr string) (net.Conn, error), *tls.Config) {
+	transport := c.http.Transport
+	if t, ok := transport.(*clientTransport); ok {
+		transport = t.next
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	switch t := transport.(type) {
+	case *http.Transport:
+		if t.DialContext != nil {
+			return t.DialContext, t.TLSClientConfig
+		}
+		return (&net.Dialer{}).DialContext, t.TLSClientConfig
+	case *h2cTransport:
+		return t.dial, nil
+	default:
+		return (&net.Dialer{}).DialContext, nil
+	}
+}
+
+// WebSocket upgrades a connection to the server's WebSocket endpoint and exchanges the messages described by
+// spec, validating the echoed messages using SHA256 digests as ReplayN does. The time taken to upgrade the
+// connection is returned as Result.Upgrade, and the round-trip time of each message as Result.RoundTrips.
+// The server is dialed directly, even if the client's transport uses a proxy.
+func (c *client) WebSocket(ctx context.Context, spec WebSocketSpec) (result Result, err error) {
+
+	ctx = c.correlate(ctx, &result)
+	logger := c.logger(ctx)
+	logger.Info("starting websocket exchange", zap.Int("text", spec.TextMessages), zap.Int("binary", spec.BinaryMessages), zap.Int("size", spec.MessageSize))
+
+	if err = spec.Validate(); err != nil {
+		logger.Error("invalid websocket spec", zap.Error(err))
+		return result, result.fail(RequestFailure, err)
+	}
+
+	start := time.Now()
+	defer func() {
+		result.Timings.Total = time.Since(start)
+		logger.Debug("request timings", zap.Object("timings", result.Timings), zap.Duration("upgrade", result.Upgrade))
+	}()
+
+	var config *websocket.Config
+	if u, e := url.Parse(c.server); e != nil {
+		logger.Error("an error occurred generating the websocket request", zap.Error(e))
+		return result, result.fail(RequestFailure, e)
+	} else {
+		origin := *u
+		u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+		u.Path += "/websocket"
+		if config, err = websocket.NewConfig(u.String(), origin.String()); err != nil {
+			logger.Error("an error occurred generating the websocket request", zap.Error(err))
+			return result, result.fail(RequestFailure, err)
+		}
+		if corr, ok := correlationFrom(ctx); ok {
+			corr.set(config.Header)
+		}
+		c.creds.authorize(config.Header, http.MethodGet, config.Location.RequestURI())
+	}
+
+	// Dial the server (or endpoint), respecting ctx until the upgrade is complete
+	dial, tlsConfig := c.dialer()
+	addr := c.endpoint
+	if addr == "" {
+		addr = config.Location.Host
+		if config.Location.Port() == "" {
+			addr = net.JoinHostPort(addr, map[string]string{"ws": "80", "wss": "443"}[config.Location.Scheme])
+		}
+	}
+	var conn net.Conn
+	if conn, err = dial(ctx, "tcp", addr); err != nil {
+		logger.Error("an error occurred connecting to the server", zap.Error(err))
+		return result, result.fail(classifyError(err), err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	result.Timings.Connect = time.Since(start)
+
+	if config.Location.Scheme == "wss" {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = config.Location.Hostname()
+		}
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		tlsStart := time.Now()
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			logger.Error("an error occurred during the TLS handshake", zap.Error(err))
+			return result, result.fail(classifyError(err), err)
+		}
+		result.Timings.TLSHandshake = time.Since(tlsStart)
+		conn = tlsConn
+	}
+
+	upgradeStart := time.Now()
+	var ws *websocket.Conn
+	if ws, err = websocket.NewClient(config, conn); err != nil {
+		err = wsError(ctx, err)
+		logger.Error("an error occurred upgrading to a websocket", zap.Error(err))
+		if errors.Is(err, websocket.ErrBadStatus) {
+			return result, result.fail(StatusFailure, err)
+		}
+		return result, result.fail(classifyError(err), err)
+	}
+	result.Timings.TTFB = time.Since(upgradeStart)
+	result.Upgrade = time.Since(start)
+	result.StatusCode = http.StatusSwitchingProtocols
+	result.Protocol = "websocket"
+	logger.Info("upgraded to websocket", zap.Duration("upgrade", result.Upgrade))
+
+	// Exchange messages, teeing what was sent and received to calculate digests
+	expected, actual := crypto.SHA256.New(), crypto.SHA256.New()
+	binary := source.New(int64(spec.MessageSize) * int64(spec.BinaryMessages))
+	for i := 0; i < spec.TextMessages+spec.BinaryMessages; i++ {
+
+		msg := wsMessage{payloadType: websocket.BinaryFrame, data: make([]byte, spec.MessageSize)}
+		if i < spec.TextMessages {
+			msg.payloadType = websocket.TextFrame
+			textPayload(msg.data, i)
+		} else if _, e := io.ReadFull(binary, msg.data); e != nil {
+			return result, result.fail(RequestFailure, e)
+		}
+		_, _ = expected.Write(msg.data)
+
+		sent := time.Now()
+		if err = wsCodec.Send(ws, msg); err != nil {
+			err = wsError(ctx, err)
+			logger.Error("an error occurred sending a websocket message", zap.Error(err), zap.Int("message", i))
+			return result, result.fail(classifyError(err), err)
+		}
+		result.BytesSent += int64(len(msg.data))
+
+		var echo wsMessage
+		if err = wsCodec.Receive(ws, &echo); err != nil {
+			err = wsError(ctx, err)
+			logger.Error("an error occurred receiving a websocket message", zap.Error(err), zap.Int("message", i))
+			return result, result.fail(classifyError(err), err)
+		}
+		result.RoundTrips = append(result.RoundTrips, time.Since(sent))
+		result.BytesReceived += int64(len(echo.data))
+		_, _ = actual.Write(echo.data)
+
+		if echo.payloadType != msg.payloadType {
+			logger.Error("echoed websocket message had a different frame type", zap.Int("message", i))
+			return result, result.fail(BodyFailure, WebSocketFrameTypeErr)
+		} else if len(echo.data) != len(msg.data) {
+			logger.Error("echoed websocket message length did not match", zap.Int("message", i), zap.Int("expected", len(msg.data)), zap.Int("actual", len(echo.data)))
+			return result, result.fail(LengthFailure, nil)
+		}
+	}
+	_ = ws.Close()
+
+	result.ExpectedDigest = "sha256:" + hex.EncodeToString(expected.Sum(nil))
+	result.ActualDigest = "sha256:" + hex.EncodeToString(actual.Sum(nil))
+	if result.ExpectedDigest == result.ActualDigest {
+		logger.Info("websocket exchange successful", zap.String("digest", result.ActualDigest), zap.Durations("roundTrips", result.RoundTrips))
+		result.OK = true
+	} else {
+		logger.Warn("echoed websocket messages did not match", zap.String("expectedDigest", result.ExpectedDigest), zap.String("actualDigest", result.ActualDigest))
+		result.fail(DigestFailure, nil)
+	}
+	return
+}
+
+// wsError returns the cause of err if the connection was closed because ctx is done, and otherwise treats
+// the connection closing unexpectedly as a reset.
+func wsError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return errors.Join(ctx.Err(), err)
+	} else if errors.Is(err, io.EOF) {
+		return errors.Join(io.ErrUnexpectedEOF, err)
+	}
+	return err
+}
+
+const textAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// textPayload fills p with printable ASCII, varying with n, so text messages are valid UTF-8.
+func textPayload(p []byte, n int) {
+	for i := range p {
+		p[i] = textAlphabet[(i+n)%len(textAlphabet)]
+	}
+}
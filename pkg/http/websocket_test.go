@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2024 Raft, LLC
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/raft-tech/konfirm-inspections/internal/logging"
+)
+
+var _ = Describe("WebSocket", func() {
+
+	spec := WebSocketSpec{TextMessages: 3, BinaryMessages: 3, MessageSize: 64 * 1024}
+
+	It("echoes text and binary messages", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(NewH2CHandler(NewHandler()))
+		DeferCleanup(srv.Close)
+
+		result, err := NewClient(srv.URL, http.DefaultClient).WebSocket(ctx, spec)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeSuccessful())
+		Expect(result.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+		Expect(result.BytesSent).To(Equal(int64(6 * 64 * 1024)))
+		Expect(result.BytesReceived).To(Equal(result.BytesSent))
+		Expect(result.ActualDigest).To(Equal(result.ExpectedDigest))
+		Expect(result.Upgrade).To(BeNumerically(">", 0))
+		Expect(result.RoundTrips).To(HaveLen(6))
+		Expect(result.RoundTripPercentile(1)).To(BeNumerically(">=", result.RoundTripPercentile(0.5)))
+
+		// The endpoint can be overridden
+		addr := srv.Listener.Addr().String()
+		_, port, _ := net.SplitHostPort(addr)
+		Expect(NewClient("http://localhost:"+port, http.DefaultClient, WithEndpoint(addr)).WebSocket(ctx, spec)).To(BeSuccessful())
+		h2cClient, err := NewHTTPClient(ClientConfig{Protocol: H2C})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(NewClient("http://localhost:"+port, h2cClient, WithEndpoint(addr)).WebSocket(ctx, spec)).To(BeSuccessful())
+	})
+
+	It("upgrades over TLS", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewTLSServer(NewHandler(WithFaults(FaultConfig{ContentType: 1})))
+		DeferCleanup(srv.Close)
+
+		result, err := NewClient(srv.URL, srv.Client()).WebSocket(ctx, spec)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeSuccessful())
+		Expect(result.Timings.TLSHandshake).To(BeNumerically(">", 0))
+	})
+
+	It("rejects invalid specs", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		client := NewClient("http://localhost:1", http.DefaultClient)
+		for _, invalid := range []WebSocketSpec{
+			{TextMessages: -1, MessageSize: 1024},
+			{BinaryMessages: 1, MessageSize: -1},
+			{BinaryMessages: 1, MessageSize: int(MaxReplayRequestSize) + 1},
+		} {
+			result, err := client.WebSocket(ctx, invalid)
+			Expect(err).To(MatchError(InvalidWebSocketSpecErr))
+			Expect(result.Failure).To(Equal(RequestFailure))
+		}
+	})
+
+	It("fails if the upgrade is rejected", func(ctx context.Context) {
+		ctx = logging.NewContext(ctx, logger)
+		srv := httptest.NewServer(http.NotFoundHandler())
+		DeferCleanup(srv.Close)
+
+		result, err := NewClient(srv.URL, http.DefaultClient).WebSocket(ctx, spec)
+		Expect(err).To(HaveOccurred())
+		Expect(result.Failure).To(Equal(StatusFailure))
+	})
+})